@@ -2,14 +2,36 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	"code.cloudfoundry.org/go-envstruct"
+	"github.com/poy/cf-canary-router/internal/predicate"
 	"github.com/poy/cf-canary-router/internal/proxy"
 )
 
 type Config struct {
-	Port         int    `env:"PORT, required, report"`
+	Port int `env:"PORT, required, report"`
+
+	// MetricsPort is the port the Prometheus metrics are served on. The
+	// metrics are disabled when it is 0.
+	MetricsPort int `env:"METRICS_PORT, report"`
+
+	// RouterPathPrefix is reserved for the router's own endpoints. Requests
+	// under it are never proxied.
+	RouterPathPrefix string `env:"ROUTER_PATH_PREFIX, report"`
+
+	// ShutdownTimeout is how long in-flight requests and hijacked
+	// connections have to finish once the router is told to stop. Cloud
+	// Foundry kills the router 10 seconds after asking it to stop.
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT, report"`
+
+	// AdminToken is the bearer token required by the admin API. The admin
+	// API is disabled when it is empty.
+	AdminToken string `env:"ADMIN_TOKEN"`
+
 	CurrentRoute string `env:"CURRENT_ROUTE, required, report"`
 	CanaryRoute  string `env:"CANARY_ROUTE, required, report"`
 	LogCacheAddr string `env:"LOG_CACHE_ADDR, required, report"`
@@ -20,27 +42,308 @@ type Config struct {
 	UaaClient       string `env:"UAA_CLIENT, required, report"`
 	UaaClientSecret string `env:"UAA_CLIENT_SECRET"`
 
-	Query string `env:"QUERY, required, report"`
-	Plan  Plan   `env:"PLAN, required, report"`
+	// StateStore shares the progress of the plan between router instances.
+	// It is either "file:<path>" or the URL of a state store server (see
+	// cmd/state-store). The instances do not share progress when it is
+	// empty.
+	StateStore        string        `env:"STATE_STORE, report"`
+	StateStoreToken   string        `env:"STATE_STORE_TOKEN"`
+	StateSyncInterval time.Duration `env:"STATE_SYNC_INTERVAL, report"`
+
+	// Query is the PromQL query that determines if the canary is
+	// successful. Instead, Queries can be given along with QueryExpr, an
+	// expression of their names, && and || (e.g.,
+	// "errors && (latency || low_volume)"). Without QueryExpr, every query
+	// has to succeed. Instead of either, Analysis compares the canary to a
+	// baseline (see predicate.AnalysisConfig). Exactly one of Query, Queries
+	// and Analysis is required.
+	Query     string       `env:"QUERY, report"`
+	Queries   NamedQueries `env:"QUERIES, report"`
+	QueryExpr string       `env:"QUERY_EXPR, report"`
+	Analysis  Analysis     `env:"ANALYSIS, report"`
+
+	// QueryMode, QueryThreshold and QueryNoData decide which results of
+	// Query are a success (see predicate.Evaluation). Queries and
+	// Candidates set their own.
+	QueryMode      predicate.Mode   `env:"QUERY_MODE, report"`
+	QueryThreshold string           `env:"QUERY_THRESHOLD, report"`
+	QueryNoData    predicate.NoData `env:"QUERY_NO_DATA, report"`
+
+	Plan Plan `env:"PLAN, required, report"`
+
+	// Candidates are additional canary routes. The plan sets the weight of
+	// each one by name. The CANARY_ROUTE is named "canary".
+	Candidates Candidates `env:"CANDIDATES, report"`
+
+	// StickyCookie is the name of the cookie used to pin clients to a
+	// backend. Sticky sessions are disabled when it is empty.
+	StickyCookie string `env:"STICKY_COOKIE, report"`
+
+	// Overrides allow a request to force the current or canary route. See
+	// proxy.Override.
+	OverrideHeader     string `env:"OVERRIDE_HEADER, report"`
+	OverrideQueryParam string `env:"OVERRIDE_QUERY_PARAM, report"`
+	OverrideSecret     string `env:"OVERRIDE_SECRET"`
+
+	// SplitMode is either "counter" (default) or "hash". The hash mode
+	// requires SplitKey (e.g., "header:X-User-ID", "cookie:session", "ip" or
+	// "jwt-sub").
+	SplitMode string `env:"SPLIT_MODE, report"`
+	SplitKey  string `env:"SPLIT_KEY, report"`
+
+	// Shadow settings are used while a step of the plan copies requests to
+	// the candidates.
+	ShadowQueueSize   int           `env:"SHADOW_QUEUE_SIZE, report"`
+	ShadowWorkers     int           `env:"SHADOW_WORKERS, report"`
+	ShadowTimeout     time.Duration `env:"SHADOW_TIMEOUT, report"`
+	ShadowMaxBodySize int64         `env:"SHADOW_MAX_BODY_SIZE, report"`
+
+	// Diff settings compare the responses of shadowed requests. A candidate
+	// is aborted once its mismatch rate is above DiffMaxMismatchRate.
+	DiffResponses       bool     `env:"DIFF_RESPONSES, report"`
+	DiffHeaders         []string `env:"DIFF_HEADERS, report"`
+	DiffIgnoreFields    []string `env:"DIFF_IGNORE_FIELDS, report"`
+	DiffMaxBodySize     int      `env:"DIFF_MAX_BODY_SIZE, report"`
+	DiffMaxMismatchRate float64  `env:"DIFF_MAX_MISMATCH_RATE, report"`
+	DiffMinCompared     int64    `env:"DIFF_MIN_COMPARED, report"`
+
+	// Fallback retries requests that failed on a candidate on the current
+	// route. Requests with bodies larger than FallbackMaxBodySize are not
+	// retried.
+	Fallback            bool  `env:"FALLBACK, report"`
+	FallbackMaxBodySize int64 `env:"FALLBACK_MAX_BODY_SIZE, report"`
+
+	// Breaker settings trip a circuit breaker around each candidate. The
+	// breaker is disabled unless BreakerConsecutiveFailures or
+	// BreakerFailureRatio is set.
+	BreakerConsecutiveFailures int           `env:"BREAKER_CONSECUTIVE_FAILURES, report"`
+	BreakerFailureRatio        float64       `env:"BREAKER_FAILURE_RATIO, report"`
+	BreakerWindow              time.Duration `env:"BREAKER_WINDOW, report"`
+	BreakerMinRequests         int           `env:"BREAKER_MIN_REQUESTS, report"`
+
+	// Local settings evaluate the requests the router has seen itself. A
+	// candidate is aborted when its 5xx ratio or its latency (compared to the
+	// current route) is too high. Each rule is disabled when its max is 0.
+	LocalMaxErrorRatio   float64 `env:"LOCAL_MAX_ERROR_RATIO, report"`
+	LocalMaxLatencyRatio float64 `env:"LOCAL_MAX_LATENCY_RATIO, report"`
+	LocalLatencyQuantile float64 `env:"LOCAL_LATENCY_QUANTILE, report"`
+	LocalMinRequests     int64   `env:"LOCAL_MIN_REQUESTS, report"`
+	LocalMaxFailures     int     `env:"LOCAL_MAX_FAILURES, report"`
+
+	// AccessLog writes a line of JSON to stderr for AccessLogSampleRate (0
+	// to 1) of the requests. Events are written to stdout, so the access log
+	// never gets in their way.
+	AccessLog           bool    `env:"ACCESS_LOG, report"`
+	AccessLogSampleRate float64 `env:"ACCESS_LOG_SAMPLE_RATE, report"`
 
 	SkipSSLValidation bool `env:"SKIP_SSL_VALIDATION"`
 }
 
 func loadConfig() Config {
-	cfg := Config{}
+	shadow := proxy.DefaultShadowConfig()
+	cfg := Config{
+		RouterPathPrefix: "/canary-router",
+		SplitMode:        "counter",
+		ShutdownTimeout:  8 * time.Second,
+
+		StateSyncInterval: time.Second,
+
+		ShadowQueueSize:   shadow.QueueSize,
+		ShadowWorkers:     shadow.Workers,
+		ShadowTimeout:     shadow.Timeout,
+		ShadowMaxBodySize: shadow.MaxBodySize,
+
+		DiffMaxBodySize:     1 << 20,
+		DiffMaxMismatchRate: 0.01,
+		DiffMinCompared:     100,
+
+		FallbackMaxBodySize: 64 << 10,
+
+		BreakerWindow:      time.Minute,
+		BreakerMinRequests: 20,
+
+		LocalLatencyQuantile: 0.99,
+		LocalMinRequests:     100,
+		LocalMaxFailures:     10,
+
+		AccessLogSampleRate: 1,
+	}
 	if err := envstruct.Load(&cfg); err != nil {
 		log.Fatal(err)
 	}
 
+	var queries int
+	for _, given := range []bool{cfg.Query != "", len(cfg.Queries) != 0, cfg.Analysis.given()} {
+		if given {
+			queries++
+		}
+	}
+	if queries != 1 {
+		log.Fatal("exactly one of QUERY, QUERIES and ANALYSIS is required")
+	}
+
+	if err := cfg.QueryEvaluation().Validate(); err != nil {
+		log.Fatalf("invalid QUERY_MODE, QUERY_THRESHOLD or QUERY_NO_DATA: %s", err)
+	}
+
+	// The prefix is both a path and the prefix of the paths under it, so
+	// it has to start with a slash but not end with one.
+	if !strings.HasPrefix(cfg.RouterPathPrefix, "/") || strings.HasSuffix(cfg.RouterPathPrefix, "/") {
+		log.Fatalf("invalid ROUTER_PATH_PREFIX: %q has to start with a / and can not end with one", cfg.RouterPathPrefix)
+	}
+
 	envstruct.WriteReport(&cfg)
 
 	return cfg
 }
 
+// QueryEvaluation returns how the results of Query are evaluated.
+func (c Config) QueryEvaluation() predicate.Evaluation {
+	return predicate.Evaluation{
+		Mode:      c.QueryMode,
+		Threshold: c.QueryThreshold,
+		NoData:    c.QueryNoData,
+	}
+}
+
 type Plan struct {
 	Plan proxy.Plan
 }
 
 func (p *Plan) UnmarshalEnv(data string) error {
-	return json.Unmarshal([]byte(data), p)
+	if err := json.Unmarshal([]byte(data), p); err != nil {
+		return err
+	}
+
+	if err := p.Plan.Validate(); err != nil {
+		return err
+	}
+
+	for i, s := range p.Plan {
+		for _, q := range s.Queries {
+			if err := predicate.ValidateQuery(q); err != nil {
+				return fmt.Errorf("step %d: invalid query %q: %s", i+1, q, err)
+			}
+		}
+
+		if s.Evaluation != nil {
+			if err := stepEvaluation(*s.Evaluation).Validate(); err != nil {
+				return fmt.Errorf("step %d: invalid evaluation: %s", i+1, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// stepEvaluation returns how the results of a step's Queries are evaluated.
+func stepEvaluation(e proxy.QueryEvaluation) predicate.Evaluation {
+	return predicate.Evaluation{
+		Mode:      predicate.Mode(e.Mode),
+		Threshold: e.Threshold,
+		NoData:    predicate.NoData(e.NoData),
+	}
+}
+
+// NamedQueries are PromQL queries that are referred to by name.
+type NamedQueries []NamedQuery
+
+type NamedQuery struct {
+	Name  string
+	Query string
+	predicate.Evaluation
+}
+
+func (q *NamedQueries) UnmarshalEnv(data string) error {
+	if err := json.Unmarshal([]byte(data), q); err != nil {
+		return err
+	}
+
+	names := make(map[string]bool)
+	for _, nq := range *q {
+		if nq.Name == "" {
+			return fmt.Errorf("query %q has no name", nq.Query)
+		}
+
+		if names[nq.Name] {
+			return fmt.Errorf("query %s is given more than once", nq.Name)
+		}
+		names[nq.Name] = true
+
+		if err := predicate.ValidateQuery(nq.Query); err != nil {
+			return fmt.Errorf("invalid query %s: %s", nq.Name, err)
+		}
+
+		if err := nq.Evaluation.Validate(); err != nil {
+			return fmt.Errorf("invalid query %s: %s", nq.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Analysis compares the canary to a baseline instead of running a query.
+type Analysis struct {
+	predicate.AnalysisConfig
+}
+
+func (a *Analysis) UnmarshalEnv(data string) error {
+	if err := json.Unmarshal([]byte(data), &a.AnalysisConfig); err != nil {
+		return err
+	}
+
+	return a.AnalysisConfig.Validate()
+}
+
+// given returns true if ANALYSIS is set. A valid analysis has metrics.
+func (a Analysis) given() bool {
+	return len(a.Metrics) != 0
+}
+
+type Candidates []Candidate
+
+// Candidate is a named canary route. If Query is empty, the global query is
+// used to determine whether the candidate is successful. The Evaluation is
+// only used with a Query.
+type Candidate struct {
+	Name  string
+	Route string
+	Query string
+	predicate.Evaluation
+}
+
+func (c *Candidates) UnmarshalEnv(data string) error {
+	if err := json.Unmarshal([]byte(data), c); err != nil {
+		return err
+	}
+
+	names := make(map[string]bool)
+	for _, candidate := range *c {
+		if candidate.Name == "" {
+			return fmt.Errorf("candidate %q has no name", candidate.Route)
+		}
+
+		// The canary's name is taken by CANARY_ROUTE and the current
+		// route's by the metrics.
+		if candidate.Name == proxy.DefaultCandidate || candidate.Name == proxy.CurrentBackend {
+			return fmt.Errorf("candidate name %s is reserved", candidate.Name)
+		}
+
+		if names[candidate.Name] {
+			return fmt.Errorf("candidate %s is given more than once", candidate.Name)
+		}
+		names[candidate.Name] = true
+
+		if candidate.Query != "" {
+			if err := predicate.ValidateQuery(candidate.Query); err != nil {
+				return fmt.Errorf("invalid query for %s: %s", candidate.Name, err)
+			}
+		}
+
+		if err := candidate.Evaluation.Validate(); err != nil {
+			return fmt.Errorf("invalid query for %s: %s", candidate.Name, err)
+		}
+	}
+
+	return nil
 }
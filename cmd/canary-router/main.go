@@ -1,20 +1,35 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	logcache "code.cloudfoundry.org/go-log-cache"
+	"github.com/poy/cf-canary-router/internal/admin"
+	"github.com/poy/cf-canary-router/internal/drain"
+	"github.com/poy/cf-canary-router/internal/health"
+	"github.com/poy/cf-canary-router/internal/metrics"
 	"github.com/poy/cf-canary-router/internal/predicate"
 	"github.com/poy/cf-canary-router/internal/proxy"
+	"github.com/poy/cf-canary-router/internal/statestore"
 	"github.com/poy/cf-canary-router/internal/structuredlogs"
 	"github.com/bradylove/envstruct"
 )
 
+// healthCheckTimeout is how long the readiness checks wait to connect to
+// each backend.
+const healthCheckTimeout = 2 * time.Second
+
 func main() {
 	log.Println("Starting canary router...")
 	defer log.Println("Closing canary router...")
@@ -47,31 +62,457 @@ func main() {
 	// We aren't reading events, so we don't need a LineStream.
 	eventWriter := structuredlogs.NewEventStream(nil, os.Stdout)
 
-	predicate := predicate.NewPromQL(
-		cfg.Query,
-		30,
-		reader,
-		time.Tick(time.Second),
-		log.New(os.Stderr, "", log.LstdFlags),
+	var (
+		plannerOpts []proxy.RoutePlannerOption
+		opts        []proxy.ProxyOption
+		differ      *proxy.Differ
+		predicates  []metrics.Predicate
+	)
+
+	newPromQL := func(query string, e predicate.Evaluation) *predicate.PromQL {
+		return predicate.NewPromQL(
+			query,
+			30,
+			reader,
+			time.Tick(time.Second),
+			log.New(os.Stderr, "", log.LstdFlags),
+			predicate.WithEvaluation(e),
+		)
+	}
+
+	// The global query is either QUERY, the QUERIES combined by QUERY_EXPR
+	// or the ANALYSIS. globalQueries holds their evaluators (without a candidate)
+	// for the metrics. globalQuery is used by every candidate without a
+	// query of its own. The first query reports whether log-cache can be
+	// read.
+	var (
+		globalQueries []metrics.Predicate
+		globalQuery   func(candidate string) proxy.RoutePlannerOption
+		logCache      func() error
+	)
+	switch {
+	case cfg.Analysis.given():
+		analysis := predicate.NewAnalysis(
+			cfg.Analysis.AnalysisConfig,
+			30,
+			reader,
+			time.Tick(time.Second),
+			log.New(os.Stderr, "", log.LstdFlags),
+		)
+		logCache = analysis.Err
+		globalQueries = append(globalQueries, metrics.Predicate{
+			Source: "analysis",
+			Reader: analysis,
+		})
+		globalQuery = func(candidate string) proxy.RoutePlannerOption {
+			return proxy.WithQueryPredicate(candidate, analysis.Predicate)
+		}
+	case cfg.Query != "":
+		promQL := newPromQL(cfg.Query, cfg.QueryEvaluation())
+		logCache = promQL.Err
+		globalQueries = append(globalQueries, metrics.Predicate{
+			Source: "promql",
+			Reader: promQL,
+		})
+		globalQuery = func(candidate string) proxy.RoutePlannerOption {
+			return proxy.WithQueryPredicate(candidate, promQL.Predicate)
+		}
+	default:
+		named := make(map[string]func() bool)
+		for _, q := range cfg.Queries {
+			promQL := newPromQL(q.Query, q.Evaluation)
+			if logCache == nil {
+				logCache = promQL.Err
+			}
+			globalQueries = append(globalQueries, metrics.Predicate{
+				Source: "promql:" + q.Name,
+				Reader: promQL,
+			})
+			named[q.Name] = promQL.Predicate
+		}
+
+		composite, err := predicate.NewComposite(cfg.QueryExpr, named)
+		if err != nil {
+			log.Fatalf("invalid QUERY_EXPR: %s", err)
+		}
+		globalQuery = func(candidate string) proxy.RoutePlannerOption {
+			return proxy.WithQueryCheck(candidate, composite.Check)
+		}
+	}
+
+	// withGlobalQuery adds the global query to the metrics of the candidate
+	// and returns its option for the planner.
+	withGlobalQuery := func(candidate string) proxy.RoutePlannerOption {
+		for _, q := range globalQueries {
+			q.Candidate = candidate
+			predicates = append(predicates, q)
+		}
+
+		return globalQuery(candidate)
+	}
+
+	if cfg.DiffResponses {
+		differ = proxy.NewDiffer(
+			proxy.DiffConfig{
+				Headers:      cfg.DiffHeaders,
+				IgnoreFields: cfg.DiffIgnoreFields,
+				MaxBodySize:  cfg.DiffMaxBodySize,
+			},
+			log.New(os.Stderr, "", log.LstdFlags),
+		)
+		opts = append(opts, proxy.WithDiffer(differ))
+	}
+
+	backendMetrics := proxy.NewMetrics()
+	opts = append(opts, proxy.WithMetrics(backendMetrics))
+
+	// local returns the predicate of the candidate's mismatch rate and the
+	// local rules. The queries are given to the planner separately so that
+	// steps can replace them.
+	local := func(name string) proxy.Predicate {
+		var ps []proxy.Predicate
+		if differ != nil {
+			ps = append(ps, differ.Predicate(name, cfg.DiffMaxMismatchRate, cfg.DiffMinCompared))
+		}
+
+		var rules []predicate.Rule
+		if cfg.LocalMaxErrorRatio > 0 {
+			rules = append(rules, predicate.MaxErrorRatio(
+				name,
+				cfg.LocalMaxErrorRatio,
+				cfg.LocalMinRequests,
+			))
+		}
+
+		if cfg.LocalMaxLatencyRatio > 0 {
+			rules = append(rules, predicate.MaxLatencyRatio(
+				name,
+				proxy.CurrentBackend,
+				cfg.LocalLatencyQuantile,
+				cfg.LocalMaxLatencyRatio,
+				cfg.LocalMinRequests,
+			))
+		}
+
+		if len(rules) > 0 {
+			l := predicate.NewLocal(
+				rules,
+				cfg.LocalMaxFailures,
+				backendMetrics,
+				time.Tick(time.Second),
+				log.New(os.Stderr, "", log.LstdFlags),
+			)
+			ps = append(ps, l.Predicate)
+			predicates = append(predicates, metrics.Predicate{
+				Candidate: name,
+				Source:    "local",
+				Reader:    l,
+			})
+		}
+
+		return proxy.AllPredicates(ps...)
+	}
+
+	for _, c := range cfg.Candidates {
+		opts = append(opts, proxy.WithCandidate(c.Name, c.Route))
+
+		if c.Query == "" {
+			plannerOpts = append(plannerOpts, withGlobalQuery(c.Name))
+		} else {
+			candidatePromQL := newPromQL(c.Query, c.Evaluation)
+			predicates = append(predicates, metrics.Predicate{
+				Candidate: c.Name,
+				Source:    "promql",
+				Reader:    candidatePromQL,
+			})
+			plannerOpts = append(plannerOpts, proxy.WithQueryPredicate(c.Name, candidatePromQL.Predicate))
+		}
+
+		plannerOpts = append(plannerOpts, proxy.WithCandidatePredicate(c.Name, local(c.Name)))
+	}
+
+	plannerOpts = append(plannerOpts, withGlobalQuery(proxy.DefaultCandidate))
+	defaultPredicate := local(proxy.DefaultCandidate)
+
+	plannerOpts = append(plannerOpts,
+		proxy.WithStepQueries(func(query string, e proxy.QueryEvaluation) proxy.StepQuery {
+			ticker := time.NewTicker(time.Second)
+			return stepQuery{
+				PromQL: predicate.NewPromQL(
+					query,
+					30,
+					reader,
+					ticker.C,
+					log.New(os.Stderr, "", log.LstdFlags),
+					predicate.WithEvaluation(stepEvaluation(e)),
+				),
+				ticker: ticker,
+			}
+		}),
 	)
 
+	if cfg.StateStore != "" {
+		for _, pred := range predicates {
+			if h, ok := pred.Reader.(proxy.PredicateHistory); ok {
+				plannerOpts = append(plannerOpts, proxy.WithPredicateHistory(
+					fmt.Sprintf("%s:%s", pred.Candidate, pred.Source),
+					h,
+				))
+			}
+		}
+
+		plannerOpts = append(plannerOpts, proxy.WithStateStore(
+			stateStore(cfg, httpClient),
+			time.Tick(cfg.StateSyncInterval),
+		))
+	}
+
 	planner := proxy.NewRoutePlanner(
 		cfg.Plan.Plan,
-		predicate.Predicate,
+		defaultPredicate,
 		eventWriter,
 		log.New(os.Stderr, "", log.LstdFlags),
+		plannerOpts...,
 	)
 
-	proxy := proxy.New(
+	// Restoring is opt-in: without a STATE_STORE, a restarted router starts
+	// the plan over.
+	switch err := planner.Restore(); err {
+	case nil:
+	case proxy.ErrFinished:
+		log.Printf("Not restarting the plan: %s. Directing traffic to the remaining candidates...", err)
+	case proxy.ErrAborted:
+		log.Printf("Not restarting the plan: %s. Directing traffic to previous route...", err)
+	default:
+		log.Printf("failed to restore the plan: %s", err)
+	}
+
+	if cfg.StickyCookie != "" {
+		opts = append(opts, proxy.WithStickySessions(cfg.StickyCookie))
+	}
+
+	if cfg.OverrideHeader != "" || cfg.OverrideQueryParam != "" {
+		opts = append(opts, proxy.WithOverride(proxy.Override{
+			Header:     cfg.OverrideHeader,
+			QueryParam: cfg.OverrideQueryParam,
+			Secret:     cfg.OverrideSecret,
+		}))
+	}
+
+	opts = append(opts, proxy.WithShadowConfig(proxy.ShadowConfig{
+		QueueSize:   cfg.ShadowQueueSize,
+		Workers:     cfg.ShadowWorkers,
+		Timeout:     cfg.ShadowTimeout,
+		MaxBodySize: cfg.ShadowMaxBodySize,
+	}))
+
+	if cfg.Fallback {
+		opts = append(opts, proxy.WithFallback(cfg.FallbackMaxBodySize, eventWriter))
+	}
+
+	if cfg.BreakerConsecutiveFailures > 0 || cfg.BreakerFailureRatio > 0 {
+		opts = append(opts, proxy.WithCircuitBreaker(
+			proxy.BreakerConfig{
+				ConsecutiveFailures: cfg.BreakerConsecutiveFailures,
+				FailureRatio:        cfg.BreakerFailureRatio,
+				Window:              cfg.BreakerWindow,
+				MinRequests:         cfg.BreakerMinRequests,
+			},
+			planner,
+		))
+	}
+
+	if cfg.AccessLog {
+		opts = append(opts, proxy.WithAccessLog(os.Stderr, cfg.AccessLogSampleRate))
+	}
+
+	switch cfg.SplitMode {
+	case "counter":
+	case "hash":
+		key, err := proxy.ParseKey(cfg.SplitKey)
+		if err != nil {
+			log.Fatalf("invalid SPLIT_KEY: %s", err)
+		}
+		opts = append(opts, proxy.WithHashSplit(key))
+	default:
+		log.Fatalf("unknown SPLIT_MODE: %s", cfg.SplitMode)
+	}
+
+	p := proxy.New(
 		cfg.CurrentRoute,
 		cfg.CanaryRoute,
 		planner,
 		cfg.SkipSSLValidation,
 		log.New(os.Stderr, "", log.LstdFlags),
+		opts...,
 	)
 
-	// Health endpoint
-	log.Fatal(
-		http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port), proxy),
-	)
+	router := http.NewServeMux()
+	router.Handle(cfg.RouterPathPrefix+"/", http.StripPrefix(
+		cfg.RouterPathPrefix,
+		health.NewHandler(healthChecks(cfg, p, logCache, predicates)),
+	))
+
+	if cfg.AdminToken != "" {
+		adminPrefix := cfg.RouterPathPrefix + "/admin"
+		router.Handle(adminPrefix+"/", http.StripPrefix(
+			adminPrefix,
+			admin.NewHandler(planner, cfg.AdminToken),
+		))
+	}
+
+	hijacked := drain.NewHijacked()
+	servers := []*http.Server{{
+		Addr:    fmt.Sprintf(":%d", cfg.Port),
+		Handler: hijacked.Handler(reserve(cfg.RouterPathPrefix, router, p)),
+	}}
+
+	if cfg.MetricsPort != 0 {
+		servers = append(servers, &http.Server{
+			Addr:    fmt.Sprintf(":%d", cfg.MetricsPort),
+			Handler: metrics.NewHandler(backendMetrics, planner, predicates),
+		})
+	}
+
+	for _, s := range servers {
+		go func(s *http.Server) {
+			if err := s.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}(s)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	log.Printf("Received %s. Draining connections...", <-signals)
+
+	shutdown(servers, hijacked, cfg.ShutdownTimeout)
+
+	log.Printf("Plan %s", planner.Stop())
+	if err := eventWriter.Flush(); err != nil {
+		log.Printf("failed to flush events: %s", err)
+	}
+}
+
+// shutdown stops accepting new connections and waits for the in-flight
+// requests and hijacked connections to finish. Whatever is left once the
+// timeout is up is closed.
+func shutdown(servers []*http.Server, hijacked *drain.Hijacked, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+
+			if err := s.Shutdown(ctx); err != nil {
+				log.Printf("failed to drain connections: %s", err)
+				s.Close()
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	if err := hijacked.Wait(ctx); err != nil {
+		log.Printf("closing %d hijacked connections: %s", hijacked.Len(), err)
+		hijacked.Close()
+	}
+}
+
+// healthChecks returns the checks for the readiness endpoint. The router is
+// only unready when it can not reach the current route. The state of the
+// candidates, log-cache and the predicates is reported.
+func healthChecks(
+	cfg Config,
+	p *proxy.Proxy,
+	logCache func() error,
+	predicates []metrics.Predicate,
+) []health.Check {
+	checks := []health.Check{
+		{
+			Name:     proxy.CurrentBackend,
+			Critical: true,
+			Check:    health.DialCheck(cfg.CurrentRoute, healthCheckTimeout),
+		},
+		{
+			Name:  "log-cache",
+			Check: logCache,
+		},
+	}
+
+	candidates := map[string]string{proxy.DefaultCandidate: cfg.CanaryRoute}
+	for _, c := range cfg.Candidates {
+		candidates[c.Name] = c.Route
+	}
+
+	for name, route := range candidates {
+		name, dial := name, health.DialCheck(route, healthCheckTimeout)
+		checks = append(checks, health.Check{
+			Name: name,
+			Check: func() error {
+				if p.Tripped(name) {
+					return errors.New("circuit breaker tripped")
+				}
+
+				return dial()
+			},
+		})
+	}
+
+	for _, pred := range predicates {
+		pred := pred
+		checks = append(checks, health.Check{
+			Name: fmt.Sprintf("predicate:%s:%s", pred.Candidate, pred.Source),
+			Check: func() error {
+				if !pred.Reader.Predicate() {
+					return errors.New("predicate failed")
+				}
+
+				return nil
+			},
+		})
+	}
+
+	return checks
+}
+
+// stepQuery runs one of a step's queries until the plan moves on from the
+// step.
+type stepQuery struct {
+	*predicate.PromQL
+	ticker *time.Ticker
+}
+
+func (q stepQuery) Stop() {
+	q.ticker.Stop()
+	q.PromQL.Stop()
+}
+
+// stateStore returns the store described by STATE_STORE.
+func stateStore(cfg Config, httpClient *http.Client) proxy.StateStore {
+	if strings.HasPrefix(cfg.StateStore, "file:") {
+		return statestore.NewFile(strings.TrimPrefix(cfg.StateStore, "file:"))
+	}
+
+	if strings.HasPrefix(cfg.StateStore, "http://") || strings.HasPrefix(cfg.StateStore, "https://") {
+		return statestore.NewHTTP(cfg.StateStore, cfg.StateStoreToken, httpClient)
+	}
+
+	log.Fatalf("invalid STATE_STORE: %s", cfg.StateStore)
+	return nil
+}
+
+// reserve routes every request under the prefix to h. Every other request is
+// proxied.
+func reserve(prefix string, h, p http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		p.ServeHTTP(w, r)
+	})
 }
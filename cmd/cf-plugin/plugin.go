@@ -94,9 +94,11 @@ func (c cli) GetMetadata() plugin.PluginMetadata {
 						"username":            "Username to use when pushing the app (REQUIRED)",
 						"password":            "Password to use when pushing the app (REQUIRED)",
 						"force":               "Skip warning prompt (default is false)",
+						"auto-approve":        "Approve every gate of the plan without prompting (default is false)",
 						"canary-app":          "The new app to start routing data to (REQUIRED)",
 						"current-app":         "The existing app to start routing data from (REQUIRED)",
-						"plan":                `The migration plan (defaults to '{"Plan":[{"Percentage":10,"Duration":300000000000}]}')`,
+						"plan":                `The migration plan (defaults to '{"Plan":[{"Percentage":10,"Duration":"5m"}]}')`,
+						"plan-file":           "Path to a JSON or YAML file with the migration plan (instead of -plan)",
 						"query":               "The PromQL query that determines if the canary is successful (REQUIRED)",
 						"skip-ssl-validation": "Whether to ignore certificate errors (default is false)",
 					},
@@ -0,0 +1,37 @@
+// state-store serves the progress of a plan so that several canary router
+// instances can share it. The state is kept in memory, so it is lost when the
+// state store restarts.
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/bradylove/envstruct"
+	"github.com/poy/cf-canary-router/internal/statestore"
+)
+
+type Config struct {
+	Port int `env:"PORT, required, report"`
+
+	// Token is the bearer token the canary routers have to give (as
+	// STATE_STORE_TOKEN). Every request is accepted when it is empty.
+	Token string `env:"TOKEN"`
+}
+
+func main() {
+	log.Println("Starting state store...")
+	defer log.Println("Closing state store...")
+
+	var cfg Config
+	if err := envstruct.Load(&cfg); err != nil {
+		log.Fatal(err)
+	}
+	envstruct.WriteReport(&cfg)
+
+	log.Fatal(http.ListenAndServe(
+		fmt.Sprintf(":%d", cfg.Port),
+		statestore.NewHandler(statestore.NewMemory(), cfg.Token),
+	))
+}
@@ -0,0 +1,127 @@
+// Package admin implements an HTTP API that lets an operator step in while
+// the plan runs.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/poy/cf-canary-router/internal/proxy"
+)
+
+// Planner is implemented by proxy.RoutePlanner.
+type Planner interface {
+	Status() proxy.Status
+	Pause() error
+	Resume() error
+	AbortPlan(reason string)
+	Promote() error
+	NextStep() error
+	Approve() error
+	Reject(reason string) error
+}
+
+// Handler serves the admin API. Every request has to have the token as a
+// bearer token. The following endpoints are served:
+//
+//	GET  /status
+//	POST /pause
+//	POST /resume
+//	POST /abort (the reason can be given with the "reason" query parameter)
+//	POST /promote
+//	POST /step/next
+//	POST /approve
+//	POST /reject (the reason can be given with the "reason" query parameter)
+//
+// Every endpoint responds with the status of the plan.
+type Handler struct {
+	p     Planner
+	token string
+	mux   *http.ServeMux
+}
+
+func NewHandler(p Planner, token string) *Handler {
+	h := &Handler{
+		p:     p,
+		token: token,
+		mux:   http.NewServeMux(),
+	}
+
+	h.mux.HandleFunc("/status", h.get(func() error { return nil }))
+	h.mux.HandleFunc("/pause", h.post(p.Pause))
+	h.mux.HandleFunc("/resume", h.post(p.Resume))
+	h.mux.HandleFunc("/promote", h.post(p.Promote))
+	h.mux.HandleFunc("/step/next", h.post(p.NextStep))
+	h.mux.HandleFunc("/approve", h.post(p.Approve))
+	h.mux.HandleFunc("/abort", func(w http.ResponseWriter, r *http.Request) {
+		reason := reason(r, "aborted by operator")
+		h.post(func() error {
+			p.AbortPlan(reason)
+			return nil
+		})(w, r)
+	})
+	h.mux.HandleFunc("/reject", func(w http.ResponseWriter, r *http.Request) {
+		reason := reason(r, "rejected by operator")
+		h.post(func() error {
+			return p.Reject(reason)
+		})(w, r)
+	})
+
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") || h.token == "" {
+		return false
+	}
+
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+// reason returns the "reason" query parameter or the given default.
+func reason(r *http.Request, def string) string {
+	if reason := r.URL.Query().Get("reason"); reason != "" {
+		return reason
+	}
+
+	return def
+}
+
+func (h *Handler) get(action func() error) http.HandlerFunc {
+	return h.method(http.MethodGet, action)
+}
+
+func (h *Handler) post(action func() error) http.HandlerFunc {
+	return h.method(http.MethodPost, action)
+}
+
+func (h *Handler) method(method string, action func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := action(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.p.Status())
+	}
+}
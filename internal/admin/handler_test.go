@@ -0,0 +1,157 @@
+package admin_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/poy/cf-canary-router/internal/admin"
+	"github.com/poy/cf-canary-router/internal/proxy"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TH struct {
+	*testing.T
+
+	spyPlanner *spyPlanner
+	h          *admin.Handler
+}
+
+func TestHandler(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TH {
+		spyPlanner := &spyPlanner{
+			status: proxy.Status{Step: 1, Steps: 2},
+		}
+
+		return TH{
+			T:          t,
+			spyPlanner: spyPlanner,
+			h:          admin.NewHandler(spyPlanner, "some-token"),
+		}
+	})
+
+	o.Spec("it returns the status", func(t TH) {
+		recorder := do(t, "GET", "/status", "some-token")
+		Expect(t, recorder.Code).To(Equal(http.StatusOK))
+
+		var s proxy.Status
+		Expect(t, json.NewDecoder(recorder.Body).Decode(&s)).To(BeNil())
+		Expect(t, s.Step).To(Equal(1))
+		Expect(t, s.Steps).To(Equal(2))
+	})
+
+	o.Spec("it rejects requests without the token", func(t TH) {
+		Expect(t, do(t, "GET", "/status", "").Code).To(Equal(http.StatusUnauthorized))
+		Expect(t, do(t, "POST", "/pause", "wrong-token").Code).To(Equal(http.StatusUnauthorized))
+		Expect(t, t.spyPlanner.actions).To(HaveLen(0))
+	})
+
+	o.Spec("it rejects every request without a configured token", func(t TH) {
+		h := admin.NewHandler(t.spyPlanner, "")
+
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/status", nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("Authorization", "Bearer ")
+		h.ServeHTTP(recorder, req)
+
+		Expect(t, recorder.Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	o.Spec("it performs each action", func(t TH) {
+		for _, path := range []string{"/pause", "/resume", "/promote", "/step/next", "/approve", "/reject", "/abort"} {
+			Expect(t, do(t, "POST", path, "some-token").Code).To(Equal(http.StatusOK))
+		}
+
+		Expect(t, t.spyPlanner.actions).To(Equal([]string{
+			"pause", "resume", "promote", "next", "approve", "reject: rejected by operator", "abort: aborted by operator",
+		}))
+	})
+
+	o.Spec("it aborts with the given reason", func(t TH) {
+		Expect(t, do(t, "POST", "/abort?reason=bad+canary", "some-token").Code).To(Equal(http.StatusOK))
+		Expect(t, t.spyPlanner.actions).To(Equal([]string{"abort: bad canary"}))
+	})
+
+	o.Spec("it only accepts POST for actions", func(t TH) {
+		recorder := do(t, "GET", "/pause", "some-token")
+		Expect(t, recorder.Code).To(Equal(http.StatusMethodNotAllowed))
+		Expect(t, t.spyPlanner.actions).To(HaveLen(0))
+	})
+
+	o.Spec("it returns a conflict when the action does not apply", func(t TH) {
+		t.spyPlanner.err = proxy.ErrFinished
+
+		recorder := do(t, "POST", "/pause", "some-token")
+		Expect(t, recorder.Code).To(Equal(http.StatusConflict))
+		Expect(t, recorder.Body.String()).To(ContainSubstring("plan has finished"))
+	})
+
+	o.Spec("it returns a 404 for unknown paths", func(t TH) {
+		Expect(t, do(t, "POST", "/unknown", "some-token").Code).To(Equal(http.StatusNotFound))
+	})
+}
+
+func do(t TH, method, path, token string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest(method, path, nil)
+	Expect(t, err).To(BeNil())
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	t.h.ServeHTTP(recorder, req)
+	return recorder
+}
+
+type spyPlanner struct {
+	status  proxy.Status
+	err     error
+	actions []string
+}
+
+func (s *spyPlanner) Status() proxy.Status {
+	return s.status
+}
+
+func (s *spyPlanner) Pause() error {
+	s.actions = append(s.actions, "pause")
+	return s.err
+}
+
+func (s *spyPlanner) Resume() error {
+	s.actions = append(s.actions, "resume")
+	return s.err
+}
+
+func (s *spyPlanner) AbortPlan(reason string) {
+	s.actions = append(s.actions, "abort: "+reason)
+}
+
+func (s *spyPlanner) Promote() error {
+	s.actions = append(s.actions, "promote")
+	return s.err
+}
+
+func (s *spyPlanner) NextStep() error {
+	s.actions = append(s.actions, "next")
+	return s.err
+}
+
+func (s *spyPlanner) Approve() error {
+	s.actions = append(s.actions, "approve")
+	return s.err
+}
+
+func (s *spyPlanner) Reject(reason string) error {
+	s.actions = append(s.actions, "reject: "+reason)
+	return s.err
+}
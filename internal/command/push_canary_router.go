@@ -3,10 +3,15 @@ package command
 import (
 	"bufio"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
 	"strconv"
@@ -16,8 +21,10 @@ import (
 	llog "log"
 
 	"code.cloudfoundry.org/cli/plugin"
+	plugin_models "code.cloudfoundry.org/cli/plugin/models"
 	logcache "code.cloudfoundry.org/go-log-cache"
 	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/ghodss/yaml"
 	"github.com/poy/cf-canary-router/internal/proxy"
 	"github.com/poy/cf-canary-router/internal/structuredlogs"
 )
@@ -32,6 +39,34 @@ type Logger interface {
 	Print(...interface{})
 }
 
+// PushOption configures optional behavior of PushCanaryRouter.
+type PushOption func(*pushConfig)
+
+type pushConfig struct {
+	httpClient HTTPClient
+}
+
+// WithHTTPClient replaces the HTTP client used to approve or reject gates.
+// It defaults to a client that honors --skip-ssl-validation.
+func WithHTTPClient(c HTTPClient) PushOption {
+	return func(cfg *pushConfig) {
+		cfg.httpClient = c
+	}
+}
+
+// routerPathPrefix is the ROUTER_PATH_PREFIX the canary router is pushed
+// with. The health check and the admin API are served under it.
+const routerPathPrefix = "/canary-router"
+
+// gateRetryInterval is how long to wait before passing a gate decision to
+// the canary router again. It doubles after each failure up to
+// maxGateRetryInterval. The decision is given up on after maxGateAttempts.
+const (
+	gateRetryInterval    = time.Second
+	maxGateRetryInterval = 30 * time.Second
+	maxGateAttempts      = 10
+)
+
 func PushCanaryRouter(
 	cli plugin.CliConnection,
 	reader io.Reader,
@@ -39,7 +74,13 @@ func PushCanaryRouter(
 	d Downloader,
 	r logcache.Reader,
 	log Logger,
+	opts ...PushOption,
 ) {
+	var cfg pushConfig
+	for _, o := range opts {
+		o(&cfg)
+	}
+
 	f := flag.NewFlagSet("", flag.ContinueOnError)
 	p := f.String("path", "", "")
 	name := f.String("name", "canary-router", "")
@@ -49,7 +90,9 @@ func PushCanaryRouter(
 	currentApp := f.String("current-app", "", "")
 	query := f.String("query", "", "")
 	planStr := f.String("plan", "", "")
+	planFile := f.String("plan-file", "", "")
 	force := f.Bool("force", false, "")
+	autoApprove := f.Bool("auto-approve", false, "")
 	skipSSLValidation := f.Bool("skip-ssl-validation", false, "")
 	err := f.Parse(args)
 	if err != nil {
@@ -57,12 +100,12 @@ func PushCanaryRouter(
 	}
 
 	f.VisitAll(func(flag *flag.Flag) {
-		if flag.Value.String() == "" && (flag.Name != "path" && flag.Name != "plan" && flag.Name != "skip-ssl-validation") {
+		if flag.Value.String() == "" && (flag.Name != "path" && flag.Name != "plan" && flag.Name != "plan-file" && flag.Name != "skip-ssl-validation") {
 			log.Fatalf("required flag --%s missing", flag.Name)
 		}
 	})
 
-	plan := parsePlan(*planStr, log)
+	plan, gated := parsePlan(*planStr, *planFile, log)
 
 	canaryM, err := cli.GetApp(*canaryApp)
 	if err != nil {
@@ -89,6 +132,7 @@ func PushCanaryRouter(
 	currentR := currentM.Routes[0]
 	currentRoute := fmt.Sprintf("https://%s.%s%s", tempRoute, currentR.Domain.Name, currentR.Path)
 
+	buf := bufio.NewReader(reader)
 	if !*force {
 		log.Print(
 			"The canary router functionality is an experimental feature. ",
@@ -96,7 +140,6 @@ func PushCanaryRouter(
 			"Do you wish to proceed? [y/N] ",
 		)
 
-		buf := bufio.NewReader(reader)
 		resp, err := buf.ReadString('\n')
 		if err != nil {
 			log.Fatalf("failed to read user input: %s", err)
@@ -112,104 +155,237 @@ func PushCanaryRouter(
 		log.Printf("Done downloading canary router from github.")
 	}
 
-	_, err = cli.CliCommand(
-		"push", *name,
-		"-p", *p,
+	envs := map[string]string{
+		"UAA_CLIENT":          "cf",
+		"UAA_USER":            *username,
+		"UAA_PASSWORD":        *password,
+		"CANARY_ROUTE":        canaryRoute,
+		"CURRENT_ROUTE":       currentRoute,
+		"QUERY":               *query,
+		"PLAN":                plan,
+		"ROUTER_PATH_PREFIX":  routerPathPrefix,
+		"SKIP_SSL_VALIDATION": strconv.FormatBool(*skipSSLValidation),
+	}
+
+	ro := rollout{
+		cli:               cli,
+		input:             buf,
+		reader:            r,
+		log:               log,
+		name:              *name,
+		path:              *p,
+		canaryApp:         *canaryApp,
+		currentApp:        *currentApp,
+		currentR:          currentR,
+		tempRoute:         tempRoute,
+		envs:              envs,
+		gated:             gated,
+		autoApprove:       *autoApprove,
+		skipSSLValidation: *skipSSLValidation,
+		httpClient:        cfg.httpClient,
+	}
+
+	// The rollout returns its errors so that its deferred clean up runs
+	// before exiting.
+	if err := ro.run(); err != nil {
+		log.Fatalf("%s", err)
+	}
+}
+
+// rollout pushes the canary router in front of the current app and follows
+// the plan.
+type rollout struct {
+	cli    plugin.CliConnection
+	input  *bufio.Reader
+	reader logcache.Reader
+	log    Logger
+
+	name              string
+	path              string
+	canaryApp         string
+	currentApp        string
+	currentR          plugin_models.GetApp_RouteSummary
+	tempRoute         string
+	envs              map[string]string
+	gated             bool
+	autoApprove       bool
+	skipSSLValidation bool
+	httpClient        HTTPClient
+}
+
+func (ro rollout) run() error {
+	cli, log, currentR := ro.cli, ro.log, ro.currentR
+
+	_, err := cli.CliCommand(
+		"push", ro.name,
+		"-p", ro.path,
 		"-b", "binary_buildpack",
 		"-c", "./canary-router",
 		"--no-start",
 		"--no-route",
+		"--health-check-type", "http",
+		"--endpoint", routerPathPrefix+"/live",
 	)
 	if err != nil {
-		log.Fatalf("%s", err)
+		return err
 	}
 
 	defer func() {
 		cli.CliCommandWithoutTerminalOutput(
-			"delete", *name, "-f",
+			"delete", ro.name, "-f",
 		)
 	}()
 
 	// Map the canary app to the current route
 	_, err = cli.CliCommandWithoutTerminalOutput(
-		"map-route", *name,
+		"map-route", ro.name,
 		currentR.Domain.Name,
 		"--hostname", currentR.Host,
 		"--path", currentR.Path,
 	)
 	if err != nil {
-		log.Fatalf("%s", err)
+		return err
 	}
 
 	// Map the current app to a temp route
 	_, err = cli.CliCommandWithoutTerminalOutput(
-		"map-route", *currentApp,
+		"map-route", ro.currentApp,
 		currentR.Domain.Name,
-		"--hostname", tempRoute,
+		"--hostname", ro.tempRoute,
 		"--path", currentR.Path,
 	)
 	if err != nil {
-		log.Fatalf("%s", err)
+		return err
 	}
 
 	defer func() {
-		_, err = cli.CliCommandWithoutTerminalOutput(
-			"unmap-route", *currentApp,
+		_, err := cli.CliCommandWithoutTerminalOutput(
+			"unmap-route", ro.currentApp,
 			currentR.Domain.Name,
-			"--hostname", tempRoute,
+			"--hostname", ro.tempRoute,
 			"--path", currentR.Path,
 		)
 		if err != nil {
-			log.Fatalf("%s", err)
+			log.Printf("failed to unmap the temporary route: %s", err)
 		}
 	}()
 
 	api, err := cli.ApiEndpoint()
 	if err != nil {
-		log.Fatalf("%s", err)
+		return err
 	}
 
-	envs := map[string]string{
-		"UAA_ADDR":            strings.Replace(api, "api", "uaa", 1),
-		"LOG_CACHE_ADDR":      strings.Replace(api, "api", "log-cache", 1),
-		"UAA_CLIENT":          "cf",
-		"UAA_USER":            *username,
-		"UAA_PASSWORD":        *password,
-		"CANARY_ROUTE":        canaryRoute,
-		"CURRENT_ROUTE":       currentRoute,
-		"QUERY":               *query,
-		"PLAN":                plan,
-		"SKIP_SSL_VALIDATION": strconv.FormatBool(*skipSSLValidation),
+	ro.envs["UAA_ADDR"] = strings.Replace(api, "api", "uaa", 1)
+	ro.envs["LOG_CACHE_ADDR"] = strings.Replace(api, "api", "log-cache", 1)
+
+	// Gates are approved through the admin API. It is given a route of its
+	// own as the current route may be a path route. The random suffix keeps
+	// it from clashing with other rollouts on the same domain.
+	var gate *gateClient
+	if ro.gated {
+		adminRoute := fmt.Sprintf("%s-admin-%s", ro.name, randomHex(4))
+		gate = newGateClient(
+			fmt.Sprintf("https://%s.%s%s/admin", adminRoute, currentR.Domain.Name, routerPathPrefix),
+			ro.httpClient,
+			ro.skipSSLValidation,
+		)
+		ro.envs["ADMIN_TOKEN"] = gate.token
+
+		_, err = cli.CliCommandWithoutTerminalOutput(
+			"map-route", ro.name,
+			currentR.Domain.Name,
+			"--hostname", adminRoute,
+		)
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			_, err := cli.CliCommandWithoutTerminalOutput(
+				"delete-route", currentR.Domain.Name,
+				"--hostname", adminRoute,
+				"-f",
+			)
+			if err != nil {
+				log.Printf("failed to delete the admin route: %s", err)
+			}
+		}()
 	}
 
-	for n, value := range envs {
+	for n, value := range ro.envs {
 		_, err := cli.CliCommandWithoutTerminalOutput(
-			"set-env", *name, n, value,
+			"set-env", ro.name, n, value,
 		)
 		if err != nil {
-			log.Fatalf("%s", err)
+			return err
 		}
 	}
 
-	cli.CliCommand("start", *name)
+	cli.CliCommand("start", ro.name)
+
+	// Until the plan decides which app gets the current route, it is given
+	// back to the current app on the way out. Otherwise it would be left
+	// without an app once the canary router is deleted.
+	decided := false
+	defer func() {
+		if decided {
+			return
+		}
+
+		if err := ro.mapRoute(ro.currentApp); err != nil {
+			log.Printf("failed to map the route back to %s: %s", ro.currentApp, err)
+		}
+	}()
 
 	// Remove the route from the current app
 	_, err = cli.CliCommandWithoutTerminalOutput(
-		"unmap-route", *currentApp,
+		"unmap-route", ro.currentApp,
 		currentR.Domain.Name,
 		"--hostname", currentR.Host,
 		"--path", currentR.Path,
 	)
 	if err != nil {
-		log.Fatalf("%s", err)
+		return err
 	}
 
-	appInfo, err := cli.GetApp(*name)
+	appInfo, err := cli.GetApp(ro.name)
 	if err != nil {
-		log.Fatalf("%s", err)
+		return err
+	}
+
+	log.Printf("%s", appInfo.Guid)
+
+	app, err := ro.await(appInfo.Guid, gate)
+	if err != nil {
+		return err
+	}
+
+	if err := ro.mapRoute(app); err != nil {
+		return err
 	}
+	decided = true
 
-	log.Printf(appInfo.Guid)
+	return nil
+}
+
+// mapRoute maps the current route to the given app.
+func (ro rollout) mapRoute(app string) error {
+	_, err := ro.cli.CliCommandWithoutTerminalOutput(
+		"map-route", app,
+		ro.currentR.Domain.Name,
+		"--hostname", ro.currentR.Host,
+		"--path", ro.currentR.Path,
+	)
+
+	return err
+}
+
+// await follows the events of the canary router until the plan finishes or
+// aborts. It returns the app that gets the current route. Gate decisions are
+// read while the events are followed, so a gate that times out or a
+// candidate that aborts is noticed while waiting on the operator.
+func (ro rollout) await(guid string, gate *gateClient) (string, error) {
+	log := ro.log
 
 	envelopes := make(chan *loggregator_v2.Envelope, 10)
 
@@ -217,15 +393,19 @@ func PushCanaryRouter(
 	defer cancel()
 	go logcache.Walk(
 		ctx,
-		appInfo.Guid,
+		guid,
 		func(es []*loggregator_v2.Envelope) bool {
 			for _, e := range es {
-				envelopes <- e
+				select {
+				case envelopes <- e:
+				case <-ctx.Done():
+					return false
+				}
 			}
 
 			return true
 		},
-		r,
+		ro.reader,
 		logcache.WithWalkBackoff(logcache.NewAlwaysRetryBackoff(time.Second)),
 		logcache.WithWalkLogger(llog.New(os.Stderr, "", 0)),
 	)
@@ -233,7 +413,10 @@ func PushCanaryRouter(
 	s := structuredlogs.NewEventStream(func() string {
 		for {
 			e := <-envelopes
-			if len(e.GetLog().GetPayload()) == 0 {
+
+			// Events are written to stdout. Anything else (e.g., the access
+			// log) is written to stderr.
+			if len(e.GetLog().GetPayload()) == 0 || e.GetLog().GetType() != loggregator_v2.Log_OUT {
 				continue
 			}
 
@@ -241,51 +424,181 @@ func PushCanaryRouter(
 		}
 	}, nil)
 
+	events := make(chan structuredlogs.Event)
+	go func() {
+		for {
+			e := s.NextEvent()
+			select {
+			case events <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	lines, inputErrs := readLines(ctx, ro.input)
+
+	var (
+		// prompting is set while the operator is asked for a decision. The
+		// input is only read meanwhile, so a line typed ahead answers the
+		// next prompt.
+		prompting bool
+
+		// retry fires when the decision is passed on again.
+		retry    <-chan time.Time
+		approve  bool
+		attempts int
+	)
+
+	// decide passes the decision on to the canary router. The gate waits on
+	// it, so it is retried with a backoff (e.g., until the admin route is
+	// routable) before giving up.
+	decide := func() error {
+		err := gate.decide(approve)
+		if err == nil {
+			return nil
+		}
+
+		attempts++
+		if attempts >= maxGateAttempts {
+			return fmt.Errorf("%s (gave up after %d attempts)", err, attempts)
+		}
+
+		interval := gateRetryInterval << uint(attempts-1)
+		if interval > maxGateRetryInterval {
+			interval = maxGateRetryInterval
+		}
+
+		log.Printf("%s (retrying in %s)", err, interval)
+		retry = time.After(interval)
+
+		return nil
+	}
+
+	// resolved stops waiting on a gate once the plan moved on without it
+	// (e.g., the gate timed out).
+	resolved := func() {
+		if prompting {
+			log.Printf("The gate is no longer waiting for a decision.")
+		}
+		prompting, retry = false, nil
+	}
+
 	// Wait to see if the canary app succeeds
 	log.Printf("Waiting for events")
 	for {
-		e := s.NextEvent()
-
-		switch e.Code {
-		case proxy.NextPlanStep:
-			log.Printf(e.Message)
-		case proxy.FinishedPlanSteps:
-			log.Printf(e.Message)
-
-			_, err = cli.CliCommandWithoutTerminalOutput(
-				"map-route", *canaryApp,
-				currentR.Domain.Name,
-				"--hostname", currentR.Host,
-				"--path", currentR.Path,
-			)
-			if err != nil {
-				log.Fatalf("%s", err)
+		var (
+			promptLines <-chan string
+			promptErrs  <-chan error
+		)
+		if prompting {
+			promptLines, promptErrs = lines, inputErrs
+		}
+
+		select {
+		case e := <-events:
+			switch e.Code {
+			case proxy.NextPlanStep:
+				resolved()
+				log.Printf("%s", e.Message)
+			case proxy.AbortCandidate, proxy.Paused, proxy.Resumed, proxy.Stopped:
+				log.Printf("%s", e.Message)
+			case proxy.AwaitingApproval:
+				log.Printf("%s", e.Message)
+				if gate == nil {
+					continue
+				}
+
+				prompting, retry, attempts = false, nil, 0
+				if ro.autoApprove {
+					approve = true
+					if err := decide(); err != nil {
+						return "", err
+					}
+					continue
+				}
+
+				log.Print("Do you approve moving on? [y/N] ")
+				prompting = true
+			case proxy.FinishedPlanSteps:
+				resolved()
+				log.Printf("%s", e.Message)
+
+				return ro.canaryApp, nil
+			case proxy.Abort:
+				resolved()
+				log.Printf("%s", e.Message)
+
+				return ro.currentApp, nil
+			}
+		case line := <-promptLines:
+			prompting = false
+			approve = strings.TrimSpace(strings.ToLower(line)) == "y"
+			if err := decide(); err != nil {
+				return "", err
 			}
+		case err := <-promptErrs:
+			return "", fmt.Errorf("failed to read user input: %s", err)
+		case <-retry:
+			retry = nil
+			if err := decide(); err != nil {
+				return "", err
+			}
+		}
+	}
+}
 
-			return
-		case proxy.Abort:
-			log.Printf(e.Message)
-
-			_, err = cli.CliCommandWithoutTerminalOutput(
-				"map-route", *currentApp,
-				currentR.Domain.Name,
-				"--hostname", currentR.Host,
-				"--path", currentR.Path,
-			)
+// readLines reads the given input line by line until it fails (e.g., at the
+// end of the input).
+func readLines(ctx context.Context, r *bufio.Reader) (<-chan string, <-chan error) {
+	lines := make(chan string)
+	errs := make(chan error, 1)
+
+	go func() {
+		for {
+			line, err := r.ReadString('\n')
 			if err != nil {
-				log.Fatalf("%s", err)
+				errs <- err
+				return
 			}
 
-			return
+			select {
+			case lines <- line:
+			case <-ctx.Done():
+				return
+			}
 		}
-	}
+	}()
+
+	return lines, errs
 }
 
-func parsePlan(planStr string, log Logger) string {
+// parsePlan reads the plan from the given JSON or YAML file and validates
+// it. The plan is returned as JSON with the durations in nanoseconds so that
+// every version of the router can read it, along with whether it has gates.
+func parsePlan(planStr, planFile string, log Logger) (string, bool) {
 	type Plan struct {
 		Plan proxy.Plan
 	}
 
+	if planStr != "" && planFile != "" {
+		log.Fatalf("only one of --plan and --plan-file may be given")
+	}
+
+	if planFile != "" {
+		data, err := ioutil.ReadFile(planFile)
+		if err != nil {
+			log.Fatalf("failed to read plan file: %s", err)
+		}
+
+		// Converting to JSON keeps a single parser for both formats.
+		data, err = yaml.YAMLToJSON(data)
+		if err != nil {
+			log.Fatalf("failed to parse plan file: %s", err)
+		}
+		planStr = string(data)
+	}
+
 	if planStr == "" {
 		p := Plan{
 			Plan: proxy.Plan{
@@ -297,7 +610,7 @@ func parsePlan(planStr string, log Logger) string {
 		}
 
 		s, _ := json.Marshal(p)
-		return string(s)
+		return string(s), false
 	}
 
 	var p Plan
@@ -305,5 +618,86 @@ func parsePlan(planStr string, log Logger) string {
 		log.Fatalf("failed to parse plan: %s", err)
 	}
 
-	return planStr
+	if err := p.Plan.Validate(); err != nil {
+		log.Fatalf("invalid plan: %s", err)
+	}
+
+	for _, w := range p.Plan.Warnings() {
+		log.Printf("WARNING: %s", w)
+	}
+
+	s, err := json.Marshal(p)
+	if err != nil {
+		log.Fatalf("failed to encode plan: %s", err)
+	}
+
+	var gated bool
+	for _, step := range p.Plan {
+		gated = gated || step.Gate
+	}
+
+	return string(s), gated
+}
+
+// gateClient approves or rejects gates through the canary router's admin
+// API.
+type gateClient struct {
+	addr   string
+	token  string
+	client HTTPClient
+}
+
+func newGateClient(addr string, c HTTPClient, skipSSLValidation bool) *gateClient {
+	if c == nil {
+		c = &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: skipSSLValidation,
+				},
+			},
+		}
+	}
+
+	return &gateClient{
+		addr:   addr,
+		token:  randomHex(16),
+		client: c,
+	}
+}
+
+// randomHex returns n random bytes encoded as hex.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+func (c *gateClient) decide(approve bool) error {
+	action := "reject"
+	if approve {
+		action = "approve"
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/%s", c.addr, action), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to %s: %s", action, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("failed to %s: %d: %s", action, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return nil
 }
@@ -4,7 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -113,6 +118,8 @@ func TestPushCanaryRouter(t *testing.T) {
 				"-c", "./canary-router",
 				"--no-start",
 				"--no-route",
+				"--health-check-type", "http",
+				"--endpoint", "/canary-router/live",
 			},
 		))
 
@@ -126,6 +133,7 @@ func TestPushCanaryRouter(t *testing.T) {
 			[]string{"set-env", "canary-router", "CURRENT_ROUTE", "https://canary-router-temp.some.route/v1"},
 			[]string{"set-env", "canary-router", "QUERY", "some-query"},
 			[]string{"set-env", "canary-router", "PLAN", `{"Plan":[{"Percentage":99,"Duration":1000}]}`},
+			[]string{"set-env", "canary-router", "ROUTER_PATH_PREFIX", "/canary-router"},
 			[]string{"set-env", "canary-router", "SKIP_SSL_VALIDATION", "true"},
 		))
 
@@ -161,6 +169,8 @@ func TestPushCanaryRouter(t *testing.T) {
 				"-c", "./canary-router",
 				"--no-start",
 				"--no-route",
+				"--health-check-type", "http",
+				"--endpoint", "/canary-router/live",
 			},
 		))
 
@@ -234,6 +244,8 @@ func TestPushCanaryRouter(t *testing.T) {
 				"-c", "./canary-router",
 				"--no-start",
 				"--no-route",
+				"--health-check-type", "http",
+				"--endpoint", "/canary-router/live",
 			},
 		))
 
@@ -326,6 +338,367 @@ func TestPushCanaryRouter(t *testing.T) {
 		))
 	})
 
+	o.Spec("it keeps waiting if a single candidate aborts", func(t TP) {
+		t.spyReader.envelopes = nil
+		t.spyReader.errs = nil
+		writeEvent(structuredlogs.Event{Code: proxy.AbortCandidate, Message: "some-message with 100%"}, t.spyReader)
+		writeEvent(structuredlogs.Event{Code: proxy.FinishedPlanSteps}, t.spyReader)
+		command.PushCanaryRouter(
+			t.cli,
+			t.reader,
+			[]string{
+				"--path", "some-temp-dir",
+				"--username", "some-user",
+				"--password", "some-password",
+				"--canary-app", "canary-app",
+				"--current-app", "current-app",
+				"--query", "some-query",
+			},
+			t.downloader,
+			t.spyReader.read,
+			t.logger,
+		)
+
+		Expect(t, t.logger.printfMessages).To(Contain("some-message with 100%"))
+		Expect(t, t.cli.cliCommandWithoutTerminalOutputArgs).To(Contain(
+			[]string{"map-route", "canary-app", "some.route", "--hostname", "current", "--path", "/v1"},
+		))
+	})
+
+	o.Spec("it approves gates when given --auto-approve", func(t TP) {
+		t.spyReader.envelopes = nil
+		t.spyReader.errs = nil
+		writeEvent(structuredlogs.Event{Code: proxy.AwaitingApproval, Message: "some-message"}, t.spyReader)
+		writeEvent(structuredlogs.Event{Code: proxy.FinishedPlanSteps}, t.spyReader)
+
+		client := &spyGateClient{}
+		command.PushCanaryRouter(
+			t.cli,
+			t.reader,
+			[]string{
+				"--path", "some-temp-dir",
+				"--username", "some-user",
+				"--password", "some-password",
+				"--canary-app", "canary-app",
+				"--current-app", "current-app",
+				"--query", "some-query",
+				"--plan", `{"Plan":[{"Percentage":10,"Duration":"1m"},{"Gate":true}]}`,
+				"--auto-approve",
+			},
+			t.downloader,
+			t.spyReader.read,
+			t.logger,
+			command.WithHTTPClient(client),
+		)
+
+		route := adminRoute(t.cli)
+		Expect(t, strings.HasPrefix(route, "canary-router-admin-")).To(BeTrue())
+		Expect(t, t.cli.cliCommandWithoutTerminalOutputArgs).To(Contain(
+			[]string{"delete-route", "some.route", "--hostname", route, "-f"},
+		))
+		Expect(t, t.logger.printfMessages).To(Contain("some-message"))
+
+		Expect(t, client.requests).To(HaveLen(1))
+		Expect(t, client.requests[0].Method).To(Equal(http.MethodPost))
+		Expect(t, client.requests[0].URL.String()).To(Equal(
+			"https://" + route + ".some.route/canary-router/admin/approve",
+		))
+
+		token := adminToken(t.cli)
+		Expect(t, token).To(Not(Equal("")))
+		Expect(t, client.requests[0].Header.Get("Authorization")).To(Equal("Bearer " + token))
+	})
+
+	o.Spec("it rejects gates that the operator does not approve", func(t TP) {
+		t.spyReader.envelopes = nil
+		t.spyReader.errs = nil
+		writeEvent(structuredlogs.Event{Code: proxy.AwaitingApproval, Message: "some-message"}, t.spyReader)
+
+		client := &spyGateClient{after: func(int) {
+			writeEvent(structuredlogs.Event{Code: proxy.Abort}, t.spyReader)
+		}}
+		command.PushCanaryRouter(
+			t.cli,
+			strings.NewReader("y\nn\n"),
+			[]string{
+				"--path", "some-temp-dir",
+				"--username", "some-user",
+				"--password", "some-password",
+				"--canary-app", "canary-app",
+				"--current-app", "current-app",
+				"--query", "some-query",
+				"--plan", `{"Plan":[{"Percentage":10,"Duration":"1m"},{"Gate":true}]}`,
+			},
+			t.downloader,
+			t.spyReader.read,
+			t.logger,
+			command.WithHTTPClient(client),
+		)
+
+		Expect(t, client.requests).To(HaveLen(1))
+		Expect(t, client.requests[0].URL.String()).To(Equal(
+			"https://" + adminRoute(t.cli) + ".some.route/canary-router/admin/reject",
+		))
+	})
+
+	o.Spec("it gives the admin route a unique hostname based on the name", func(t TP) {
+		var routes []string
+		for i := 0; i < 2; i++ {
+			spyReader := newSpyReader()
+			writeEvent(structuredlogs.Event{Code: proxy.FinishedPlanSteps}, spyReader)
+
+			cli := newStubCliConnection()
+			cli.apiEndpoint = t.cli.apiEndpoint
+			cli.getApp = t.cli.getApp
+
+			command.PushCanaryRouter(
+				cli,
+				strings.NewReader("y\n"),
+				[]string{
+					"--path", "some-temp-dir",
+					"--name", "some-name",
+					"--username", "some-user",
+					"--password", "some-password",
+					"--canary-app", "canary-app",
+					"--current-app", "current-app",
+					"--query", "some-query",
+					"--plan", `{"Plan":[{"Percentage":10,"Duration":"1m"},{"Gate":true}]}`,
+				},
+				t.downloader,
+				spyReader.read,
+				t.logger,
+				command.WithHTTPClient(&spyGateClient{}),
+			)
+
+			routes = append(routes, adminRoute(cli))
+		}
+
+		Expect(t, strings.HasPrefix(routes[0], "some-name-admin-")).To(BeTrue())
+		Expect(t, strings.HasPrefix(routes[1], "some-name-admin-")).To(BeTrue())
+		Expect(t, routes[0]).To(Not(Equal(routes[1])))
+	})
+
+	o.Spec("it retries the gate decision until the canary router takes it", func(t TP) {
+		t.spyReader.envelopes = nil
+		t.spyReader.errs = nil
+		writeEvent(structuredlogs.Event{Code: proxy.AwaitingApproval, Message: "some-message"}, t.spyReader)
+
+		client := &spyGateClient{
+			statuses: []int{http.StatusServiceUnavailable},
+			after: func(status int) {
+				if status == http.StatusOK {
+					writeEvent(structuredlogs.Event{Code: proxy.FinishedPlanSteps}, t.spyReader)
+				}
+			},
+		}
+		command.PushCanaryRouter(
+			t.cli,
+			t.reader,
+			[]string{
+				"--path", "some-temp-dir",
+				"--username", "some-user",
+				"--password", "some-password",
+				"--canary-app", "canary-app",
+				"--current-app", "current-app",
+				"--query", "some-query",
+				"--plan", `{"Plan":[{"Percentage":10,"Duration":"1m"},{"Gate":true}]}`,
+				"--auto-approve",
+			},
+			t.downloader,
+			t.spyReader.read,
+			t.logger,
+			command.WithHTTPClient(client),
+		)
+
+		Expect(t, client.requests).To(HaveLen(2))
+		Expect(t, client.requests[1].URL.String()).To(Equal(
+			"https://" + adminRoute(t.cli) + ".some.route/canary-router/admin/approve",
+		))
+	})
+
+	o.Spec("it fatally logs if the gate decision cannot be read", func(t TP) {
+		t.spyReader.envelopes = nil
+		t.spyReader.errs = nil
+		writeEvent(structuredlogs.Event{Code: proxy.AwaitingApproval, Message: "some-message"}, t.spyReader)
+
+		client := &spyGateClient{}
+		Expect(t, func() {
+			command.PushCanaryRouter(
+				t.cli,
+				t.reader,
+				[]string{
+					"--path", "some-temp-dir",
+					"--username", "some-user",
+					"--password", "some-password",
+					"--canary-app", "canary-app",
+					"--current-app", "current-app",
+					"--query", "some-query",
+					"--plan", `{"Plan":[{"Percentage":10,"Duration":"1m"},{"Gate":true}]}`,
+				},
+				t.downloader,
+				t.spyReader.read,
+				t.logger,
+				command.WithHTTPClient(client),
+			)
+		}).To(Panic())
+
+		Expect(t, t.logger.fatalfMessage).To(Equal("failed to read user input: EOF"))
+		Expect(t, client.requests).To(HaveLen(0))
+
+		// The clean up still runs.
+		Expect(t, t.cli.cliCommandWithoutTerminalOutputArgs).To(Contain(
+			[]string{"delete-route", "some.route", "--hostname", adminRoute(t.cli), "-f"},
+			[]string{"map-route", "current-app", "some.route", "--hostname", "current", "--path", "/v1"},
+			[]string{"delete", "canary-router", "-f"},
+		))
+	})
+
+	o.Spec("it stops retrying the gate decision once the gate times out", func(t TP) {
+		t.spyReader.envelopes = nil
+		t.spyReader.errs = nil
+		writeEvent(structuredlogs.Event{Code: proxy.AwaitingApproval, Message: "some-message"}, t.spyReader)
+
+		var timeout sync.Once
+		client := &spyGateClient{
+			statuses: []int{
+				http.StatusServiceUnavailable,
+				http.StatusServiceUnavailable,
+				http.StatusServiceUnavailable,
+				http.StatusServiceUnavailable,
+			},
+			after: func(int) {
+				timeout.Do(func() {
+					writeEvent(structuredlogs.Event{Code: proxy.Abort, Message: "gate timed out"}, t.spyReader)
+				})
+			},
+		}
+		command.PushCanaryRouter(
+			t.cli,
+			t.reader,
+			[]string{
+				"--path", "some-temp-dir",
+				"--username", "some-user",
+				"--password", "some-password",
+				"--canary-app", "canary-app",
+				"--current-app", "current-app",
+				"--query", "some-query",
+				"--plan", `{"Plan":[{"Percentage":10,"Duration":"1m"},{"Gate":true,"Duration":"1m"}]}`,
+				"--auto-approve",
+			},
+			t.downloader,
+			t.spyReader.read,
+			t.logger,
+			command.WithHTTPClient(client),
+		)
+
+		// The event is read while the decision is retried.
+		Expect(t, len(client.requests) < 4).To(BeTrue())
+		Expect(t, t.logger.printfMessages).To(Contain("gate timed out"))
+		Expect(t, t.cli.cliCommandWithoutTerminalOutputArgs).To(Contain(
+			[]string{"map-route", "current-app", "some.route", "--hostname", "current", "--path", "/v1"},
+		))
+	})
+
+	o.Spec("it stops prompting once the gate times out", func(t TP) {
+		t.spyReader.envelopes = nil
+		t.spyReader.errs = nil
+		writeEvent(structuredlogs.Event{Code: proxy.AwaitingApproval, Message: "some-message"}, t.spyReader)
+		writeEvent(structuredlogs.Event{Code: proxy.NextPlanStep, Message: "some-step"}, t.spyReader)
+		writeEvent(structuredlogs.Event{Code: proxy.FinishedPlanSteps}, t.spyReader)
+
+		// The operator never answers.
+		input, w := io.Pipe()
+		defer w.Close()
+
+		client := &spyGateClient{}
+		command.PushCanaryRouter(
+			t.cli,
+			input,
+			[]string{
+				"--path", "some-temp-dir",
+				"--username", "some-user",
+				"--password", "some-password",
+				"--canary-app", "canary-app",
+				"--current-app", "current-app",
+				"--query", "some-query",
+				"--plan", `{"Plan":[{"Gate":true,"Duration":"1m","OnTimeout":"approve"},{"Percentage":10,"Duration":"1m"}]}`,
+				"--force",
+			},
+			t.downloader,
+			t.spyReader.read,
+			t.logger,
+			command.WithHTTPClient(client),
+		)
+
+		Expect(t, client.requests).To(HaveLen(0))
+		Expect(t, t.logger.printMessages).To(Contain("Do you approve moving on? [y/N] "))
+		Expect(t, t.logger.printfMessages).To(Contain("The gate is no longer waiting for a decision.", "some-step"))
+		Expect(t, t.cli.cliCommandWithoutTerminalOutputArgs).To(Contain(
+			[]string{"map-route", "canary-app", "some.route", "--hostname", "current", "--path", "/v1"},
+		))
+	})
+
+	o.Spec("it does not set up the admin API without gates", func(t TP) {
+		command.PushCanaryRouter(
+			t.cli,
+			t.reader,
+			[]string{
+				"--path", "some-temp-dir",
+				"--username", "some-user",
+				"--password", "some-password",
+				"--canary-app", "canary-app",
+				"--current-app", "current-app",
+				"--query", "some-query",
+			},
+			t.downloader,
+			t.spyReader.read,
+			t.logger,
+		)
+
+		Expect(t, adminToken(t.cli)).To(Equal(""))
+		Expect(t, adminRoute(t.cli)).To(Equal(""))
+	})
+
+	o.Spec("it ignores lines written to stderr", func(t TP) {
+		t.spyReader.envelopes = nil
+		t.spyReader.errs = nil
+
+		eventData, _ := structuredlogs.Event{Code: proxy.Abort}.Marshal()
+		t.spyReader.envelopes = append(t.spyReader.envelopes, []*loggregator_v2.Envelope{{
+			Message: &loggregator_v2.Envelope_Log{
+				Log: &loggregator_v2.Log{
+					Payload: []byte(eventData),
+					Type:    loggregator_v2.Log_ERR,
+				},
+			},
+		}})
+		t.spyReader.errs = append(t.spyReader.errs, nil)
+		writeEvent(structuredlogs.Event{Code: proxy.FinishedPlanSteps}, t.spyReader)
+
+		command.PushCanaryRouter(
+			t.cli,
+			t.reader,
+			[]string{
+				"--path", "some-temp-dir",
+				"--username", "some-user",
+				"--password", "some-password",
+				"--canary-app", "canary-app",
+				"--current-app", "current-app",
+				"--query", "some-query",
+			},
+			t.downloader,
+			t.spyReader.read,
+			t.logger,
+		)
+
+		Expect(t, t.cli.cliCommandWithoutTerminalOutputArgs).To(Contain(
+			[]string{"map-route", "canary-app", "some.route", "--hostname", "current", "--path", "/v1"},
+		))
+		Expect(t, t.cli.cliCommandWithoutTerminalOutputArgs).To(Not(Contain(
+			[]string{"map-route", "current-app", "some.route", "--hostname", "current", "--path", "/v1"},
+		)))
+	})
+
 	o.Spec("it fatally logs if confirmation is given anything other than y", func(t TP) {
 		reader := strings.NewReader("no\n")
 
@@ -604,6 +977,130 @@ func TestPushCanaryRouter(t *testing.T) {
 		Expect(t, t.logger.fatalfMessage).To(Equal("failed to parse plan: invalid character 'i' looking for beginning of value"))
 	})
 
+	o.Spec("fatally logs if a percentage of the plan is finer than 0.01", func(t TP) {
+		Expect(t, func() {
+			command.PushCanaryRouter(
+				t.cli,
+				t.reader,
+				[]string{
+					"--path", "some-temp-dir",
+					"--username", "some-user",
+					"--password", "some-password",
+					"--canary-app", "canary-app",
+					"--current-app", "current-app",
+					"--query", "some-query",
+					"--plan", `{"Plan":[{"Percentage":0.001,"Duration":1000}]}`,
+				},
+				t.downloader,
+				t.spyReader.read,
+				t.logger,
+			)
+		}).To(Panic())
+		Expect(t, t.logger.fatalfMessage).To(Equal("invalid plan: step 1: percentage for canary must be a multiple of 0.01: 0.001"))
+	})
+
+	o.Spec("fatally logs if a step of the plan has no duration", func(t TP) {
+		Expect(t, func() {
+			command.PushCanaryRouter(
+				t.cli,
+				t.reader,
+				[]string{
+					"--path", "some-temp-dir",
+					"--username", "some-user",
+					"--password", "some-password",
+					"--canary-app", "canary-app",
+					"--current-app", "current-app",
+					"--query", "some-query",
+					"--plan", `{"Plan":[{"Percentage":10}]}`,
+				},
+				t.downloader,
+				t.spyReader.read,
+				t.logger,
+			)
+		}).To(Panic())
+		Expect(t, t.logger.fatalfMessage).To(Equal("invalid plan: step 1: duration must be greater than 0: 0s"))
+	})
+
+	o.Spec("it accepts durations as strings and warns about dropping percentages", func(t TP) {
+		command.PushCanaryRouter(
+			t.cli,
+			t.reader,
+			[]string{
+				"--path", "some-temp-dir",
+				"--username", "some-user",
+				"--password", "some-password",
+				"--canary-app", "canary-app",
+				"--current-app", "current-app",
+				"--query", "some-query",
+				"--plan", `{"Plan":[{"Percentage":50,"Duration":"5m"},{"Percentage":10,"Duration":"1h30m"}]}`,
+				"--force",
+			},
+			t.downloader,
+			t.spyReader.read,
+			t.logger,
+		)
+
+		Expect(t, t.cli.cliCommandWithoutTerminalOutputArgs).To(Contain(
+			[]string{"set-env", "canary-router", "PLAN", `{"Plan":[{"Percentage":50,"Duration":300000000000},{"Percentage":10,"Duration":5400000000000}]}`},
+		))
+		Expect(t, t.logger.printfMessages).To(Contain("WARNING: step 2: percentage for canary drops from 50 to 10"))
+	})
+
+	o.Spec("it reads the plan from a YAML file", func(t TP) {
+		f, err := ioutil.TempFile("", "plan")
+		Expect(t, err).To(BeNil())
+		defer os.Remove(f.Name())
+
+		_, err = f.WriteString("plan:\n- percentage: 0.5\n  ramp: exponential\n  duration: 30m\n- percentage: 10\n  duration: 15m\n")
+		Expect(t, err).To(BeNil())
+		Expect(t, f.Close()).To(BeNil())
+
+		command.PushCanaryRouter(
+			t.cli,
+			t.reader,
+			[]string{
+				"--path", "some-temp-dir",
+				"--username", "some-user",
+				"--password", "some-password",
+				"--canary-app", "canary-app",
+				"--current-app", "current-app",
+				"--query", "some-query",
+				"--plan-file", f.Name(),
+				"--force",
+			},
+			t.downloader,
+			t.spyReader.read,
+			t.logger,
+		)
+
+		Expect(t, t.cli.cliCommandWithoutTerminalOutputArgs).To(Contain(
+			[]string{"set-env", "canary-router", "PLAN", `{"Plan":[{"Percentage":0.5,"Ramp":"exponential","Duration":1800000000000},{"Percentage":10,"Duration":900000000000}]}`},
+		))
+	})
+
+	o.Spec("fatally logs if both a plan and a plan file are given", func(t TP) {
+		Expect(t, func() {
+			command.PushCanaryRouter(
+				t.cli,
+				t.reader,
+				[]string{
+					"--path", "some-temp-dir",
+					"--username", "some-user",
+					"--password", "some-password",
+					"--canary-app", "canary-app",
+					"--current-app", "current-app",
+					"--query", "some-query",
+					"--plan", `{"Plan":[{"Percentage":10,"Duration":"5m"}]}`,
+					"--plan-file", "some-file",
+				},
+				t.downloader,
+				t.spyReader.read,
+				t.logger,
+			)
+		}).To(Panic())
+		Expect(t, t.logger.fatalfMessage).To(Equal("only one of --plan and --plan-file may be given"))
+	})
+
 	o.Spec("fatally logs if setting env variables fails", func(t TP) {
 		assert := func(env string) {
 			t.cli.setEnvErrors[env] = errors.New("some-error")
@@ -660,6 +1157,58 @@ func (l *stubLogger) Print(a ...interface{}) {
 	l.printMessages = append(l.printMessages, fmt.Sprint(a...))
 }
 
+// adminToken returns the ADMIN_TOKEN set on the canary router.
+func adminToken(cli *stubCliConnection) string {
+	for _, args := range cli.cliCommandWithoutTerminalOutputArgs {
+		if args[0] == "set-env" && args[2] == "ADMIN_TOKEN" {
+			return args[3]
+		}
+	}
+
+	return ""
+}
+
+// adminRoute returns the hostname the admin API is mapped to.
+func adminRoute(cli *stubCliConnection) string {
+	for _, args := range cli.cliCommandWithoutTerminalOutputArgs {
+		if args[0] == "map-route" && len(args) == 5 && strings.Contains(args[4], "-admin-") {
+			return args[4]
+		}
+	}
+
+	return ""
+}
+
+type spyGateClient struct {
+	requests []*http.Request
+
+	// statuses are returned in order before falling back to 200.
+	statuses []int
+
+	// after is called with the status of each request (e.g., to write the
+	// event the canary router writes next).
+	after func(status int)
+}
+
+func (s *spyGateClient) Do(r *http.Request) (*http.Response, error) {
+	s.requests = append(s.requests, r)
+
+	status := http.StatusOK
+	if len(s.statuses) > 0 {
+		status = s.statuses[0]
+		s.statuses = s.statuses[1:]
+	}
+
+	if s.after != nil {
+		s.after(status)
+	}
+
+	return &http.Response{
+		StatusCode: status,
+		Body:       ioutil.NopCloser(strings.NewReader("{}")),
+	}, nil
+}
+
 type stubDownloader struct {
 	path      string
 	assetName string
@@ -759,6 +1308,7 @@ func (s *spyEventStream) NextEvent() structuredlogs.Event {
 }
 
 type spyReader struct {
+	mu        sync.Mutex
 	sourceIDs []string
 	starts    []int64
 	opts      [][]logcache.ReadOption
@@ -772,6 +1322,9 @@ func newSpyReader() *spyReader {
 }
 
 func (s *spyReader) read(ctx context.Context, sourceID string, start time.Time, opts ...logcache.ReadOption) ([]*loggregator_v2.Envelope, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	s.sourceIDs = append(s.sourceIDs, sourceID)
 	s.starts = append(s.starts, start.UnixNano())
 	s.opts = append(s.opts, opts)
@@ -793,6 +1346,9 @@ func (s *spyReader) read(ctx context.Context, sourceID string, start time.Time,
 }
 
 func writeEvent(e structuredlogs.Event, r *spyReader) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	eventData, _ := e.Marshal()
 	r.envelopes = append(r.envelopes, []*loggregator_v2.Envelope{{
 		Message: &loggregator_v2.Envelope_Log{
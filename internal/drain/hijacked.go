@@ -0,0 +1,139 @@
+// Package drain keeps track of the connections that are hijacked from the
+// router's server (e.g., WebSockets). http.Server.Shutdown does not wait for
+// them, so they are drained separately.
+package drain
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// pollInterval is how often Wait checks for remaining connections.
+const pollInterval = 100 * time.Millisecond
+
+// Hijacked records every connection that is hijacked by the wrapped handler
+// until it is closed.
+type Hijacked struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func NewHijacked() *Hijacked {
+	return &Hijacked{
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+// Handler wraps the given handler. Connections hijacked by it are tracked.
+func (h *Hijacked) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Hijacker); !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		next.ServeHTTP(&hijackResponseWriter{ResponseWriter: w, h: h}, r)
+	})
+}
+
+// Len returns the number of hijacked connections that are still open.
+func (h *Hijacked) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.conns)
+}
+
+// Wait blocks until every hijacked connection has been closed or the
+// context is done.
+func (h *Hijacked) Wait(ctx context.Context) error {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for h.Len() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// Close closes every hijacked connection that is still open.
+func (h *Hijacked) Close() {
+	h.mu.Lock()
+	conns := make([]net.Conn, 0, len(h.conns))
+	for c := range h.conns {
+		conns = append(conns, c)
+	}
+	h.mu.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func (h *Hijacked) add(c net.Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.conns[c] = struct{}{}
+}
+
+func (h *Hijacked) remove(c net.Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.conns, c)
+}
+
+type hijackResponseWriter struct {
+	http.ResponseWriter
+	h *Hijacked
+}
+
+func (w *hijackResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := &trackedConn{Conn: conn, h: w.h}
+	w.h.add(c)
+
+	return c, rw, nil
+}
+
+// Flush implements http.Flusher so responses can still be streamed.
+func (w *hijackResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// trackedConn stops being tracked once it is closed.
+type trackedConn struct {
+	net.Conn
+	h    *Hijacked
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.h.remove(c)
+	})
+
+	return c.Conn.Close()
+}
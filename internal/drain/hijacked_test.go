@@ -0,0 +1,104 @@
+package drain_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-canary-router/internal/drain"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TD struct {
+	*testing.T
+
+	h      *drain.Hijacked
+	server *httptest.Server
+	conns  chan net.Conn
+}
+
+func TestHijacked(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TD {
+		h := drain.NewHijacked()
+		conns := make(chan net.Conn, 10)
+
+		server := httptest.NewServer(h.Handler(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				conns <- conn
+			},
+		)))
+
+		return TD{
+			T:      t,
+			h:      h,
+			server: server,
+			conns:  conns,
+		}
+	})
+
+	o.AfterEach(func(t TD) {
+		t.server.Close()
+	})
+
+	o.Spec("it tracks hijacked connections until they are closed", func(t TD) {
+		conn := hijack(t)
+		Expect(t, t.h.Len()).To(Equal(1))
+
+		conn.Close()
+		Expect(t, t.h.Len()).To(Equal(0))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		Expect(t, t.h.Wait(ctx)).To(BeNil())
+	})
+
+	o.Spec("it stops waiting once the context is done", func(t TD) {
+		hijack(t)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		Expect(t, t.h.Wait(ctx)).To(Equal(context.DeadlineExceeded))
+	})
+
+	o.Spec("it closes the remaining connections", func(t TD) {
+		conn := hijack(t)
+		t.h.Close()
+
+		Expect(t, t.h.Len()).To(Equal(0))
+
+		_, err := conn.Write([]byte("some-data"))
+		Expect(t, err).To(HaveOccurred())
+	})
+}
+
+// hijack makes a request that is hijacked by the server and returns the
+// server's side of the connection.
+func hijack(t TD) net.Conn {
+	client, err := net.Dial("tcp", t.server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Write([]byte("GET / HTTP/1.1\r\nHost: some-host\r\n\r\n"))
+
+	select {
+	case conn := <-t.conns:
+		return conn
+	case <-time.After(time.Second):
+		t.Fatal("request was not hijacked")
+		return nil
+	}
+}
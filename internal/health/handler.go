@@ -0,0 +1,122 @@
+// Package health implements the liveness and readiness endpoints of the
+// canary router.
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Check reports the state of a dependency of the router. Only critical
+// checks make the router unready. The others are reported so an operator
+// can see them.
+type Check struct {
+	Name     string
+	Critical bool
+	Check    func() error
+}
+
+// Report is the body of a readiness response.
+type Report struct {
+	Ready  bool
+	Checks map[string]CheckResult
+}
+
+type CheckResult struct {
+	OK       bool
+	Critical bool
+	Error    string `json:",omitempty"`
+}
+
+// Handler serves "/live" and "/ready". The liveness endpoint succeeds while
+// the router is running. The readiness endpoint runs every check and
+// responds with a 503 if a critical check fails.
+type Handler struct {
+	checks []Check
+	mux    *http.ServeMux
+}
+
+func NewHandler(checks []Check) *Handler {
+	h := &Handler{
+		checks: checks,
+		mux:    http.NewServeMux(),
+	}
+
+	h.mux.HandleFunc("/live", h.live)
+	h.mux.HandleFunc("/ready", h.ready)
+
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) live(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
+
+func (h *Handler) ready(w http.ResponseWriter, r *http.Request) {
+	report := Report{
+		Ready:  true,
+		Checks: make(map[string]CheckResult, len(h.checks)),
+	}
+
+	for _, c := range h.checks {
+		result := CheckResult{
+			OK:       true,
+			Critical: c.Critical,
+		}
+
+		if err := c.Check(); err != nil {
+			result.OK = false
+			result.Error = err.Error()
+
+			if c.Critical {
+				report.Ready = false
+			}
+		}
+
+		report.Checks[c.Name] = result
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
+
+// DialCheck returns a check that succeeds when a TCP connection can be made
+// to the route's host. No request is made, so the check does not show up as
+// traffic for the backend.
+func DialCheck(route string, timeout time.Duration) func() error {
+	return func() error {
+		u, err := url.Parse(route)
+		if err != nil {
+			return err
+		}
+
+		host := u.Host
+		if u.Port() == "" {
+			port := "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+			host = net.JoinHostPort(u.Hostname(), port)
+		}
+
+		conn, err := net.DialTimeout("tcp", host, timeout)
+		if err != nil {
+			return fmt.Errorf("failed to reach %s: %s", host, err)
+		}
+
+		return conn.Close()
+	}
+}
@@ -0,0 +1,109 @@
+package health_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-canary-router/internal/health"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TH struct {
+	*testing.T
+
+	criticalErr error
+	otherErr    error
+	h           *health.Handler
+}
+
+func TestHandler(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) *TH {
+		th := &TH{T: t}
+		th.h = health.NewHandler([]health.Check{
+			{Name: "critical", Critical: true, Check: func() error { return th.criticalErr }},
+			{Name: "other", Check: func() error { return th.otherErr }},
+		})
+
+		return th
+	})
+
+	o.Spec("it is always live", func(t *TH) {
+		t.criticalErr = errors.New("some-error")
+
+		recorder := get(t, "/live")
+		Expect(t, recorder.Code).To(Equal(http.StatusOK))
+	})
+
+	o.Spec("it is ready when every check succeeds", func(t *TH) {
+		recorder := get(t, "/ready")
+		Expect(t, recorder.Code).To(Equal(http.StatusOK))
+
+		var r health.Report
+		Expect(t, json.NewDecoder(recorder.Body).Decode(&r)).To(BeNil())
+		Expect(t, r.Ready).To(BeTrue())
+		Expect(t, r.Checks).To(Equal(map[string]health.CheckResult{
+			"critical": {OK: true, Critical: true},
+			"other":    {OK: true},
+		}))
+	})
+
+	o.Spec("it is ready when a non-critical check fails", func(t *TH) {
+		t.otherErr = errors.New("some-error")
+
+		recorder := get(t, "/ready")
+		Expect(t, recorder.Code).To(Equal(http.StatusOK))
+
+		var r health.Report
+		Expect(t, json.NewDecoder(recorder.Body).Decode(&r)).To(BeNil())
+		Expect(t, r.Checks["other"]).To(Equal(health.CheckResult{Error: "some-error"}))
+	})
+
+	o.Spec("it is not ready when a critical check fails", func(t *TH) {
+		t.criticalErr = errors.New("some-error")
+
+		recorder := get(t, "/ready")
+		Expect(t, recorder.Code).To(Equal(http.StatusServiceUnavailable))
+
+		var r health.Report
+		Expect(t, json.NewDecoder(recorder.Body).Decode(&r)).To(BeNil())
+		Expect(t, r.Ready).To(BeFalse())
+	})
+
+	o.Group("DialCheck", func() {
+		o.Spec("it succeeds when the route accepts connections", func(t *TH) {
+			server := httptest.NewServer(http.NotFoundHandler())
+			defer server.Close()
+
+			Expect(t, health.DialCheck(server.URL, time.Second)()).To(BeNil())
+		})
+
+		o.Spec("it fails when the route does not accept connections", func(t *TH) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(t, err).To(BeNil())
+			addr := l.Addr().String()
+			l.Close()
+
+			Expect(t, health.DialCheck("http://"+addr, time.Second)()).To(Not(BeNil()))
+		})
+	})
+}
+
+func get(t *TH, path string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", path, nil)
+	Expect(t, err).To(BeNil())
+
+	t.h.ServeHTTP(recorder, req)
+	return recorder
+}
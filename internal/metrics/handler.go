@@ -0,0 +1,221 @@
+// Package metrics exposes the state of the canary router in the Prometheus
+// text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/poy/cf-canary-router/internal/proxy"
+)
+
+// BackendReader returns the recorded requests for each backend. It is
+// implemented by proxy.Metrics.
+type BackendReader interface {
+	Backends() []string
+	Stats(backend string) proxy.BackendStats
+}
+
+// StatusReader returns the progress of the plan. It is implemented by
+// proxy.RoutePlanner.
+type StatusReader interface {
+	Status() proxy.Status
+}
+
+// PredicateReader is implemented by predicate.PromQL and predicate.Local.
+type PredicateReader interface {
+	Predicate() bool
+	Failures() int
+}
+
+// ScoreReader is implemented by predicates that score the candidate (e.g.,
+// predicate.Analysis).
+type ScoreReader interface {
+	Score() float64
+	MetricScores() map[string]float64
+}
+
+// Predicate is a predicate that is reported for a candidate. Source
+// distinguishes the different predicates for the same candidate (e.g.,
+// "promql" or "local").
+type Predicate struct {
+	Candidate string
+	Source    string
+	Reader    PredicateReader
+}
+
+// Handler writes the metrics for each request.
+type Handler struct {
+	backends   BackendReader
+	status     StatusReader
+	predicates []Predicate
+}
+
+func NewHandler(b BackendReader, s StatusReader, predicates []Predicate) *Handler {
+	return &Handler{
+		backends:   b,
+		status:     s,
+		predicates: predicates,
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	bw := bufio.NewWriter(w)
+	h.writeBackends(bw)
+	h.writeStatus(bw)
+	h.writePredicates(bw)
+	bw.Flush()
+}
+
+func (h *Handler) writeBackends(w io.Writer) {
+	backends := h.backends.Backends()
+	stats := make(map[string]proxy.BackendStats, len(backends))
+	for _, b := range backends {
+		stats[b] = h.backends.Stats(b)
+	}
+
+	header(w, "canary_router_requests_total", "counter", "Requests sent to each backend.")
+	for _, b := range backends {
+		fmt.Fprintf(w, "canary_router_requests_total{backend=\"%s\"} %d\n", label(b), stats[b].Requests)
+	}
+
+	header(w, "canary_router_responses_total", "counter", "Responses from each backend by status class.")
+	for _, b := range backends {
+		for i, n := range stats[b].StatusClasses {
+			fmt.Fprintf(w, "canary_router_responses_total{backend=\"%s\",class=\"%dxx\"} %d\n", label(b), i+1, n)
+		}
+	}
+
+	header(w, "canary_router_errors_total", "counter", "Failed (5xx) requests to each backend.")
+	for _, b := range backends {
+		fmt.Fprintf(w, "canary_router_errors_total{backend=\"%s\"} %d\n", label(b), stats[b].StatusClasses[4])
+	}
+
+	header(w, "canary_router_request_duration_seconds", "histogram", "Latency of the requests to each backend.")
+	for _, b := range backends {
+		s := stats[b]
+
+		var count int64
+		for i, n := range s.Latencies {
+			count += n
+
+			le := "+Inf"
+			if i < len(proxy.LatencyBuckets) {
+				le = formatFloat(proxy.LatencyBuckets[i].Seconds())
+			}
+			fmt.Fprintf(w, "canary_router_request_duration_seconds_bucket{backend=\"%s\",le=\"%s\"} %d\n", label(b), label(le), count)
+		}
+		fmt.Fprintf(w, "canary_router_request_duration_seconds_sum{backend=\"%s\"} %s\n", label(b), formatFloat(s.LatencySum.Seconds()))
+		fmt.Fprintf(w, "canary_router_request_duration_seconds_count{backend=\"%s\"} %d\n", label(b), count)
+	}
+}
+
+func (h *Handler) writeStatus(w io.Writer) {
+	s := h.status.Status()
+
+	header(w, "canary_router_plan_step", "gauge", "Index of the current step (-1 before the plan starts).")
+	fmt.Fprintf(w, "canary_router_plan_step %d\n", s.Step)
+
+	header(w, "canary_router_plan_steps", "gauge", "Number of steps in the plan.")
+	fmt.Fprintf(w, "canary_router_plan_steps %d\n", s.Steps)
+
+	// The time spent paused does not count towards the step.
+	var inStep float64
+	if !s.StepStarted.IsZero() {
+		end := time.Now()
+		if s.Paused {
+			end = s.PausedAt
+		}
+		inStep = end.Sub(s.StepStarted).Seconds()
+	}
+	header(w, "canary_router_plan_step_seconds", "gauge", "Time spent in the current step.")
+	fmt.Fprintf(w, "canary_router_plan_step_seconds %s\n", formatFloat(inStep))
+
+	names := make([]string, 0, len(s.Weights))
+	for name := range s.Weights {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	header(w, "canary_router_candidate_percentage", "gauge", "Percentage of requests routed to each candidate.")
+	for _, name := range names {
+		fmt.Fprintf(w, "canary_router_candidate_percentage{candidate=\"%s\"} %s\n", label(name), formatFloat(s.Weights[name]))
+	}
+
+	names = names[:0]
+	for name := range s.Aborted {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	header(w, "canary_router_candidate_aborted", "gauge", "Candidates that have been aborted.")
+	for _, name := range names {
+		fmt.Fprintf(w, "canary_router_candidate_aborted{candidate=\"%s\"} 1\n", label(name))
+	}
+}
+
+func (h *Handler) writePredicates(w io.Writer) {
+	header(w, "canary_router_predicate_result", "gauge", "Result of each predicate (1 is success).")
+	for _, p := range h.predicates {
+		var result int
+		if p.Reader.Predicate() {
+			result = 1
+		}
+		fmt.Fprintf(w, "canary_router_predicate_result{candidate=\"%s\",source=\"%s\"} %d\n", label(p.Candidate), label(p.Source), result)
+	}
+
+	header(w, "canary_router_predicate_consecutive_failures", "gauge", "Number of times in a row each predicate has failed.")
+	for _, p := range h.predicates {
+		fmt.Fprintf(w, "canary_router_predicate_consecutive_failures{candidate=\"%s\",source=\"%s\"} %d\n", label(p.Candidate), label(p.Source), p.Reader.Failures())
+	}
+
+	header(w, "canary_router_analysis_score", "gauge", "Overall score (0 to 100) of each analysis.")
+	for _, p := range h.predicates {
+		if s, ok := p.Reader.(ScoreReader); ok {
+			fmt.Fprintf(w, "canary_router_analysis_score{candidate=\"%s\",source=\"%s\"} %s\n", label(p.Candidate), label(p.Source), formatFloat(s.Score()))
+		}
+	}
+
+	header(w, "canary_router_analysis_metric_score", "gauge", "Score (0 to 100) of each metric of each analysis.")
+	for _, p := range h.predicates {
+		s, ok := p.Reader.(ScoreReader)
+		if !ok {
+			continue
+		}
+
+		scores := s.MetricScores()
+		names := make([]string, 0, len(scores))
+		for name := range scores {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			fmt.Fprintf(w, "canary_router_analysis_metric_score{candidate=\"%s\",source=\"%s\",metric=\"%s\"} %s\n", label(p.Candidate), label(p.Source), label(name), formatFloat(scores[name]))
+		}
+	}
+}
+
+func header(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// labelEscaper escapes label values like Prometheus does. Only backslashes,
+// double quotes and line feeds are escaped.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func label(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
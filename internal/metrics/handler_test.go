@@ -0,0 +1,189 @@
+package metrics_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-canary-router/internal/metrics"
+	"github.com/poy/cf-canary-router/internal/proxy"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TH struct {
+	*testing.T
+
+	m            *proxy.Metrics
+	spyStatus    *spyStatus
+	spyPredicate *spyPredicate
+	h            *metrics.Handler
+}
+
+func TestHandler(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TH {
+		m := proxy.NewMetrics()
+		spyStatus := &spyStatus{}
+		spyPredicate := &spyPredicate{}
+
+		return TH{
+			T:            t,
+			m:            m,
+			spyStatus:    spyStatus,
+			spyPredicate: spyPredicate,
+			h: metrics.NewHandler(m, spyStatus, []metrics.Predicate{
+				{Candidate: "canary", Source: "promql", Reader: spyPredicate},
+			}),
+		}
+	})
+
+	o.Spec("it reports the requests to each backend", func(t TH) {
+		t.m.Record("canary", 200, 3*time.Millisecond)
+		t.m.Record("canary", 503, 20*time.Millisecond)
+		t.m.Record("current", 200, 2*time.Second)
+
+		body := scrape(t, t.h)
+
+		Expect(t, body).To(ContainSubstring(`canary_router_requests_total{backend="canary"} 2`))
+		Expect(t, body).To(ContainSubstring(`canary_router_requests_total{backend="current"} 1`))
+		Expect(t, body).To(ContainSubstring(`canary_router_responses_total{backend="canary",class="2xx"} 1`))
+		Expect(t, body).To(ContainSubstring(`canary_router_responses_total{backend="canary",class="5xx"} 1`))
+		Expect(t, body).To(ContainSubstring(`canary_router_errors_total{backend="canary"} 1`))
+		Expect(t, body).To(ContainSubstring(`canary_router_request_duration_seconds_bucket{backend="canary",le="0.005"} 1`))
+		Expect(t, body).To(ContainSubstring(`canary_router_request_duration_seconds_bucket{backend="canary",le="0.025"} 2`))
+		Expect(t, body).To(ContainSubstring(`canary_router_request_duration_seconds_bucket{backend="canary",le="+Inf"} 2`))
+		Expect(t, body).To(ContainSubstring(`canary_router_request_duration_seconds_sum{backend="canary"} 0.023`))
+		Expect(t, body).To(ContainSubstring(`canary_router_request_duration_seconds_count{backend="current"} 1`))
+		Expect(t, body).To(ContainSubstring("# TYPE canary_router_request_duration_seconds histogram"))
+	})
+
+	o.Spec("it reports the progress of the plan", func(t TH) {
+		t.spyStatus.status = proxy.Status{
+			Step:        1,
+			Steps:       3,
+			StepStarted: time.Now().Add(-time.Minute),
+			Weights:     map[string]float64{"canary": 20},
+			Aborted:     map[string]string{"other": "predicate failed"},
+		}
+
+		body := scrape(t, t.h)
+
+		Expect(t, body).To(ContainSubstring("canary_router_plan_step 1\n"))
+		Expect(t, body).To(ContainSubstring("canary_router_plan_steps 3\n"))
+		Expect(t, body).To(ContainSubstring("canary_router_plan_step_seconds 60."))
+		Expect(t, body).To(ContainSubstring(`canary_router_candidate_percentage{candidate="canary"} 20`))
+		Expect(t, body).To(ContainSubstring(`canary_router_candidate_aborted{candidate="other"} 1`))
+	})
+
+	o.Spec("it reports zero time in a step before the plan starts", func(t TH) {
+		t.spyStatus.status = proxy.Status{Step: -1}
+
+		body := scrape(t, t.h)
+
+		Expect(t, body).To(ContainSubstring("canary_router_plan_step -1\n"))
+		Expect(t, body).To(ContainSubstring("canary_router_plan_step_seconds 0\n"))
+	})
+
+	o.Spec("it does not count the time spent paused towards the step", func(t TH) {
+		started := time.Now().Add(-time.Hour)
+		t.spyStatus.status = proxy.Status{
+			Step:        1,
+			Steps:       3,
+			StepStarted: started,
+			Paused:      true,
+			PausedAt:    started.Add(time.Minute),
+		}
+
+		Expect(t, scrape(t, t.h)).To(ContainSubstring("canary_router_plan_step_seconds 60\n"))
+	})
+
+	o.Spec("it escapes label values", func(t TH) {
+		t.m.Record("some\\\"backend\"\n", 200, time.Millisecond)
+		t.m.Record("some\tbackend", 200, time.Millisecond)
+
+		body := scrape(t, t.h)
+
+		Expect(t, body).To(ContainSubstring(`canary_router_requests_total{backend="some\\\"backend\"\n"} 1`))
+		Expect(t, body).To(ContainSubstring("canary_router_requests_total{backend=\"some\tbackend\"} 1"))
+	})
+
+	o.Spec("it reports the predicates", func(t TH) {
+		t.spyPredicate.result = true
+		t.spyPredicate.failures = 2
+
+		body := scrape(t, t.h)
+
+		Expect(t, body).To(ContainSubstring(`canary_router_predicate_result{candidate="canary",source="promql"} 1`))
+		Expect(t, body).To(ContainSubstring(`canary_router_predicate_consecutive_failures{candidate="canary",source="promql"} 2`))
+		Expect(t, body).To(Not(ContainSubstring(`canary_router_analysis_score{`)))
+	})
+
+	o.Spec("it reports the scores of an analysis", func(t TH) {
+		h := metrics.NewHandler(proxy.NewMetrics(), t.spyStatus, []metrics.Predicate{
+			{Candidate: "canary", Source: "analysis", Reader: &spyAnalysis{
+				score:        62.5,
+				metricScores: map[string]float64{"latency": 25, "errors": 100},
+			}},
+		})
+
+		body := scrape(t, h)
+
+		Expect(t, body).To(ContainSubstring(`canary_router_analysis_score{candidate="canary",source="analysis"} 62.5`))
+		Expect(t, body).To(ContainSubstring(`canary_router_analysis_metric_score{candidate="canary",source="analysis",metric="errors"} 100`))
+		Expect(t, body).To(ContainSubstring(`canary_router_analysis_metric_score{candidate="canary",source="analysis",metric="latency"} 25`))
+	})
+}
+
+func scrape(t TH, h http.Handler) string {
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "http://some.url/metrics", nil)
+	Expect(t, err).To(BeNil())
+
+	h.ServeHTTP(recorder, req)
+	Expect(t, recorder.Code).To(Equal(http.StatusOK))
+	Expect(t, recorder.Header().Get("Content-Type")).To(ContainSubstring("text/plain"))
+
+	return recorder.Body.String()
+}
+
+type spyStatus struct {
+	status proxy.Status
+}
+
+func (s *spyStatus) Status() proxy.Status {
+	return s.status
+}
+
+type spyPredicate struct {
+	result   bool
+	failures int
+}
+
+func (s *spyPredicate) Predicate() bool {
+	return s.result
+}
+
+func (s *spyPredicate) Failures() int {
+	return s.failures
+}
+
+type spyAnalysis struct {
+	spyPredicate
+
+	score        float64
+	metricScores map[string]float64
+}
+
+func (s *spyAnalysis) Score() float64 {
+	return s.score
+}
+
+func (s *spyAnalysis) MetricScores() map[string]float64 {
+	return s.metricScores
+}
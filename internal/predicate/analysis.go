@@ -0,0 +1,471 @@
+package predicate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/loggregator/prometheus/promql"
+)
+
+// SourceIDPlaceholder is replaced with the source ID of the canary and the
+// baseline in the queries of an analysis.
+const SourceIDPlaceholder = "$source_id"
+
+// Direction is the direction in which a metric of the canary may not differ
+// from the baseline.
+type Direction string
+
+const (
+	// DirectionIncrease fails the canary when its values are higher (e.g.,
+	// latency). It is the default.
+	DirectionIncrease Direction = "increase"
+
+	// DirectionDecrease fails the canary when its values are lower (e.g.,
+	// throughput).
+	DirectionDecrease Direction = "decrease"
+
+	// DirectionEither fails the canary when its values differ either way.
+	DirectionEither Direction = "either"
+)
+
+// AnalysisMetric is a metric the canary is compared to the baseline on.
+type AnalysisMetric struct {
+	Name string
+
+	// Query selects the values of the metric (e.g.,
+	// `http{source_id="$source_id"}[10m]`). Every sample of the range or
+	// instant vector it yields is a value. It is run once with each source
+	// ID in place of SourceIDPlaceholder.
+	Query string
+
+	Direction Direction `json:",omitempty"`
+
+	// Weight is the share of the metric in the overall score. It defaults
+	// to 1.
+	Weight float64 `json:",omitempty"`
+}
+
+// AnalysisConfig configures an Analysis.
+type AnalysisConfig struct {
+	CanarySourceID   string
+	BaselineSourceID string
+	Metrics          []AnalysisMetric
+
+	// MinScore is the overall score (0 to 100) the canary has to reach.
+	MinScore float64
+
+	// Alpha is the significance level of the test. A metric scores 100
+	// unless the p-value of the canary being worse is below Alpha. It
+	// defaults to 0.05.
+	Alpha float64 `json:",omitempty"`
+
+	// MinSamples is the number of values each of the canary and the
+	// baseline need for a metric to be scored. It defaults to 10.
+	MinSamples int `json:",omitempty"`
+
+	// NoData decides what happens when none of the metrics can be scored.
+	NoData NoData `json:",omitempty"`
+}
+
+// Validate returns an error describing the first problem with the config.
+func (c AnalysisConfig) Validate() error {
+	if c.CanarySourceID == "" || c.BaselineSourceID == "" {
+		return errors.New("the canary and baseline source IDs are required")
+	}
+
+	if len(c.Metrics) == 0 {
+		return errors.New("analysis has no metrics")
+	}
+
+	if c.MinScore < 0 || c.MinScore > 100 {
+		return fmt.Errorf("MinScore must be between 0 and 100: %g", c.MinScore)
+	}
+
+	if c.Alpha < 0 || c.Alpha >= 1 {
+		return fmt.Errorf("Alpha must be between 0 and 1: %g", c.Alpha)
+	}
+
+	if c.MinSamples < 0 {
+		return fmt.Errorf("MinSamples must not be negative: %d", c.MinSamples)
+	}
+
+	if err := (Evaluation{NoData: c.NoData}).Validate(); err != nil {
+		return err
+	}
+
+	names := make(map[string]bool)
+	for _, m := range c.Metrics {
+		if m.Name == "" || names[m.Name] {
+			return fmt.Errorf("metric names must be given and unique: %q", m.Name)
+		}
+		names[m.Name] = true
+
+		if !strings.Contains(m.Query, SourceIDPlaceholder) {
+			return fmt.Errorf("query of %s does not contain %s", m.Name, SourceIDPlaceholder)
+		}
+
+		if err := ValidateQuery(m.query(c.CanarySourceID)); err != nil {
+			return fmt.Errorf("invalid query of %s: %s", m.Name, err)
+		}
+
+		switch m.Direction {
+		case "", DirectionIncrease, DirectionDecrease, DirectionEither:
+		default:
+			return fmt.Errorf("unknown direction of %s: %s", m.Name, m.Direction)
+		}
+
+		if m.Weight < 0 {
+			return fmt.Errorf("weight of %s must not be negative: %g", m.Name, m.Weight)
+		}
+	}
+
+	return nil
+}
+
+func (m AnalysisMetric) query(sourceID string) string {
+	return strings.Replace(m.Query, SourceIDPlaceholder, sourceID, -1)
+}
+
+// Analysis compares the metrics of the canary to the ones of the baseline
+// with a Mann-Whitney U test. Each metric is scored from 0 to 100 and the
+// overall score is the weighted average of the metrics with enough data. It
+// stands in for a PromQL: it fails once the overall score has been below
+// MinScore maxFailures times in a row.
+type Analysis struct {
+	cfg         AnalysisConfig
+	r           DataReader
+	log         *log.Logger
+	maxFailures int
+	ticker      <-chan time.Time
+
+	result      int64
+	failures    int64
+	evaluations int64
+	done        chan struct{}
+	stop        sync.Once
+
+	// err holds the error (wrapped in queryErr) of the latest evaluation.
+	err atomic.Value
+
+	// scores holds the scores of the latest evaluation.
+	scores atomic.Value
+}
+
+type analysisScores struct {
+	overall float64
+	metrics map[string]float64
+}
+
+// NewAnalysis starts comparing the canary to the baseline on each tick. The
+// config has to be valid (see AnalysisConfig.Validate).
+func NewAnalysis(
+	cfg AnalysisConfig,
+	maxFailures int,
+	r DataReader,
+	ticker <-chan time.Time,
+	log *log.Logger,
+) *Analysis {
+	if cfg.Alpha == 0 {
+		cfg.Alpha = 0.05
+	}
+
+	if cfg.MinSamples == 0 {
+		cfg.MinSamples = 10
+	}
+
+	a := &Analysis{
+		cfg:         cfg,
+		r:           r,
+		log:         log,
+		maxFailures: maxFailures,
+		ticker:      ticker,
+		result:      1,
+		done:        make(chan struct{}),
+	}
+	a.scores.Store(analysisScores{overall: 100})
+
+	go a.start()
+
+	return a
+}
+
+func (a *Analysis) Predicate() bool {
+	return atomic.LoadInt64(&a.result) != 0
+}
+
+// Err returns the error of the latest evaluation. It is nil if every query
+// (and reading from log-cache) succeeded.
+func (a *Analysis) Err() error {
+	e, _ := a.err.Load().(queryErr)
+	return e.err
+}
+
+// Failures returns the number of times in a row the canary has scored
+// below MinScore.
+func (a *Analysis) Failures() int {
+	return int(atomic.LoadInt64(&a.failures))
+}
+
+// RestoreFailures sets the number of times in a row the canary has scored
+// below MinScore (e.g., before the router restarted).
+func (a *Analysis) RestoreFailures(n int) {
+	atomic.StoreInt64(&a.failures, int64(n))
+	if n > 0 && n >= a.maxFailures {
+		atomic.StoreInt64(&a.result, 0)
+	}
+}
+
+// Evaluations returns the number of times the canary has been scored at or
+// above MinScore.
+func (a *Analysis) Evaluations() int {
+	return int(atomic.LoadInt64(&a.evaluations))
+}
+
+// Score returns the overall score of the latest evaluation. It is 100
+// before the first evaluation. Without a metric to score, it is 100 if
+// NoData passes, 0 if it fails and the previous score if it holds.
+func (a *Analysis) Score() float64 {
+	return a.scores.Load().(analysisScores).overall
+}
+
+// MetricScores returns the score of each metric of the latest evaluation.
+// Metrics without enough data are left out.
+func (a *Analysis) MetricScores() map[string]float64 {
+	scores := a.scores.Load().(analysisScores).metrics
+	m := make(map[string]float64, len(scores))
+	for name, s := range scores {
+		m[name] = s
+	}
+
+	return m
+}
+
+// Stop stops evaluating. The predicate keeps its latest result.
+func (a *Analysis) Stop() {
+	a.stop.Do(func() {
+		close(a.done)
+	})
+}
+
+func (a *Analysis) start() {
+	e := promql.NewEngine(&logCacheQueryable{
+		log:        a.log,
+		interval:   time.Second,
+		dataReader: a.r,
+	}, nil)
+
+	for {
+		select {
+		case <-a.ticker:
+		case <-a.done:
+			return
+		}
+
+		o, err := a.evaluate(e)
+		a.err.Store(queryErr{err: err})
+		if err != nil {
+			a.log.Printf("analysis error: %s", err)
+			atomic.StoreInt64(&a.result, 0)
+			continue
+		}
+
+		hasData := o != noData
+		if o == noData {
+			switch a.cfg.NoData {
+			case NoDataPass:
+				o = success
+			case NoDataHold:
+				continue
+			default:
+				o = failure
+			}
+		}
+
+		if o == failure {
+			if atomic.AddInt64(&a.failures, 1) >= int64(a.maxFailures) {
+				atomic.StoreInt64(&a.result, 0)
+				return
+			}
+
+			continue
+		}
+
+		atomic.StoreInt64(&a.failures, 0)
+		atomic.StoreInt64(&a.result, 1)
+		if hasData {
+			atomic.AddInt64(&a.evaluations, 1)
+		}
+	}
+}
+
+// evaluate scores each metric and compares the overall score to MinScore.
+func (a *Analysis) evaluate(e *promql.Engine) (outcome, error) {
+	scores := analysisScores{metrics: make(map[string]float64)}
+
+	var total, weights float64
+	for _, m := range a.cfg.Metrics {
+		canary, err := a.values(e, m.query(a.cfg.CanarySourceID))
+		if err != nil {
+			return failure, fmt.Errorf("%s: %s", m.Name, err)
+		}
+
+		baseline, err := a.values(e, m.query(a.cfg.BaselineSourceID))
+		if err != nil {
+			return failure, fmt.Errorf("%s: %s", m.Name, err)
+		}
+
+		if len(canary) < a.cfg.MinSamples || len(baseline) < a.cfg.MinSamples {
+			continue
+		}
+
+		score := a.score(m.Direction, canary, baseline)
+		scores.metrics[m.Name] = score
+
+		weight := m.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		total += score * weight
+		weights += weight
+	}
+
+	// Without a metric to score, the score follows the NoData policy so
+	// that the score of an earlier evaluation is not reported as current.
+	if weights == 0 {
+		switch a.cfg.NoData {
+		case NoDataPass:
+			scores.overall = 100
+		case NoDataHold:
+			scores.overall = a.Score()
+		}
+		a.scores.Store(scores)
+
+		return noData, nil
+	}
+
+	scores.overall = total / weights
+	a.scores.Store(scores)
+
+	if scores.overall < a.cfg.MinScore {
+		a.log.Printf("analysis scored %.1f (below %g): %v", scores.overall, a.cfg.MinScore, scores.metrics)
+		return failure, nil
+	}
+
+	return success, nil
+}
+
+// values runs the query and returns the value of every sample.
+func (a *Analysis) values(e *promql.Engine, query string) ([]float64, error) {
+	q, err := e.NewInstantQuery(query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result := q.Exec(ctx)
+	if result.Err != nil {
+		return nil, result.Err
+	}
+
+	var values []float64
+	switch v := result.Value.(type) {
+	case promql.Matrix:
+		for _, s := range v {
+			for _, p := range s.Points {
+				values = append(values, p.V)
+			}
+		}
+	case promql.Vector:
+		for _, s := range v {
+			values = append(values, s.V)
+		}
+	case promql.Scalar:
+		values = append(values, v.V)
+	}
+
+	return values, nil
+}
+
+// score scores the canary from 0 to 100. It is 100 unless the canary is
+// worse than the baseline with a p-value below Alpha, and drops linearly to
+// 0 along with the p-value.
+func (a *Analysis) score(d Direction, canary, baseline []float64) float64 {
+	greater, less := mannWhitneyU(canary, baseline)
+
+	var p float64
+	switch d {
+	case DirectionDecrease:
+		p = less
+	case DirectionEither:
+		p = math.Min(1, 2*math.Min(greater, less))
+	default:
+		p = greater
+	}
+
+	return 100 * math.Min(1, p/a.cfg.Alpha)
+}
+
+// mannWhitneyU returns the one-sided p-values of the values of x being
+// greater and less than the values of y. It uses the normal approximation
+// with a correction for ties and continuity.
+func mannWhitneyU(x, y []float64) (greater, less float64) {
+	type value struct {
+		v float64
+		x bool
+	}
+
+	values := make([]value, 0, len(x)+len(y))
+	for _, v := range x {
+		values = append(values, value{v: v, x: true})
+	}
+	for _, v := range y {
+		values = append(values, value{v: v})
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].v < values[j].v })
+
+	// Tied values share the average of their ranks.
+	var rankSum, ties float64
+	for i := 0; i < len(values); {
+		j := i
+		for j < len(values) && values[j].v == values[i].v {
+			j++
+		}
+
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			if values[k].x {
+				rankSum += rank
+			}
+		}
+
+		t := float64(j - i)
+		ties += t*t*t - t
+		i = j
+	}
+
+	n1, n2 := float64(len(x)), float64(len(y))
+	n := n1 + n2
+	u := rankSum - n1*(n1+1)/2
+	mean := n1 * n2 / 2
+	variance := n1 * n2 / 12 * ((n + 1) - ties/(n*(n-1)))
+	if variance <= 0 {
+		// Every value is the same.
+		return 1, 1
+	}
+	sd := math.Sqrt(variance)
+
+	greater = 0.5 * math.Erfc((u-mean-0.5)/sd/math.Sqrt2)
+	less = 0.5 * math.Erfc(-(u-mean+0.5)/sd/math.Sqrt2)
+
+	return math.Min(1, greater), math.Min(1, less)
+}
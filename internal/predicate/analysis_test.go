@@ -0,0 +1,190 @@
+package predicate_test
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	logcache "code.cloudfoundry.org/go-log-cache"
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/poy/cf-canary-router/internal/predicate"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TA struct {
+	*testing.T
+
+	reader *stubSourceReader
+	ticker chan time.Time
+	cfg    predicate.AnalysisConfig
+}
+
+func TestAnalysis(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TA {
+		return TA{
+			T:      t,
+			reader: newStubSourceReader(),
+			ticker: make(chan time.Time, 10),
+			cfg: predicate.AnalysisConfig{
+				CanarySourceID:   "canary-id",
+				BaselineSourceID: "baseline-id",
+				MinScore:         75,
+				Metrics: []predicate.AnalysisMetric{{
+					Name:  "latency",
+					Query: `latency{source_id="$source_id"}[10m]`,
+				}},
+			},
+		}
+	})
+
+	newAnalysis := func(t TA) *predicate.Analysis {
+		Expect(t, t.cfg.Validate()).To(BeNil())
+		return predicate.NewAnalysis(t.cfg, 1, t.reader, t.ticker, log.New(ioutil.Discard, "", 0))
+	}
+
+	o.Spec("it passes while the canary is like the baseline", func(t TA) {
+		t.reader.setLatencies("canary-id", 1, 20)
+		t.reader.setLatencies("baseline-id", 1, 20)
+		a := newAnalysis(t)
+
+		t.ticker <- time.Now()
+		Expect(t, a.Evaluations).To(ViaPolling(Equal(1)))
+		Expect(t, a.Predicate()).To(BeTrue())
+		Expect(t, a.Score()).To(Equal(100.0))
+		Expect(t, a.MetricScores()).To(Equal(map[string]float64{"latency": 100}))
+	})
+
+	o.Spec("it fails once the canary is worse than the baseline", func(t TA) {
+		t.reader.setLatencies("canary-id", 101, 20)
+		t.reader.setLatencies("baseline-id", 1, 20)
+		a := newAnalysis(t)
+
+		t.ticker <- time.Now()
+		Expect(t, a.Predicate).To(ViaPolling(BeFalse()))
+		Expect(t, a.Score() < 75).To(BeTrue())
+	})
+
+	o.Spec("it passes when the canary is better than the baseline", func(t TA) {
+		t.reader.setLatencies("canary-id", 1, 20)
+		t.reader.setLatencies("baseline-id", 101, 20)
+		a := newAnalysis(t)
+
+		t.ticker <- time.Now()
+		Expect(t, a.Evaluations).To(ViaPolling(Equal(1)))
+		Expect(t, a.Predicate()).To(BeTrue())
+	})
+
+	o.Spec("it does not score metrics without enough data", func(t TA) {
+		t.cfg.NoData = predicate.NoDataHold
+		t.reader.setLatencies("canary-id", 101, 5)
+		t.reader.setLatencies("baseline-id", 1, 20)
+		a := newAnalysis(t)
+
+		t.ticker <- time.Now()
+		Expect(t, t.reader.ReadSourceIDs).To(ViaPolling(Contain("canary-id", "baseline-id")))
+		Expect(t, a.Predicate).To(Always(BeTrue()))
+		Expect(t, a.Evaluations()).To(Equal(0))
+	})
+
+	o.Spec("it does not keep the score once the metrics run out of data", func(t TA) {
+		t.reader.setLatencies("canary-id", 1, 20)
+		t.reader.setLatencies("baseline-id", 1, 20)
+		a := newAnalysis(t)
+
+		t.ticker <- time.Now()
+		Expect(t, a.Evaluations).To(ViaPolling(Equal(1)))
+		Expect(t, a.Score()).To(Equal(100.0))
+
+		t.reader.setLatencies("canary-id", 1, 5)
+		t.ticker <- time.Now()
+		Expect(t, a.Predicate).To(ViaPolling(BeFalse()))
+		Expect(t, a.Score()).To(Equal(0.0))
+		Expect(t, a.MetricScores()).To(HaveLen(0))
+	})
+
+	o.Spec("it validates the config", func(t TA) {
+		cfg := t.cfg
+		cfg.CanarySourceID = ""
+		Expect(t, cfg.Validate()).To(Not(BeNil()))
+
+		cfg = t.cfg
+		cfg.Metrics = []predicate.AnalysisMetric{{Name: "latency", Query: `latency{source_id="canary-id"}`}}
+		Expect(t, cfg.Validate()).To(Not(BeNil()))
+
+		cfg = t.cfg
+		cfg.Metrics = []predicate.AnalysisMetric{{Name: "latency", Query: t.cfg.Metrics[0].Query, Direction: "some-direction"}}
+		Expect(t, cfg.Validate()).To(Not(BeNil()))
+
+		cfg = t.cfg
+		cfg.MinScore = 101
+		Expect(t, cfg.Validate()).To(Not(BeNil()))
+	})
+}
+
+type stubSourceReader struct {
+	mu            sync.Mutex
+	readSourceIDs []string
+	envelopes     map[string][]*loggregator_v2.Envelope
+}
+
+func newStubSourceReader() *stubSourceReader {
+	return &stubSourceReader{
+		envelopes: make(map[string][]*loggregator_v2.Envelope),
+	}
+}
+
+func (s *stubSourceReader) Read(
+	ctx context.Context,
+	sourceID string,
+	start time.Time,
+	opts ...logcache.ReadOption,
+) ([]*loggregator_v2.Envelope, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.readSourceIDs = append(s.readSourceIDs, sourceID)
+	return s.envelopes[sourceID], nil
+}
+
+func (s *stubSourceReader) ReadSourceIDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]string, len(s.readSourceIDs))
+	copy(result, s.readSourceIDs)
+
+	return result
+}
+
+// setLatencies sets n latencies for the source ID, counting up from the
+// given one, a second apart.
+func (s *stubSourceReader) setLatencies(sourceID string, from, n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var envelopes []*loggregator_v2.Envelope
+	for i := int64(0); i < n; i++ {
+		envelopes = append(envelopes, &loggregator_v2.Envelope{
+			SourceId:  sourceID,
+			Timestamp: now.Add(-time.Duration(n-i) * time.Second).UnixNano(),
+			Message: &loggregator_v2.Envelope_Timer{
+				Timer: &loggregator_v2.Timer{
+					Name:  "latency",
+					Start: 0,
+					Stop:  from + i,
+				},
+			},
+		})
+	}
+	s.envelopes[sourceID] = envelopes
+}
@@ -0,0 +1,254 @@
+package predicate
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Composite combines named predicates (e.g., one predicate.PromQL for each
+// query) with an expression of their names, && and || (e.g.,
+// `errors && (latency || low_volume)`). && binds tighter than ||.
+type Composite struct {
+	expr node
+}
+
+// NewComposite parses the expression. An empty expression requires every
+// predicate to succeed. Every name in the expression has to be given and
+// every predicate has to be used.
+func NewComposite(expr string, predicates map[string]func() bool) (*Composite, error) {
+	if len(predicates) == 0 {
+		return nil, errors.New("no predicates given")
+	}
+
+	if strings.TrimSpace(expr) == "" {
+		names := make([]string, 0, len(predicates))
+		for name := range predicates {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		expr = strings.Join(names, " && ")
+	}
+
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{
+		tokens:     tokens,
+		predicates: predicates,
+		used:       make(map[string]bool),
+	}
+
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+
+	for name := range predicates {
+		if !p.used[name] {
+			return nil, fmt.Errorf("%s is not used in the expression", name)
+		}
+	}
+
+	return &Composite{expr: n}, nil
+}
+
+// Predicate returns true while the expression succeeds.
+func (c *Composite) Predicate() bool {
+	ok, _ := c.expr.eval()
+	return ok
+}
+
+// Check returns an error naming the predicates that make the expression
+// fail. It returns nil while the expression succeeds.
+func (c *Composite) Check() error {
+	ok, failed := c.expr.eval()
+	if ok {
+		return nil
+	}
+
+	seen := make(map[string]bool, len(failed))
+	var names []string
+	for _, name := range failed {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	if len(names) == 1 {
+		return fmt.Errorf("query %s failed", names[0])
+	}
+
+	return fmt.Errorf("queries %s failed", strings.Join(names, ", "))
+}
+
+// node is a part of the expression. eval returns whether it succeeds and
+// otherwise the names of the predicates that made it fail.
+type node interface {
+	eval() (bool, []string)
+}
+
+type nameNode struct {
+	name string
+	p    func() bool
+}
+
+func (n nameNode) eval() (bool, []string) {
+	if n.p() {
+		return true, nil
+	}
+
+	return false, []string{n.name}
+}
+
+type andNode struct {
+	left, right node
+}
+
+func (n andNode) eval() (bool, []string) {
+	lok, lfailed := n.left.eval()
+	rok, rfailed := n.right.eval()
+	if lok && rok {
+		return true, nil
+	}
+
+	return false, append(lfailed, rfailed...)
+}
+
+type orNode struct {
+	left, right node
+}
+
+func (n orNode) eval() (bool, []string) {
+	lok, lfailed := n.left.eval()
+	rok, rfailed := n.right.eval()
+	if lok || rok {
+		return true, nil
+	}
+
+	return false, append(lfailed, rfailed...)
+}
+
+func tokenize(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		c := rune(expr[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case strings.HasPrefix(expr[i:], "&&") || strings.HasPrefix(expr[i:], "||"):
+			tokens = append(tokens, expr[i:i+2])
+			i += 2
+		case isNameChar(c):
+			start := i
+			for i < len(expr) && isNameChar(rune(expr[i])) {
+				i++
+			}
+			tokens = append(tokens, expr[start:i])
+		default:
+			return nil, fmt.Errorf("unexpected %q at position %d", c, i)
+		}
+	}
+
+	return tokens, nil
+}
+
+func isNameChar(c rune) bool {
+	return c == '_' || c == '-' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+type parser struct {
+	tokens     []string
+	pos        int
+	predicates map[string]func() bool
+	used       map[string]bool
+}
+
+func (p *parser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+
+	return p.tokens[p.pos]
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.next() == "||" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.next() == "&&" {
+		p.pos++
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseTerm() (node, error) {
+	token := p.next()
+	switch token {
+	case "":
+		return nil, errors.New("unexpected end of expression")
+	case "(":
+		p.pos++
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.next() != ")" {
+			return nil, errors.New("missing )")
+		}
+		p.pos++
+
+		return n, nil
+	case ")", "&&", "||":
+		return nil, fmt.Errorf("unexpected %q", token)
+	}
+
+	pred, ok := p.predicates[token]
+	if !ok {
+		return nil, fmt.Errorf("unknown query %s", token)
+	}
+	p.pos++
+	p.used[token] = true
+
+	return nameNode{name: token, p: pred}, nil
+}
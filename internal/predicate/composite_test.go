@@ -0,0 +1,104 @@
+package predicate_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/poy/cf-canary-router/internal/predicate"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TC struct {
+	*testing.T
+
+	results    map[string]bool
+	predicates map[string]func() bool
+}
+
+func TestComposite(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		results := map[string]bool{
+			"errors":     true,
+			"latency":    true,
+			"low_volume": true,
+		}
+
+		predicates := make(map[string]func() bool)
+		for name := range results {
+			name := name
+			predicates[name] = func() bool { return results[name] }
+		}
+
+		return TC{
+			T:          t,
+			results:    results,
+			predicates: predicates,
+		}
+	})
+
+	o.Spec("it combines the predicates with the expression", func(t TC) {
+		c, err := predicate.NewComposite("errors && (latency || low_volume)", t.predicates)
+		Expect(t, err).To(BeNil())
+		Expect(t, c.Predicate()).To(BeTrue())
+		Expect(t, c.Check()).To(BeNil())
+
+		t.results["latency"] = false
+		Expect(t, c.Predicate()).To(BeTrue())
+
+		t.results["low_volume"] = false
+		Expect(t, c.Predicate()).To(BeFalse())
+		Expect(t, c.Check()).To(Equal(errors.New("queries latency, low_volume failed")))
+
+		t.results["latency"] = true
+		t.results["errors"] = false
+		Expect(t, c.Check()).To(Equal(errors.New("query errors failed")))
+	})
+
+	o.Spec("it binds && tighter than ||", func(t TC) {
+		c, err := predicate.NewComposite("errors || latency && low_volume", t.predicates)
+		Expect(t, err).To(BeNil())
+
+		t.results["latency"] = false
+		Expect(t, c.Predicate()).To(BeTrue())
+
+		t.results["errors"] = false
+		Expect(t, c.Predicate()).To(BeFalse())
+	})
+
+	o.Spec("it requires every predicate without an expression", func(t TC) {
+		c, err := predicate.NewComposite("", t.predicates)
+		Expect(t, err).To(BeNil())
+		Expect(t, c.Predicate()).To(BeTrue())
+
+		t.results["low_volume"] = false
+		Expect(t, c.Check()).To(Equal(errors.New("query low_volume failed")))
+	})
+
+	o.Spec("it rejects invalid expressions", func(t TC) {
+		for expr, msg := range map[string]string{
+			"errors && latency":                     "low_volume is not used in the expression",
+			"errors && (latency || low_volume":      "missing )",
+			"errors && latency || low_volume)":      `unexpected ")"`,
+			"errors && && latency || low_volume":    `unexpected "&&"`,
+			"errors && latency || low_volume ||":    "unexpected end of expression",
+			"errors && latency || saturation":       "unknown query saturation",
+			"errors & latency || low_volume":        `unexpected '&' at position 7`,
+			"errors && latency low_volume":          `unexpected "low_volume"`,
+			"!errors && latency || low_volume":      `unexpected '!' at position 0`,
+			"(errors) && ((latency)) || low_volume": "",
+		} {
+			_, err := predicate.NewComposite(expr, t.predicates)
+			if msg == "" {
+				Expect(t, err).To(BeNil())
+				continue
+			}
+			Expect(t, err).To(Equal(errors.New(msg)))
+		}
+	})
+}
@@ -0,0 +1,211 @@
+package predicate
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/loggregator/prometheus/promql"
+)
+
+// Mode decides which results of a query are a success.
+type Mode string
+
+const (
+	// ModeNonEmpty succeeds when the query yields a non-empty result. It is
+	// the default.
+	ModeNonEmpty Mode = "non-empty"
+
+	// ModeEmpty succeeds when the query yields an empty result (e.g., a
+	// query that only selects failures).
+	ModeEmpty Mode = "empty"
+
+	// ModeThreshold succeeds when the scalar or every sample of the vector
+	// the query yields passes the Threshold.
+	ModeThreshold Mode = "threshold"
+)
+
+// NoData decides what happens when a query does not select any data.
+type NoData string
+
+const (
+	// NoDataFail counts as a failure. It is the default.
+	NoDataFail NoData = "fail"
+
+	// NoDataPass counts as a success. It does not count towards the
+	// evaluations of the query.
+	NoDataPass NoData = "pass"
+
+	// NoDataHold keeps the latest result.
+	NoDataHold NoData = "hold"
+)
+
+// Evaluation decides whether the result of a query is a success.
+type Evaluation struct {
+	Mode Mode `json:",omitempty"`
+
+	// Threshold is the comparison the threshold mode uses (e.g., "< 0.01").
+	// It is one of <, <=, >, >=, == and != followed by a number.
+	Threshold string `json:",omitempty"`
+
+	NoData NoData `json:",omitempty"`
+}
+
+// outcome is the result of a single evaluation.
+type outcome int
+
+const (
+	success outcome = iota
+	failure
+	noData
+)
+
+// Validate returns an error if the mode, threshold or no data policy is
+// unknown or the threshold is missing or not used.
+func (e Evaluation) Validate() error {
+	switch e.Mode {
+	case "", ModeNonEmpty, ModeEmpty:
+		if e.Threshold != "" {
+			return fmt.Errorf("threshold is only used by the %s mode", ModeThreshold)
+		}
+	case ModeThreshold:
+		if _, err := parseThreshold(e.Threshold); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown mode: %s", e.Mode)
+	}
+
+	switch e.NoData {
+	case "", NoDataFail, NoDataPass, NoDataHold:
+		return nil
+	default:
+		return fmt.Errorf("unknown no data policy: %s", e.NoData)
+	}
+}
+
+// outcome decides whether the given result is a success. hasData is false
+// when the query did not select any samples.
+func (e Evaluation) outcome(v promql.Value, hasData bool) outcome {
+	if !hasData {
+		return noData
+	}
+
+	switch e.Mode {
+	case ModeEmpty:
+		if v.String() == "" {
+			return success
+		}
+
+		return failure
+	case ModeThreshold:
+		t, err := parseThreshold(e.Threshold)
+		if err != nil {
+			return failure
+		}
+
+		switch v := v.(type) {
+		case promql.Scalar:
+			return t.outcome(v.V)
+		case promql.Vector:
+			if len(v) == 0 {
+				return noData
+			}
+
+			for _, s := range v {
+				if t.outcome(s.V) == failure {
+					return failure
+				}
+			}
+
+			return success
+		default:
+			return failure
+		}
+	default:
+		if v.String() != "" {
+			return success
+		}
+
+		return failure
+	}
+}
+
+// describe returns the given result the way it is reported when a query
+// fails.
+func describe(v promql.Value, hasData bool) string {
+	if !hasData {
+		return "no data"
+	}
+
+	switch v := v.(type) {
+	case promql.Scalar:
+		return strconv.FormatFloat(v.V, 'g', -1, 64)
+	case promql.Vector:
+		if len(v) == 0 {
+			return "no data"
+		}
+
+		samples := make([]string, 0, len(v))
+		for _, s := range v {
+			samples = append(samples, fmt.Sprintf("%s => %s", s.Metric, strconv.FormatFloat(s.V, 'g', -1, 64)))
+		}
+
+		return strings.Join(samples, ", ")
+	default:
+		return v.String()
+	}
+}
+
+type threshold struct {
+	op    string
+	value float64
+}
+
+func parseThreshold(s string) (threshold, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return threshold{}, errors.New("the threshold mode requires a threshold")
+	}
+
+	// The two character operators have to be tried first.
+	for _, op := range []string{"<=", ">=", "==", "!=", "<", ">"} {
+		if !strings.HasPrefix(s, op) {
+			continue
+		}
+
+		v, err := strconv.ParseFloat(strings.TrimSpace(s[len(op):]), 64)
+		if err != nil {
+			return threshold{}, fmt.Errorf("invalid threshold %q: %s", s, err)
+		}
+
+		return threshold{op: op, value: v}, nil
+	}
+
+	return threshold{}, fmt.Errorf("invalid threshold %q: it has to start with one of <, <=, >, >=, == and !=", s)
+}
+
+func (t threshold) outcome(v float64) outcome {
+	var ok bool
+	switch t.op {
+	case "<":
+		ok = v < t.value
+	case "<=":
+		ok = v <= t.value
+	case ">":
+		ok = v > t.value
+	case ">=":
+		ok = v >= t.value
+	case "==":
+		ok = v == t.value
+	case "!=":
+		ok = v != t.value
+	}
+
+	if ok {
+		return success
+	}
+
+	return failure
+}
@@ -0,0 +1,138 @@
+package predicate
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/poy/cf-canary-router/internal/proxy"
+)
+
+// Local evaluates rules against the requests the router has recorded itself.
+// Unlike PromQL, it does not have to wait on log-cache.
+type Local struct {
+	rules       []Rule
+	stats       StatsReader
+	log         *log.Logger
+	maxFailures int
+	failures    int64
+
+	ticker <-chan time.Time
+	result int64
+}
+
+// StatsReader returns the recorded requests for a backend. It is implemented
+// by proxy.Metrics.
+type StatsReader interface {
+	Stats(backend string) proxy.BackendStats
+}
+
+// Rule returns an error when the recorded requests are not acceptable.
+type Rule func(s StatsReader) error
+
+// MaxErrorRatio fails when the ratio of 5xx responses for the backend is
+// at or above the given ratio. It passes until the backend has served
+// minRequests.
+func MaxErrorRatio(backend string, ratio float64, minRequests int64) Rule {
+	return func(s StatsReader) error {
+		stats := s.Stats(backend)
+		if stats.Requests < minRequests {
+			return nil
+		}
+
+		if r := stats.ErrorRatio(); r >= ratio {
+			return fmt.Errorf("%s has a 5xx ratio of %.4f (max %.4f)", backend, r, ratio)
+		}
+
+		return nil
+	}
+}
+
+// MaxLatencyRatio fails when the given latency quantile (e.g., 0.99) of the
+// backend is at or above ratio times the same quantile of the baseline. It
+// passes until both have served minRequests.
+func MaxLatencyRatio(backend, baseline string, quantile, ratio float64, minRequests int64) Rule {
+	return func(s StatsReader) error {
+		stats := s.Stats(backend)
+		base := s.Stats(baseline)
+		if stats.Requests < minRequests || base.Requests < minRequests {
+			return nil
+		}
+
+		l, b := stats.Quantile(quantile), base.Quantile(quantile)
+		if float64(l) >= ratio*float64(b) {
+			return fmt.Errorf(
+				"%s has a p%g latency of %s (%s has %s, max ratio %g)",
+				backend, quantile*100, l, baseline, b, ratio,
+			)
+		}
+
+		return nil
+	}
+}
+
+func NewLocal(
+	rules []Rule,
+	maxFailures int,
+	s StatsReader,
+	ticker <-chan time.Time,
+	log *log.Logger,
+) *Local {
+	l := &Local{
+		rules:       rules,
+		stats:       s,
+		ticker:      ticker,
+		log:         log,
+		result:      1,
+		maxFailures: maxFailures,
+	}
+
+	go l.start()
+
+	return l
+}
+
+func (l *Local) Predicate() bool {
+	return atomic.LoadInt64(&l.result) != 0
+}
+
+// Failures returns the number of times in a row a rule has failed.
+func (l *Local) Failures() int {
+	return int(atomic.LoadInt64(&l.failures))
+}
+
+// RestoreFailures sets the number of times in a row a rule has failed (e.g.,
+// before the router restarted).
+func (l *Local) RestoreFailures(n int) {
+	atomic.StoreInt64(&l.failures, int64(n))
+	if n > 0 && n >= l.maxFailures {
+		atomic.StoreInt64(&l.result, 0)
+	}
+}
+
+func (l *Local) start() {
+	for range l.ticker {
+		if err := l.check(); err != nil {
+			l.log.Printf("local rule failed: %s", err)
+			if atomic.AddInt64(&l.failures, 1) >= int64(l.maxFailures) {
+				atomic.StoreInt64(&l.result, 0)
+				return
+			}
+
+			continue
+		}
+
+		atomic.StoreInt64(&l.failures, 0)
+	}
+}
+
+func (l *Local) check() error {
+	for _, r := range l.rules {
+		if err := r(l.stats); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
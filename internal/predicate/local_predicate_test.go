@@ -0,0 +1,109 @@
+package predicate_test
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-canary-router/internal/predicate"
+	"github.com/poy/cf-canary-router/internal/proxy"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TL struct {
+	*testing.T
+
+	m      *proxy.Metrics
+	ticker chan time.Time
+	l      *predicate.Local
+}
+
+func TestLocalPredicate(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TL {
+		m := proxy.NewMetrics()
+		ticker := make(chan time.Time, 10)
+
+		return TL{
+			T:      t,
+			m:      m,
+			ticker: ticker,
+			l: predicate.NewLocal(
+				[]predicate.Rule{
+					predicate.MaxErrorRatio("canary", 0.01, 10),
+					predicate.MaxLatencyRatio("canary", proxy.CurrentBackend, 0.99, 1.2, 10),
+				},
+				2,
+				m,
+				ticker,
+				log.New(ioutil.Discard, "", 0),
+			),
+		}
+	})
+
+	o.Spec("it returns true before the ticker has fired", func(t TL) {
+		Expect(t, t.l.Predicate()).To(BeTrue())
+	})
+
+	o.Spec("it returns true while the rules pass", func(t TL) {
+		record(t.m, "canary", 100, 200, 10*time.Millisecond)
+		record(t.m, proxy.CurrentBackend, 100, 200, 10*time.Millisecond)
+
+		for i := 0; i < 3; i++ {
+			t.ticker <- time.Now()
+		}
+
+		Expect(t, t.l.Predicate).To(Always(BeTrue()))
+	})
+
+	o.Spec("it returns false after the error ratio fails maxFailures times", func(t TL) {
+		record(t.m, "canary", 90, 200, 10*time.Millisecond)
+		record(t.m, "canary", 10, 503, 10*time.Millisecond)
+
+		t.ticker <- time.Now()
+		Expect(t, t.l.Predicate).To(Always(BeTrue()))
+
+		t.ticker <- time.Now()
+		Expect(t, t.l.Predicate).To(ViaPolling(BeFalse()))
+	})
+
+	o.Spec("it carries on from restored failures", func(t TL) {
+		t.l.RestoreFailures(1)
+		Expect(t, t.l.Failures()).To(Equal(1))
+
+		record(t.m, "canary", 90, 200, 10*time.Millisecond)
+		record(t.m, "canary", 10, 503, 10*time.Millisecond)
+
+		t.ticker <- time.Now()
+		Expect(t, t.l.Predicate).To(ViaPolling(BeFalse()))
+	})
+
+	o.Spec("it returns false when the latency is too high", func(t TL) {
+		record(t.m, "canary", 100, 200, 400*time.Millisecond)
+		record(t.m, proxy.CurrentBackend, 100, 200, 10*time.Millisecond)
+
+		t.ticker <- time.Now()
+		t.ticker <- time.Now()
+		Expect(t, t.l.Predicate).To(ViaPolling(BeFalse()))
+	})
+
+	o.Spec("it ignores backends without enough requests", func(t TL) {
+		record(t.m, "canary", 5, 503, time.Second)
+
+		t.ticker <- time.Now()
+		t.ticker <- time.Now()
+		Expect(t, t.l.Predicate).To(Always(BeTrue()))
+	})
+}
+
+func record(m *proxy.Metrics, backend string, n, status int, latency time.Duration) {
+	for i := 0; i < n; i++ {
+		m.Record(backend, status, latency)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"log"
 	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -19,10 +20,31 @@ type PromQL struct {
 	r           DataReader
 	log         *log.Logger
 	maxFailures int
-	failures    int
+	failures    int64
 
 	ticker <-chan time.Time
 	result int64
+	done   chan struct{}
+	stop   sync.Once
+
+	// evaluations is the number of times the query has succeeded.
+	evaluations int64
+
+	// evaluation decides whether a result is a success. samples is the
+	// number of samples the latest query selected.
+	evaluation Evaluation
+	samples    int64
+
+	// err holds the error (wrapped in queryErr) of the latest query.
+	err atomic.Value
+
+	// value holds the result of the latest query that did not fail (see
+	// describe).
+	value atomic.Value
+}
+
+type queryErr struct {
+	err error
 }
 
 type DataReader interface {
@@ -34,12 +56,25 @@ type DataReader interface {
 	) ([]*loggregator_v2.Envelope, error)
 }
 
+// PromQLOption configures optional behavior of a PromQL.
+type PromQLOption func(*PromQL)
+
+// WithEvaluation sets how the results of the query are evaluated. It
+// defaults to succeeding on any non-empty result and failing without data.
+// The evaluation has to be valid (see Evaluation.Validate).
+func WithEvaluation(e Evaluation) PromQLOption {
+	return func(p *PromQL) {
+		p.evaluation = e
+	}
+}
+
 func NewPromQL(
 	query string,
 	maxFailures int,
 	r DataReader,
 	ticker <-chan time.Time,
 	log *log.Logger,
+	opts ...PromQLOption,
 ) *PromQL {
 	p := &PromQL{
 		query:       query,
@@ -48,6 +83,11 @@ func NewPromQL(
 		log:         log,
 		result:      1,
 		maxFailures: maxFailures,
+		done:        make(chan struct{}),
+	}
+
+	for _, o := range opts {
+		o(p)
 	}
 
 	go p.start()
@@ -55,26 +95,81 @@ func NewPromQL(
 	return p
 }
 
+// ValidateQuery returns an error if the given query does not parse.
+func ValidateQuery(query string) error {
+	_, err := promql.ParseExpr(query)
+	return err
+}
+
 func (p *PromQL) Predicate() bool {
 	return atomic.LoadInt64(&p.result) != 0
 }
 
+// Err returns the error of the latest query. It is nil if the query (or
+// reading from log-cache) succeeded.
+func (p *PromQL) Err() error {
+	e, _ := p.err.Load().(queryErr)
+	return e.err
+}
+
+// Value returns the result of the latest query that did not fail (e.g.,
+// "0.5"). It is empty before the first one.
+func (p *PromQL) Value() string {
+	v, _ := p.value.Load().(string)
+	return v
+}
+
+// Failures returns the number of times in a row the query has failed.
+func (p *PromQL) Failures() int {
+	return int(atomic.LoadInt64(&p.failures))
+}
+
+// Evaluations returns the number of times the query has succeeded.
+func (p *PromQL) Evaluations() int {
+	return int(atomic.LoadInt64(&p.evaluations))
+}
+
+// Stop stops evaluating the query. The predicate keeps its latest result.
+func (p *PromQL) Stop() {
+	p.stop.Do(func() {
+		close(p.done)
+	})
+}
+
+// RestoreFailures sets the number of times in a row the query has failed (e.g.,
+// before the router restarted).
+func (p *PromQL) RestoreFailures(n int) {
+	atomic.StoreInt64(&p.failures, int64(n))
+	if n > 0 && n >= p.maxFailures {
+		atomic.StoreInt64(&p.result, 0)
+	}
+}
+
 func (p *PromQL) start() {
 	interval := time.Second
 	e := promql.NewEngine(&logCacheQueryable{
 		log:        p.log,
 		interval:   interval,
 		dataReader: p.r,
+		samples:    &p.samples,
 	}, nil)
 
-	for range p.ticker {
+	for {
+		select {
+		case <-p.ticker:
+		case <-p.done:
+			return
+		}
+
 		q, err := e.NewInstantQuery(p.query, time.Now())
 		if err != nil {
 			log.Fatalf("Invalid query: %s", err)
 		}
 
+		atomic.StoreInt64(&p.samples, 0)
 		ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
 		result := q.Exec(ctx)
+		p.err.Store(queryErr{err: result.Err})
 
 		if result.Err != nil {
 			p.log.Printf("promQL error: %s", result.Err)
@@ -82,9 +177,22 @@ func (p *PromQL) start() {
 			continue
 		}
 
-		if len(result.String()) == 0 {
-			p.failures++
-			if p.failures >= p.maxFailures {
+		hasData := atomic.LoadInt64(&p.samples) > 0
+		p.value.Store(describe(result.Value, hasData))
+		o := p.evaluation.outcome(result.Value, hasData)
+		if o == noData {
+			switch p.evaluation.NoData {
+			case NoDataPass:
+				o = success
+			case NoDataHold:
+				continue
+			default:
+				o = failure
+			}
+		}
+
+		if o == failure {
+			if atomic.AddInt64(&p.failures, 1) >= int64(p.maxFailures) {
 				atomic.StoreInt64(&p.result, 0)
 				return
 			}
@@ -92,8 +200,11 @@ func (p *PromQL) start() {
 			continue
 		}
 
-		p.failures = 0
+		atomic.StoreInt64(&p.failures, 0)
 		atomic.StoreInt64(&p.result, 1)
+		if hasData {
+			atomic.AddInt64(&p.evaluations, 1)
+		}
 	}
 }
 
@@ -101,6 +212,9 @@ type logCacheQueryable struct {
 	log        *log.Logger
 	interval   time.Duration
 	dataReader DataReader
+
+	// samples counts the samples that are selected.
+	samples *int64
 }
 
 func (l *logCacheQueryable) Querier(ctx context.Context, mint int64, maxt int64) (storage.Querier, error) {
@@ -111,6 +225,7 @@ func (l *logCacheQueryable) Querier(ctx context.Context, mint int64, maxt int64)
 		end:        time.Unix(0, maxt*int64(time.Millisecond)),
 		interval:   l.interval,
 		dataReader: l.dataReader,
+		samples:    l.samples,
 	}, nil
 }
 
@@ -121,6 +236,7 @@ type LogCacheQuerier struct {
 	end        time.Time
 	interval   time.Duration
 	dataReader DataReader
+	samples    *int64
 }
 
 func (l *LogCacheQuerier) Select(ll ...*labels.Matcher) (storage.SeriesSet, error) {
@@ -184,6 +300,10 @@ func (l *LogCacheQuerier) Select(ll ...*labels.Matcher) (storage.SeriesSet, erro
 			t: e.GetTimestamp() / int64(time.Millisecond),
 			v: f,
 		})
+
+		if l.samples != nil {
+			atomic.AddInt64(l.samples, 1)
+		}
 	}
 
 	return builder.buildSeriesSet(), nil
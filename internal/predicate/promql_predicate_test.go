@@ -2,6 +2,7 @@ package predicate_test
 
 import (
 	"context"
+	"errors"
 	"io/ioutil"
 	"log"
 	"sync"
@@ -83,6 +84,134 @@ func TestPromQLPredicate(t *testing.T) {
 		))
 	})
 
+	o.Spec("it counts successful evaluations until stopped", func(t TP) {
+		t.spyDataReader.setRead([][]*loggregator_v2.Envelope{
+			{{
+				SourceId:  "some-id-1",
+				Timestamp: time.Now().UnixNano(),
+				Message: &loggregator_v2.Envelope_Counter{
+					Counter: &loggregator_v2.Counter{
+						Name:  "metric",
+						Total: 99,
+					},
+				},
+			}},
+			{{
+				SourceId:  "some-id-2",
+				Timestamp: time.Now().UnixNano(),
+				Message: &loggregator_v2.Envelope_Counter{
+					Counter: &loggregator_v2.Counter{
+						Name:  "metric",
+						Total: 99,
+					},
+				},
+			}},
+		},
+			[]error{nil, nil},
+		)
+		t.ticker <- time.Now()
+		Expect(t, t.p.Evaluations).To(ViaPolling(Equal(1)))
+
+		t.p.Stop()
+		t.ticker <- time.Now()
+		Expect(t, t.p.Evaluations).To(Always(Equal(1)))
+		Expect(t, t.p.Predicate()).To(BeTrue())
+	})
+
+	o.Spec("it validates queries", func(t TP) {
+		Expect(t, predicate.ValidateQuery(`metric{source_id="some-id"} > 5`)).To(BeNil())
+		Expect(t, predicate.ValidateQuery(`metric{`)).To(Not(BeNil()))
+	})
+
+	o.Group("with an evaluation", func() {
+		newPromQL := func(t TP, query string, e predicate.Evaluation) (*predicate.PromQL, chan time.Time) {
+			ticker := make(chan time.Time, 10)
+			return predicate.NewPromQL(
+				query,
+				1,
+				t.spyDataReader,
+				ticker,
+				log.New(ioutil.Discard, "", 0),
+				predicate.WithEvaluation(e),
+			), ticker
+		}
+
+		counter := func(total uint64) []*loggregator_v2.Envelope {
+			return []*loggregator_v2.Envelope{{
+				SourceId:  "some-id-1",
+				Timestamp: time.Now().UnixNano(),
+				Message: &loggregator_v2.Envelope_Counter{
+					Counter: &loggregator_v2.Counter{
+						Name:  "metric",
+						Total: total,
+					},
+				},
+			}}
+		}
+
+		o.Spec("it succeeds while every sample passes the threshold", func(t TP) {
+			p, ticker := newPromQL(t, `metric{source_id="some-id-1"}`, predicate.Evaluation{
+				Mode:      predicate.ModeThreshold,
+				Threshold: "< 100",
+			})
+
+			t.spyDataReader.setRead([][]*loggregator_v2.Envelope{counter(99)}, []error{nil})
+			ticker <- time.Now()
+			Expect(t, p.Evaluations).To(ViaPolling(Equal(1)))
+			Expect(t, p.Predicate()).To(BeTrue())
+
+			t.spyDataReader.setRead([][]*loggregator_v2.Envelope{counter(100)}, []error{nil})
+			ticker <- time.Now()
+			Expect(t, p.Predicate).To(ViaPolling(BeFalse()))
+		})
+
+		o.Spec("it succeeds on an empty result with data", func(t TP) {
+			p, ticker := newPromQL(t, `metric{source_id="some-id-1"} > 100`, predicate.Evaluation{
+				Mode: predicate.ModeEmpty,
+			})
+
+			t.spyDataReader.setRead([][]*loggregator_v2.Envelope{counter(99)}, []error{nil})
+			ticker <- time.Now()
+			Expect(t, p.Evaluations).To(ViaPolling(Equal(1)))
+			Expect(t, p.Predicate()).To(BeTrue())
+
+			t.spyDataReader.setRead([][]*loggregator_v2.Envelope{counter(101)}, []error{nil})
+			ticker <- time.Now()
+			Expect(t, p.Predicate).To(ViaPolling(BeFalse()))
+		})
+
+		o.Spec("it holds its result without data", func(t TP) {
+			p, ticker := newPromQL(t, `metric{source_id="some-id-1"} > 100`, predicate.Evaluation{
+				Mode:   predicate.ModeEmpty,
+				NoData: predicate.NoDataHold,
+			})
+
+			ticker <- time.Now()
+			Expect(t, t.spyDataReader.ReadSourceIDs).To(ViaPolling(HaveLen(1)))
+			Expect(t, p.Predicate).To(Always(BeTrue()))
+			Expect(t, p.Evaluations()).To(Equal(0))
+		})
+
+		o.Spec("it fails without data by default", func(t TP) {
+			p, ticker := newPromQL(t, `metric{source_id="some-id-1"} > 100`, predicate.Evaluation{
+				Mode: predicate.ModeEmpty,
+			})
+
+			ticker <- time.Now()
+			Expect(t, p.Predicate).To(ViaPolling(BeFalse()))
+		})
+
+		o.Spec("it validates evaluations", func(t TP) {
+			Expect(t, predicate.Evaluation{}.Validate()).To(BeNil())
+			Expect(t, predicate.Evaluation{Mode: predicate.ModeThreshold, Threshold: ">= 0.5"}.Validate()).To(BeNil())
+			Expect(t, predicate.Evaluation{Mode: "some-mode"}.Validate()).To(Not(BeNil()))
+			Expect(t, predicate.Evaluation{Mode: predicate.ModeThreshold}.Validate()).To(Not(BeNil()))
+			Expect(t, predicate.Evaluation{Mode: predicate.ModeThreshold, Threshold: "~ 5"}.Validate()).To(Not(BeNil()))
+			Expect(t, predicate.Evaluation{Threshold: "< 5"}.Validate()).To(Not(BeNil()))
+			Expect(t, predicate.Evaluation{NoData: "some-policy"}.Validate()).To(Not(BeNil()))
+		})
+	})
+
 	o.Spec("it recovers if it does not fail too often", func(t TP) {
 		t.ticker <- time.Now()
 		Expect(t, t.p.Predicate).To(Always(BeTrue()))
@@ -116,6 +245,18 @@ func TestPromQLPredicate(t *testing.T) {
 		Expect(t, t.p.Predicate).To(ViaPolling(BeTrue()))
 	})
 
+	o.Spec("it reports errors from reading log-cache", func(t TP) {
+		Expect(t, t.p.Err()).To(BeNil())
+
+		t.spyDataReader.setRead(
+			[][]*loggregator_v2.Envelope{nil, nil},
+			[]error{errors.New("some-error"), errors.New("some-error")},
+		)
+		t.ticker <- time.Now()
+
+		Expect(t, func() bool { return t.p.Err() != nil }).To(ViaPolling(BeTrue()))
+	})
+
 	o.Spec("it stays false once it fails enough times", func(t TP) {
 		// We have the max num of failures set to 3.
 		t.ticker <- time.Now()
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Reasons a backend was chosen for a request.
+const (
+	// ReasonPercentage is used when the request's cohort fell within (or
+	// outside of) a candidate's percentage.
+	ReasonPercentage = "percentage"
+
+	// ReasonSticky is used when the request's cohort was read from the
+	// sticky session cookie.
+	ReasonSticky = "sticky"
+
+	// ReasonOverride is used when the request forced its backend.
+	ReasonOverride = "override"
+
+	// ReasonFallback is used when the request failed on a candidate and was
+	// retried on the old route.
+	ReasonFallback = "fallback"
+)
+
+// requestIDHeaders are checked (in order) for the ID of a request. The
+// go-router sets the first one.
+var requestIDHeaders = []string{"X-Vcap-Request-Id", "X-Request-Id"}
+
+// AccessEntry is a single line of the access log.
+type AccessEntry struct {
+	RequestID string `json:",omitempty"`
+	Method    string
+	Path      string
+	Status    int
+	Bytes     int64
+	Latency   time.Duration
+
+	// Backend is the name of the backend that served the request. The old
+	// route is named CurrentBackend.
+	Backend string
+
+	// Step is the index of the plan's step when the backend was chosen.
+	Step int
+
+	// Reason is why the backend was chosen (e.g., ReasonPercentage).
+	Reason string
+}
+
+// WithAccessLog writes an AccessEntry (as a line of JSON) to w for the given
+// ratio (0 to 1) of requests.
+func WithAccessLog(w io.Writer, sampleRate float64) ProxyOption {
+	return func(p *Proxy) {
+		p.accessLog = &accessLog{
+			w:          w,
+			sampleRate: sampleRate,
+		}
+	}
+}
+
+type accessLog struct {
+	sampleRate float64
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// decision records how the backend of a request was chosen.
+type decision struct {
+	backend string
+	step    int
+	reason  string
+}
+
+func (l *accessLog) sample() bool {
+	return l.sampleRate >= 1 || rand.Float64() < l.sampleRate
+}
+
+func (l *accessLog) write(e AccessEntry) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.w.Write(append(data, '\n'))
+}
+
+func requestID(r *http.Request) string {
+	for _, h := range requestIDHeaders {
+		if id := r.Header.Get(h); id != "" {
+			return id
+		}
+	}
+
+	return ""
+}
+
+// backendName returns the name a candidate is logged under. An empty
+// candidate is the old route.
+func backendName(candidate string) string {
+	if candidate == "" {
+		return CurrentBackend
+	}
+
+	return candidate
+}
+
+// accessResponseWriter records the status and size of a response.
+type accessResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(data)
+	w.bytes += int64(n)
+
+	return n, err
+}
+
+// Flush implements http.Flusher so responses can still be streamed.
+func (w *accessResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker so protocol upgrades still work. The
+// request is recorded as a 101.
+func (w *accessResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+
+	w.status = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
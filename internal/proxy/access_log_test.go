@@ -0,0 +1,144 @@
+package proxy_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/poy/cf-canary-router/internal/proxy"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TA struct {
+	*testing.T
+
+	accessLog  *bytes.Buffer
+	spyPlanner *spyPlanner
+
+	oldTestServer *httptest.Server
+	newTestServer *httptest.Server
+	newResponse   *stubResponse
+}
+
+func TestAccessLog(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TA {
+		newResponse := &stubResponse{status: http.StatusOK, body: "some-body"}
+		spyPlanner := newSpyPlanner()
+		spyPlanner.step = 1
+
+		return TA{
+			T:             t,
+			accessLog:     &bytes.Buffer{},
+			spyPlanner:    spyPlanner,
+			oldTestServer: httptest.NewServer(newSpyServer()),
+			newTestServer: httptest.NewServer(newResponse),
+			newResponse:   newResponse,
+		}
+	})
+
+	o.AfterEach(func(t TA) {
+		t.oldTestServer.Close()
+		t.newTestServer.Close()
+	})
+
+	o.Spec("it logs the backend that served each request", func(t TA) {
+		t.spyPlanner.percentage = 100
+		p := newAccessLogProxy(t, 1)
+
+		req, err := http.NewRequest("GET", "http://some.url/some-path", nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("X-Vcap-Request-Id", "some-id")
+		p.ServeHTTP(httptest.NewRecorder(), req)
+
+		e := readAccessEntry(t)
+		Expect(t, e.RequestID).To(Equal("some-id"))
+		Expect(t, e.Method).To(Equal("GET"))
+		Expect(t, e.Path).To(Equal("/some-path"))
+		Expect(t, e.Status).To(Equal(http.StatusOK))
+		Expect(t, e.Bytes).To(Equal(int64(len("some-body"))))
+		Expect(t, e.Latency > 0).To(BeTrue())
+		Expect(t, e.Backend).To(Equal(proxy.DefaultCandidate))
+		Expect(t, e.Step).To(Equal(1))
+		Expect(t, e.Reason).To(Equal(proxy.ReasonPercentage))
+	})
+
+	o.Spec("it logs overridden requests", func(t TA) {
+		p := newAccessLogProxy(t, 1, proxy.WithOverride(proxy.Override{Header: "X-Canary"}))
+
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("X-Canary", "always")
+		p.ServeHTTP(httptest.NewRecorder(), req)
+
+		e := readAccessEntry(t)
+		Expect(t, e.Backend).To(Equal(proxy.DefaultCandidate))
+		Expect(t, e.Reason).To(Equal(proxy.ReasonOverride))
+	})
+
+	o.Spec("it logs requests that fell back", func(t TA) {
+		t.spyPlanner.percentage = 100
+		t.newResponse.status = http.StatusServiceUnavailable
+		p := newAccessLogProxy(t, 1, proxy.WithFallback(4, newSpyEventWriter()))
+
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		p.ServeHTTP(httptest.NewRecorder(), req)
+
+		e := readAccessEntry(t)
+		Expect(t, e.Status).To(Equal(http.StatusOK))
+		Expect(t, e.Backend).To(Equal(proxy.CurrentBackend))
+		Expect(t, e.Reason).To(Equal(proxy.ReasonFallback))
+	})
+
+	o.Spec("it logs sticky requests", func(t TA) {
+		p := newAccessLogProxy(t, 1, proxy.WithStickySessions("some-cookie"))
+
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		req.AddCookie(&http.Cookie{Name: "some-cookie", Value: "99"})
+		p.ServeHTTP(httptest.NewRecorder(), req)
+
+		e := readAccessEntry(t)
+		Expect(t, e.Backend).To(Equal(proxy.CurrentBackend))
+		Expect(t, e.Reason).To(Equal(proxy.ReasonSticky))
+	})
+
+	o.Spec("it only logs the sampled requests", func(t TA) {
+		p := newAccessLogProxy(t, 0)
+
+		for i := 0; i < 10; i++ {
+			req, err := http.NewRequest("GET", "http://some.url", nil)
+			Expect(t, err).To(BeNil())
+			p.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		Expect(t, t.accessLog.Len()).To(Equal(0))
+	})
+}
+
+func newAccessLogProxy(t TA, sampleRate float64, opts ...proxy.ProxyOption) *proxy.Proxy {
+	return proxy.New(
+		t.oldTestServer.URL,
+		t.newTestServer.URL,
+		t.spyPlanner,
+		true,
+		log.New(ioutil.Discard, "", 0),
+		append(opts, proxy.WithAccessLog(t.accessLog, sampleRate))...,
+	)
+}
+
+func readAccessEntry(t TA) proxy.AccessEntry {
+	var e proxy.AccessEntry
+	Expect(t, json.NewDecoder(t.accessLog).Decode(&e)).To(BeNil())
+	return e
+}
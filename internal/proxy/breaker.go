@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BreakerConfig configures when the circuit breaker around a candidate
+// trips. Once tripped, the candidate does not receive any more requests and
+// is aborted.
+type BreakerConfig struct {
+	// ConsecutiveFailures trips the breaker after that many failed requests
+	// in a row. It is ignored if it is 0.
+	ConsecutiveFailures int
+
+	// FailureRatio trips the breaker when the ratio of failed requests
+	// within the Window is above it. It is ignored if it is 0.
+	FailureRatio float64
+
+	// Window is the length of the rolling window used for FailureRatio.
+	Window time.Duration
+
+	// MinRequests is the number of requests within the Window before the
+	// FailureRatio is considered.
+	MinRequests int
+}
+
+// Aborter is told to abort a candidate when its circuit breaker trips. It is
+// called in the background, so the request that tripped the breaker does not
+// wait on it (e.g., on syncing a StateStore). The candidate stops receiving
+// requests as soon as the breaker trips.
+type Aborter interface {
+	Abort(candidate, reason string)
+}
+
+// WithCircuitBreaker wraps each candidate with a circuit breaker. A request
+// fails if the candidate can not be reached or responds with a 5xx.
+func WithCircuitBreaker(c BreakerConfig, a Aborter) ProxyOption {
+	return func(p *Proxy) {
+		p.breakerConfig = &c
+		p.aborter = a
+	}
+}
+
+// breakerBuckets is the number of buckets the rolling window is divided
+// into.
+const breakerBuckets = 10
+
+type breaker struct {
+	cfg       BreakerConfig
+	candidate string
+	a         Aborter
+	now       func() time.Time
+
+	tripped int32
+
+	mu          sync.Mutex
+	consecutive int
+	buckets     [breakerBuckets]breakerBucket
+}
+
+type breakerBucket struct {
+	start  int64
+	total  int
+	failed int
+}
+
+func newBreaker(cfg BreakerConfig, candidate string, a Aborter) *breaker {
+	return &breaker{
+		cfg:       cfg,
+		candidate: candidate,
+		a:         a,
+		now:       time.Now,
+	}
+}
+
+// Tripped returns true once the breaker has tripped. It stays tripped.
+func (b *breaker) Tripped() bool {
+	return atomic.LoadInt32(&b.tripped) != 0
+}
+
+// record adds the outcome of a request and trips the breaker if necessary.
+func (b *breaker) record(failed bool) {
+	if b.Tripped() {
+		return
+	}
+
+	reason, trip := b.add(failed)
+	if !trip || !atomic.CompareAndSwapInt32(&b.tripped, 0, 1) {
+		return
+	}
+
+	go b.a.Abort(b.candidate, reason)
+}
+
+func (b *breaker) add(failed bool) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if failed {
+		b.consecutive++
+	} else {
+		b.consecutive = 0
+	}
+
+	if b.cfg.ConsecutiveFailures > 0 && b.consecutive >= b.cfg.ConsecutiveFailures {
+		return fmt.Sprintf("circuit breaker tripped after %d consecutive failures", b.consecutive), true
+	}
+
+	if b.cfg.FailureRatio <= 0 || b.cfg.Window <= 0 {
+		return "", false
+	}
+
+	width := int64(b.cfg.Window) / breakerBuckets
+	if width == 0 {
+		width = 1
+	}
+	now := b.now().UnixNano()
+	start := now - now%width
+
+	bucket := &b.buckets[(now/width)%breakerBuckets]
+	if bucket.start != start {
+		*bucket = breakerBucket{start: start}
+	}
+	bucket.total++
+	if failed {
+		bucket.failed++
+	}
+
+	var total, failures int
+	for _, bb := range b.buckets {
+		if now-bb.start >= int64(b.cfg.Window) {
+			continue
+		}
+		total += bb.total
+		failures += bb.failed
+	}
+
+	if total < b.cfg.MinRequests || total == 0 {
+		return "", false
+	}
+
+	ratio := float64(failures) / float64(total)
+	if ratio <= b.cfg.FailureRatio {
+		return "", false
+	}
+
+	return fmt.Sprintf("circuit breaker tripped with a failure ratio of %.2f", ratio), true
+}
+
+// breakerTransport records the outcome of each request with the breaker.
+type breakerTransport struct {
+	http.RoundTripper
+	b *breaker
+}
+
+func (t breakerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(r)
+	if err != nil {
+		// Requests that were canceled (e.g., by the client) are not the
+		// candidate's fault.
+		if r.Context().Err() == nil {
+			t.b.record(true)
+		}
+		return resp, err
+	}
+
+	t.b.record(resp.StatusCode >= 500)
+	return resp, err
+}
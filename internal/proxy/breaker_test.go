@@ -0,0 +1,181 @@
+package proxy_test
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-canary-router/internal/proxy"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TB struct {
+	*testing.T
+
+	spyAborter   *spyAborter
+	spyPlanner   *spyPlanner
+	oldSpyServer *spyServer
+	newResponse  *stubResponse
+
+	oldTestServer *httptest.Server
+	newTestServer *httptest.Server
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TB {
+		oldSpyServer := newSpyServer()
+		newResponse := &stubResponse{status: http.StatusInternalServerError}
+
+		spyPlanner := newSpyPlanner()
+		spyPlanner.percentage = 100
+
+		return TB{
+			T:             t,
+			spyAborter:    newSpyAborter(),
+			spyPlanner:    spyPlanner,
+			oldSpyServer:  oldSpyServer,
+			oldTestServer: httptest.NewServer(oldSpyServer),
+			newResponse:   newResponse,
+			newTestServer: httptest.NewServer(newResponse),
+		}
+	})
+
+	o.AfterEach(func(t TB) {
+		t.oldTestServer.Close()
+		t.newTestServer.Close()
+	})
+
+	o.Spec("it trips after consecutive failures", func(t TB) {
+		p := t.newProxy(proxy.BreakerConfig{ConsecutiveFailures: 3})
+
+		for i := 0; i < 10; i++ {
+			p.ServeHTTP(httptest.NewRecorder(), t.newRequest())
+		}
+
+		Expect(t, t.spyAborter.aborted).To(ViaPolling(Equal([]string{proxy.DefaultCandidate})))
+		Expect(t, t.spyAborter.reason(0)).To(Equal("circuit breaker tripped after 3 consecutive failures"))
+
+		// The canary does not receive any more requests once tripped.
+		Expect(t, len(t.oldSpyServer.requests)).To(Equal(7))
+	})
+
+	o.Spec("it resets after a success", func(t TB) {
+		p := t.newProxy(proxy.BreakerConfig{ConsecutiveFailures: 3})
+
+		p.ServeHTTP(httptest.NewRecorder(), t.newRequest())
+		p.ServeHTTP(httptest.NewRecorder(), t.newRequest())
+
+		t.newResponse.status = http.StatusOK
+		p.ServeHTTP(httptest.NewRecorder(), t.newRequest())
+
+		t.newResponse.status = http.StatusInternalServerError
+		p.ServeHTTP(httptest.NewRecorder(), t.newRequest())
+		p.ServeHTTP(httptest.NewRecorder(), t.newRequest())
+
+		Expect(t, t.spyAborter.aborted).To(Always(HaveLen(0)))
+	})
+
+	o.Spec("it does not wait on the aborter", func(t TB) {
+		t.spyAborter.block = make(chan struct{})
+		defer close(t.spyAborter.block)
+		p := t.newProxy(proxy.BreakerConfig{ConsecutiveFailures: 1})
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			p.ServeHTTP(httptest.NewRecorder(), t.newRequest())
+			p.ServeHTTP(httptest.NewRecorder(), t.newRequest())
+		}()
+
+		Expect(t, done).To(ViaPolling(BeClosed()))
+		Expect(t, len(t.oldSpyServer.requests)).To(Equal(1))
+	})
+
+	o.Spec("it trips on the failure ratio", func(t TB) {
+		p := t.newProxy(proxy.BreakerConfig{
+			FailureRatio: 0.5,
+			Window:       time.Minute,
+			MinRequests:  4,
+		})
+
+		for i := 0; i < 4; i++ {
+			if i%2 == 0 {
+				t.newResponse.status = http.StatusOK
+			} else {
+				t.newResponse.status = http.StatusInternalServerError
+			}
+			p.ServeHTTP(httptest.NewRecorder(), t.newRequest())
+		}
+		Expect(t, t.spyAborter.aborted).To(Always(HaveLen(0)))
+
+		p.ServeHTTP(httptest.NewRecorder(), t.newRequest())
+		Expect(t, t.spyAborter.aborted).To(ViaPolling(Equal([]string{proxy.DefaultCandidate})))
+	})
+}
+
+func (t TB) newProxy(c proxy.BreakerConfig) *proxy.Proxy {
+	return proxy.New(
+		t.oldTestServer.URL,
+		t.newTestServer.URL,
+		t.spyPlanner,
+		true,
+		log.New(ioutil.Discard, "", 0),
+		proxy.WithCircuitBreaker(c, t.spyAborter),
+	)
+}
+
+func (t TB) newRequest() *http.Request {
+	req, err := http.NewRequest("GET", "http://some.url", nil)
+	Expect(t, err).To(BeNil())
+
+	return req
+}
+
+type spyAborter struct {
+	mu         sync.Mutex
+	candidates []string
+	reasons    []string
+
+	// block, if set, holds Abort until it is closed.
+	block chan struct{}
+}
+
+func newSpyAborter() *spyAborter {
+	return &spyAborter{}
+}
+
+func (s *spyAborter) Abort(candidate, reason string) {
+	if s.block != nil {
+		<-s.block
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.candidates = append(s.candidates, candidate)
+	s.reasons = append(s.reasons, reason)
+}
+
+func (s *spyAborter) aborted() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.candidates...)
+}
+
+func (s *spyAborter) reason(i int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.reasons[i]
+}
@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// DiffConfig configures how the response of a candidate to a shadowed
+// request is compared to the response of the old route.
+type DiffConfig struct {
+	// Headers are the names of the response headers that have to match.
+	Headers []string
+
+	// IgnoreFields are the JSON fields that are removed from both bodies
+	// before they are compared. Nested fields are separated by a '.'
+	// (e.g., "meta.timestamp").
+	IgnoreFields []string
+
+	// MaxBodySize is the largest body that is compared. Larger bodies are
+	// not compared, but the status code and headers still are.
+	MaxBodySize int
+}
+
+// Differ compares the responses of shadowed requests and keeps track of the
+// mismatches for each candidate.
+type Differ struct {
+	cfg DiffConfig
+	log *log.Logger
+
+	mu     sync.Mutex
+	counts map[string]DiffCounts
+}
+
+// DiffCounts are the number of compared and mismatched responses for a
+// candidate.
+type DiffCounts struct {
+	Compared   int64
+	Mismatched int64
+}
+
+// MismatchRate is the ratio of mismatched to compared responses.
+func (c DiffCounts) MismatchRate() float64 {
+	if c.Compared == 0 {
+		return 0
+	}
+
+	return float64(c.Mismatched) / float64(c.Compared)
+}
+
+func NewDiffer(cfg DiffConfig, log *log.Logger) *Differ {
+	return &Differ{
+		cfg:    cfg,
+		log:    log,
+		counts: make(map[string]DiffCounts),
+	}
+}
+
+// WithDiffer compares the responses of shadowed requests with the given
+// Differ.
+func WithDiffer(d *Differ) ProxyOption {
+	return func(p *Proxy) {
+		p.differ = d
+	}
+}
+
+// Counts returns the counts for the given candidate.
+func (d *Differ) Counts(candidate string) DiffCounts {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.counts[candidate]
+}
+
+// Predicate returns a Predicate that fails once the candidate's mismatch
+// rate is above maxRate. It always succeeds until minCompared responses
+// have been compared.
+func (d *Differ) Predicate(candidate string, maxRate float64, minCompared int64) Predicate {
+	return func() bool {
+		c := d.Counts(candidate)
+		if c.Compared < minCompared {
+			return true
+		}
+
+		return c.MismatchRate() <= maxRate
+	}
+}
+
+// compare records whether the responses match and logs the differences.
+func (d *Differ) compare(candidate string, req shadowRequest, actual *recordedResponse) {
+	diffs := d.diff(req.expected, actual)
+
+	d.mu.Lock()
+	c := d.counts[candidate]
+	c.Compared++
+	if len(diffs) > 0 {
+		c.Mismatched++
+	}
+	d.counts[candidate] = c
+	d.mu.Unlock()
+
+	if len(diffs) > 0 {
+		d.log.Printf("response mismatch for %s %s (%s): %s", req.method, req.url, candidate, strings.Join(diffs, ", "))
+	}
+}
+
+func (d *Differ) diff(expected, actual *recordedResponse) []string {
+	var diffs []string
+	if expected.status != actual.status {
+		diffs = append(diffs, fmt.Sprintf("status %d != %d", expected.status, actual.status))
+	}
+
+	for _, h := range d.cfg.Headers {
+		if e, a := expected.header.Get(h), actual.header.Get(h); e != a {
+			diffs = append(diffs, fmt.Sprintf("header %s %q != %q", h, e, a))
+		}
+	}
+
+	if expected.truncated || actual.truncated {
+		return diffs
+	}
+
+	if !bytes.Equal(d.normalize(expected.body.Bytes()), d.normalize(actual.body.Bytes())) {
+		diffs = append(diffs, "body")
+	}
+
+	return diffs
+}
+
+// normalize removes the ignored fields from a JSON body. Bodies that are not
+// JSON are returned as is.
+func (d *Differ) normalize(body []byte) []byte {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return body
+	}
+
+	for _, f := range d.cfg.IgnoreFields {
+		removeField(v, strings.Split(f, "."))
+	}
+
+	// Map keys are sorted while marshalling.
+	normalized, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+
+	return normalized
+}
+
+func removeField(v interface{}, path []string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			delete(v, path[0])
+			return
+		}
+		removeField(v[path[0]], path[1:])
+	case []interface{}:
+		for _, e := range v {
+			removeField(e, path)
+		}
+	}
+}
+
+// recordedResponse is a response captured for comparison.
+type recordedResponse struct {
+	status    int
+	header    http.Header
+	body      bytes.Buffer
+	truncated bool
+}
+
+// recordingResponseWriter records the response while writing it to the
+// underlying ResponseWriter (if there is one).
+type recordingResponseWriter struct {
+	w           http.ResponseWriter
+	header      http.Header
+	maxBodySize int
+	resp        *recordedResponse
+}
+
+func newRecordingResponseWriter(w http.ResponseWriter, maxBodySize int) *recordingResponseWriter {
+	header := make(http.Header)
+	if w != nil {
+		header = w.Header()
+	}
+
+	return &recordingResponseWriter{
+		w:           w,
+		header:      header,
+		maxBodySize: maxBodySize,
+		resp: &recordedResponse{
+			status: http.StatusOK,
+		},
+	}
+}
+
+func (w *recordingResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	w.resp.status = status
+	w.resp.header = cloneHeader(w.header)
+
+	if w.w != nil {
+		w.w.WriteHeader(status)
+	}
+}
+
+func (w *recordingResponseWriter) Write(data []byte) (int, error) {
+	if w.resp.header == nil {
+		w.resp.header = cloneHeader(w.header)
+	}
+
+	if !w.resp.truncated {
+		if w.resp.body.Len()+len(data) > w.maxBodySize {
+			w.resp.truncated = true
+			w.resp.body.Reset()
+		} else {
+			w.resp.body.Write(data)
+		}
+	}
+
+	if w.w == nil {
+		return len(data), nil
+	}
+
+	return w.w.Write(data)
+}
+
+// Flush implements http.Flusher so that streaming responses still work.
+func (w *recordingResponseWriter) Flush() {
+	if f, ok := w.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *recordingResponseWriter) response() *recordedResponse {
+	if w.resp.header == nil {
+		w.resp.header = cloneHeader(w.header)
+	}
+
+	return w.resp
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+
+	return c
+}
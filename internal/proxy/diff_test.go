@@ -0,0 +1,141 @@
+package proxy_test
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/poy/cf-canary-router/internal/proxy"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TD struct {
+	*testing.T
+	p *proxy.Proxy
+	d *proxy.Differ
+
+	oldResponse *stubResponse
+	newResponse *stubResponse
+
+	oldTestServer *httptest.Server
+	newTestServer *httptest.Server
+}
+
+func TestDiffer(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TD {
+		oldResponse := &stubResponse{status: 200, body: `{"a":1,"meta":{"ts":1}}`}
+		newResponse := &stubResponse{status: 200, body: `{"meta":{"ts":2},"a":1}`}
+		oldTestServer := httptest.NewServer(oldResponse)
+		newTestServer := httptest.NewServer(newResponse)
+
+		spyPlanner := newSpyPlanner()
+		spyPlanner.shadow = 100
+
+		d := proxy.NewDiffer(proxy.DiffConfig{
+			Headers:      []string{"X-Some-Header"},
+			IgnoreFields: []string{"meta.ts"},
+			MaxBodySize:  1024,
+		}, log.New(ioutil.Discard, "", 0))
+
+		return TD{
+			T:             t,
+			d:             d,
+			oldResponse:   oldResponse,
+			newResponse:   newResponse,
+			oldTestServer: oldTestServer,
+			newTestServer: newTestServer,
+			p: proxy.New(
+				oldTestServer.URL,
+				newTestServer.URL,
+				spyPlanner,
+				true,
+				log.New(ioutil.Discard, "", 0),
+				proxy.WithDiffer(d),
+			),
+		}
+	})
+
+	o.AfterEach(func(t TD) {
+		t.oldTestServer.Close()
+		t.newTestServer.Close()
+	})
+
+	o.Spec("it ignores the given fields", func(t TD) {
+		recorder := t.serve()
+		Expect(t, recorder.Body.String()).To(Equal(`{"a":1,"meta":{"ts":1}}`))
+
+		Expect(t, func() proxy.DiffCounts {
+			return t.d.Counts(proxy.DefaultCandidate)
+		}).To(ViaPolling(Equal(proxy.DiffCounts{Compared: 1})))
+	})
+
+	o.Spec("it counts mismatched status codes", func(t TD) {
+		t.newResponse.status = 500
+		t.serve()
+
+		Expect(t, func() proxy.DiffCounts {
+			return t.d.Counts(proxy.DefaultCandidate)
+		}).To(ViaPolling(Equal(proxy.DiffCounts{Compared: 1, Mismatched: 1})))
+	})
+
+	o.Spec("it counts mismatched headers", func(t TD) {
+		t.newResponse.header = "other-value"
+		t.serve()
+
+		Expect(t, func() proxy.DiffCounts {
+			return t.d.Counts(proxy.DefaultCandidate)
+		}).To(ViaPolling(Equal(proxy.DiffCounts{Compared: 1, Mismatched: 1})))
+	})
+
+	o.Spec("it counts mismatched bodies", func(t TD) {
+		t.newResponse.body = `{"a":2}`
+		t.serve()
+
+		Expect(t, func() proxy.DiffCounts {
+			return t.d.Counts(proxy.DefaultCandidate)
+		}).To(ViaPolling(Equal(proxy.DiffCounts{Compared: 1, Mismatched: 1})))
+	})
+
+	o.Spec("it fails the predicate once the mismatch rate is too high", func(t TD) {
+		predicate := t.d.Predicate(proxy.DefaultCandidate, 0.5, 2)
+
+		t.newResponse.status = 500
+		t.serve()
+		Expect(t, func() proxy.DiffCounts {
+			return t.d.Counts(proxy.DefaultCandidate)
+		}).To(ViaPolling(Equal(proxy.DiffCounts{Compared: 1, Mismatched: 1})))
+		Expect(t, predicate()).To(BeTrue())
+
+		t.serve()
+		Expect(t, predicate).To(ViaPolling(BeFalse()))
+	})
+}
+
+func (t TD) serve() *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "http://some.url", nil)
+	Expect(t, err).To(BeNil())
+
+	t.p.ServeHTTP(recorder, req)
+	return recorder
+}
+
+type stubResponse struct {
+	status int
+	header string
+	body   string
+}
+
+func (s *stubResponse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Some-Header", s.header)
+	w.WriteHeader(s.status)
+	w.Write([]byte(s.body))
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"sync"
+
+	"github.com/poy/cf-canary-router/internal/structuredlogs"
+)
+
+// WithFallback retries requests on the old route when a candidate fails to
+// respond or responds with a 502, 503 or 504. Only requests without a body
+// or with a body of at most maxBodySize bytes (which is buffered) are
+// retried. Requests that are not idempotent (e.g., POST) are only retried if
+// they could not be sent to the candidate, and requests whose client has
+// gone away are not retried at all. Each fallback is counted and written to
+// w.
+func WithFallback(maxBodySize int64, w EventWriter) ProxyOption {
+	return func(p *Proxy) {
+		p.fallback = &fallback{
+			maxBodySize: maxBodySize,
+			w:           w,
+			counts:      make(map[string]int64),
+		}
+	}
+}
+
+var errFallback = errors.New("falling back to previous route")
+
+type fallbackKey struct{}
+
+// fallbackAttempt is stored in the request's context to find out whether
+// the candidate failed.
+type fallbackAttempt struct {
+	err error
+
+	// idempotent is set for requests that can be sent twice. sent is set
+	// once a connection to the candidate has been made, after which other
+	// requests might have been received by the candidate.
+	idempotent bool
+	sent       bool
+}
+
+// retryable returns true if the request can still be retried on the old
+// route.
+func (a *fallbackAttempt) retryable(r *http.Request) bool {
+	return r.Context().Err() == nil && (a.idempotent || !a.sent)
+}
+
+// idempotent returns true if sending a request with the given method twice
+// has the same effect as sending it once (see RFC 7231, section 4.2.2).
+func idempotent(method string) bool {
+	switch method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	return false
+}
+
+type fallback struct {
+	maxBodySize int64
+	w           EventWriter
+
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+// install hooks into the candidate's reverse proxy to detect failures of
+// requests that can be retried.
+func (f *fallback) install(rp *httputil.ReverseProxy, log *log.Logger) {
+	rp.ModifyResponse = func(resp *http.Response) error {
+		a, ok := resp.Request.Context().Value(fallbackKey{}).(*fallbackAttempt)
+		if !ok || !a.retryable(resp.Request) {
+			return nil
+		}
+
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			a.err = fmt.Errorf("status %d", resp.StatusCode)
+			return errFallback
+		}
+
+		return nil
+	}
+
+	rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if a, ok := r.Context().Value(fallbackKey{}).(*fallbackAttempt); ok && (a.err != nil || a.retryable(r)) {
+			if a.err == nil {
+				a.err = err
+			}
+
+			// Nothing has been written yet, the request is retried on the
+			// previous route.
+			return
+		}
+
+		log.Printf("http: proxy error: %v", err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+// serve routes the request to the candidate. If the candidate fails, the
+// request is retried on the old route and true is returned.
+func (f *fallback) serve(candidate string, rp, oldRp *httputil.ReverseProxy, w http.ResponseWriter, r *http.Request) bool {
+	body, ok := f.bufferBody(r)
+	if !ok {
+		rp.ServeHTTP(w, r)
+		return false
+	}
+
+	a := &fallbackAttempt{idempotent: idempotent(r.Method)}
+	ctx := context.WithValue(r.Context(), fallbackKey{}, a)
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			a.sent = true
+		},
+	})
+	rp.ServeHTTP(w, r.WithContext(ctx))
+	if a.err == nil {
+		return false
+	}
+
+	f.mu.Lock()
+	f.counts[candidate]++
+	f.mu.Unlock()
+
+	f.w.Write(structuredlogs.Event{
+		Code:    Fallback,
+		Message: fmt.Sprintf("request to %s failed (%s). Falling back to previous route...", candidate, a.err),
+	})
+
+	if body != nil {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	oldRp.ServeHTTP(w, r)
+	return true
+}
+
+// bufferBody reads the body so that the request can be sent twice. It
+// returns false if the body is too large.
+func (f *fallback) bufferBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+
+	if r.ContentLength > f.maxBodySize {
+		return nil, false
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, f.maxBodySize+1))
+	if err != nil || int64(len(body)) > f.maxBodySize {
+		r.Body = readCloser{
+			Reader: io.MultiReader(bytes.NewReader(body), r.Body),
+			Closer: r.Body,
+		}
+		return nil, false
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, true
+}
+
+func (f *fallback) count(candidate string) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.counts[candidate]
+}
@@ -0,0 +1,166 @@
+package proxy_test
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/poy/cf-canary-router/internal/proxy"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TF struct {
+	*testing.T
+	p *proxy.Proxy
+
+	spyEventWriter *spyEventWriter
+	oldSpyServer   *spyServer
+	newResponse    *stubResponse
+
+	oldTestServer *httptest.Server
+	newTestServer *httptest.Server
+}
+
+func TestFallback(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TF {
+		oldSpyServer := newSpyServer()
+		oldTestServer := httptest.NewServer(oldSpyServer)
+		newResponse := &stubResponse{status: http.StatusServiceUnavailable}
+		newTestServer := httptest.NewServer(newResponse)
+
+		spyPlanner := newSpyPlanner()
+		spyPlanner.percentage = 100
+		spyEventWriter := newSpyEventWriter()
+
+		return TF{
+			T:              t,
+			spyEventWriter: spyEventWriter,
+			oldSpyServer:   oldSpyServer,
+			oldTestServer:  oldTestServer,
+			newResponse:    newResponse,
+			newTestServer:  newTestServer,
+			p: proxy.New(
+				oldTestServer.URL,
+				newTestServer.URL,
+				spyPlanner,
+				true,
+				log.New(ioutil.Discard, "", 0),
+				proxy.WithFallback(4, spyEventWriter),
+			),
+		}
+	})
+
+	o.AfterEach(func(t TF) {
+		t.oldTestServer.Close()
+		t.newTestServer.Close()
+	})
+
+	o.Spec("it falls back when the candidate is unavailable", func(t TF) {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", "http://some.url", strings.NewReader("body"))
+		Expect(t, err).To(BeNil())
+
+		t.p.ServeHTTP(recorder, req)
+
+		Expect(t, recorder.Code).To(Equal(http.StatusOK))
+
+		var body []byte
+		Expect(t, t.oldSpyServer.bodies).To(Chain(Receive(), Fetch(&body)))
+		Expect(t, string(body)).To(Equal("body"))
+
+		Expect(t, t.p.Fallbacks(proxy.DefaultCandidate)).To(Equal(int64(1)))
+		Expect(t, t.spyEventWriter.events).To(HaveLen(1))
+		Expect(t, t.spyEventWriter.events[0].Code).To(Equal(proxy.Fallback))
+	})
+
+	o.Spec("it falls back when the candidate can not be reached", func(t TF) {
+		t.newTestServer.Close()
+
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+
+		t.p.ServeHTTP(recorder, req)
+
+		Expect(t, recorder.Code).To(Equal(http.StatusOK))
+		Expect(t, len(t.oldSpyServer.requests)).To(Equal(1))
+	})
+
+	o.Spec("it does not fall back for requests that are not idempotent once they are sent", func(t TF) {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "http://some.url", strings.NewReader("body"))
+		Expect(t, err).To(BeNil())
+
+		t.p.ServeHTTP(recorder, req)
+
+		Expect(t, recorder.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(t, len(t.oldSpyServer.requests)).To(Equal(0))
+		Expect(t, t.p.Fallbacks(proxy.DefaultCandidate)).To(Equal(int64(0)))
+	})
+
+	o.Spec("it falls back for requests that are not idempotent when the candidate can not be reached", func(t TF) {
+		t.newTestServer.Close()
+
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "http://some.url", strings.NewReader("body"))
+		Expect(t, err).To(BeNil())
+
+		t.p.ServeHTTP(recorder, req)
+
+		Expect(t, recorder.Code).To(Equal(http.StatusOK))
+
+		var body []byte
+		Expect(t, t.oldSpyServer.bodies).To(Chain(Receive(), Fetch(&body)))
+		Expect(t, string(body)).To(Equal("body"))
+	})
+
+	o.Spec("it does not fall back once the client has gone away", func(t TF) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+
+		t.p.ServeHTTP(recorder, req.WithContext(ctx))
+
+		Expect(t, recorder.Code).To(Equal(http.StatusBadGateway))
+		Expect(t, len(t.oldSpyServer.requests)).To(Equal(0))
+		Expect(t, t.p.Fallbacks(proxy.DefaultCandidate)).To(Equal(int64(0)))
+	})
+
+	o.Spec("it does not fall back for other statuses", func(t TF) {
+		t.newResponse.status = http.StatusInternalServerError
+
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+
+		t.p.ServeHTTP(recorder, req)
+
+		Expect(t, recorder.Code).To(Equal(http.StatusInternalServerError))
+		Expect(t, len(t.oldSpyServer.requests)).To(Equal(0))
+		Expect(t, t.p.Fallbacks(proxy.DefaultCandidate)).To(Equal(int64(0)))
+	})
+
+	o.Spec("it does not fall back for large bodies", func(t TF) {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "http://some.url", strings.NewReader("too-large"))
+		Expect(t, err).To(BeNil())
+
+		t.p.ServeHTTP(recorder, req)
+
+		Expect(t, recorder.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(t, len(t.oldSpyServer.requests)).To(Equal(0))
+	})
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/poy/cf-canary-router/internal/structuredlogs"
+)
+
+// GateAction is what a gate does once its Duration is up.
+type GateAction string
+
+const (
+	// GateReject aborts the plan. It is the default.
+	GateReject GateAction = "reject"
+
+	// GateApprove moves on to the next step.
+	GateApprove GateAction = "approve"
+)
+
+// ErrNoGate is returned when the plan is not waiting for approval.
+var ErrNoGate = errors.New("plan is not waiting for approval")
+
+// UnmarshalText implements encoding.TextUnmarshaler so that unknown actions
+// are rejected when a plan is parsed.
+func (a *GateAction) UnmarshalText(text []byte) error {
+	switch action := GateAction(text); action {
+	case "", GateReject, GateApprove:
+		*a = action
+		return nil
+	default:
+		return fmt.Errorf("unknown gate action: %s", text)
+	}
+}
+
+// held returns the last step at or before the given index that is not a
+// gate. Its percentages are the ones in use at the given index. It returns
+// false if there is no such step.
+func (p Plan) held(idx int64) (PlanStep, bool) {
+	for i := idx; i >= 0; i-- {
+		if i < int64(len(p)) && !p[i].Gate {
+			return p[i], true
+		}
+	}
+
+	return PlanStep{}, false
+}
+
+// Approve moves a plan that is waiting at a gate on to the next step.
+func (p *RoutePlanner) Approve() error {
+	if err := p.checkAborted(); err != nil {
+		return err
+	}
+
+	c, err := p.update(func(c currentPlan) (currentPlan, error) {
+		if !p.atGate(c) {
+			return c, ErrNoGate
+		}
+
+		now := p.now()
+		updated := currentPlan{
+			idx:  c.idx + 1,
+			last: now,
+		}
+		if !c.paused.IsZero() {
+			updated.paused = now
+		}
+
+		return updated, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	p.reportStep(c)
+	p.evaluate()
+
+	return nil
+}
+
+// Reject aborts a plan that is waiting at a gate. All the traffic is
+// directed to the previous route.
+func (p *RoutePlanner) Reject(reason string) error {
+	if err := p.checkAborted(); err != nil {
+		return err
+	}
+
+	if !p.atGate(*p.load()) {
+		return ErrNoGate
+	}
+
+	p.AbortPlan(reason)
+
+	return nil
+}
+
+// atGate returns true if the given step is a gate.
+func (p *RoutePlanner) atGate(c currentPlan) bool {
+	return c.idx >= 0 && c.idx < int64(len(p.plan)) && p.plan[c.idx].Gate
+}
+
+// gateExpired returns true if the given step is a gate that rejects the plan
+// and its Duration is up.
+func (p *RoutePlanner) gateExpired(c currentPlan) bool {
+	if !p.atGate(c) || !c.paused.IsZero() {
+		return false
+	}
+
+	step := p.plan[c.idx]
+	return step.Duration > 0 &&
+		step.OnTimeout != GateApprove &&
+		p.now().Sub(c.last) >= step.Duration
+}
+
+// reportGate writes the event for a gate the plan has reached.
+func (p *RoutePlanner) reportGate(c currentPlan) {
+	step := p.plan[c.idx]
+
+	msg := fmt.Sprintf("waiting for approval at step %d of %d", c.idx+1, len(p.plan))
+	if step.Duration > 0 {
+		action := step.OnTimeout
+		if action == "" {
+			action = GateReject
+		}
+		msg = fmt.Sprintf("%s (%ss in %s)", msg, action, step.Duration)
+	}
+
+	p.w.Write(structuredlogs.Event{
+		Code:    AwaitingApproval,
+		Message: msg,
+	})
+}
@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CurrentBackend is the name the old route is recorded under.
+const CurrentBackend = "current"
+
+// LatencyBuckets are the upper bounds of the latency histogram. The last
+// bucket (not listed) has no upper bound.
+var LatencyBuckets = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Metrics records the requests sent to each backend. Failed requests (e.g.,
+// the backend could not be reached) are recorded as a 502.
+type Metrics struct {
+	mu       sync.Mutex
+	backends map[string]*BackendStats
+}
+
+// BackendStats are the recorded requests for a single backend.
+type BackendStats struct {
+	Requests int64
+
+	// StatusClasses are the number of responses for each class of status
+	// code (1xx through 5xx).
+	StatusClasses [5]int64
+
+	// Latencies are the number of requests in each of the LatencyBuckets.
+	// The last entry is for requests that are slower than every bucket.
+	Latencies  []int64
+	LatencySum time.Duration
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		backends: make(map[string]*BackendStats),
+	}
+}
+
+// WithMetrics records every request to each backend with the given Metrics.
+func WithMetrics(m *Metrics) ProxyOption {
+	return func(p *Proxy) {
+		p.metrics = m
+	}
+}
+
+// Record adds a request to the backend's stats.
+func (m *Metrics) Record(backend string, status int, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.backends[backend]
+	if !ok {
+		s = &BackendStats{
+			Latencies: make([]int64, len(LatencyBuckets)+1),
+		}
+		m.backends[backend] = s
+	}
+
+	s.Requests++
+	if class := status/100 - 1; class >= 0 && class < len(s.StatusClasses) {
+		s.StatusClasses[class]++
+	}
+
+	i := 0
+	for i < len(LatencyBuckets) && latency > LatencyBuckets[i] {
+		i++
+	}
+	s.Latencies[i]++
+	s.LatencySum += latency
+}
+
+// Stats returns a copy of the backend's stats.
+func (m *Metrics) Stats(backend string) BackendStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.backends[backend]
+	if !ok {
+		return BackendStats{
+			Latencies: make([]int64, len(LatencyBuckets)+1),
+		}
+	}
+
+	c := *s
+	c.Latencies = append([]int64(nil), s.Latencies...)
+
+	return c
+}
+
+// Backends returns the name of every backend with recorded requests.
+func (m *Metrics) Backends() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make(map[string]int, len(m.backends))
+	for name := range m.backends {
+		names[name] = 0
+	}
+
+	return sortedNames(names)
+}
+
+// ErrorRatio is the ratio of 5xx responses to requests.
+func (s BackendStats) ErrorRatio() float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+
+	return float64(s.StatusClasses[4]) / float64(s.Requests)
+}
+
+// Quantile estimates the latency of the given quantile (e.g., 0.99) by
+// interpolating within the histogram's buckets.
+func (s BackendStats) Quantile(q float64) time.Duration {
+	if s.Requests == 0 {
+		return 0
+	}
+
+	rank := q * float64(s.Requests)
+
+	var (
+		count int64
+		lower time.Duration
+	)
+	for i, n := range s.Latencies {
+		if i == len(LatencyBuckets) {
+			// The last bucket does not have an upper bound.
+			return lower
+		}
+
+		upper := LatencyBuckets[i]
+		if float64(count+n) >= rank && n > 0 {
+			fraction := (rank - float64(count)) / float64(n)
+			return lower + time.Duration(fraction*float64(upper-lower))
+		}
+
+		count += n
+		lower = upper
+	}
+
+	return lower
+}
+
+// metricsTransport records the outcome of each request to a backend.
+type metricsTransport struct {
+	http.RoundTripper
+	m       *Metrics
+	backend string
+}
+
+func (t metricsTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(r)
+	latency := time.Since(start)
+
+	if err != nil {
+		// Requests that were canceled (e.g., by the client) are not the
+		// backend's fault.
+		if r.Context().Err() == nil {
+			t.m.Record(t.backend, http.StatusBadGateway, latency)
+		}
+		return resp, err
+	}
+
+	t.m.Record(t.backend, resp.StatusCode, latency)
+	return resp, err
+}
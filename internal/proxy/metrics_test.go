@@ -0,0 +1,134 @@
+package proxy_test
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-canary-router/internal/proxy"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TM struct {
+	*testing.T
+	m *proxy.Metrics
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TM {
+		return TM{
+			T: t,
+			m: proxy.NewMetrics(),
+		}
+	})
+
+	o.Spec("it records status classes", func(t TM) {
+		t.m.Record("canary", 200, time.Millisecond)
+		t.m.Record("canary", 204, time.Millisecond)
+		t.m.Record("canary", 404, time.Millisecond)
+		t.m.Record("canary", 503, time.Millisecond)
+
+		s := t.m.Stats("canary")
+		Expect(t, s.Requests).To(Equal(int64(4)))
+		Expect(t, s.StatusClasses).To(Equal([5]int64{0, 2, 0, 1, 1}))
+		Expect(t, s.ErrorRatio()).To(Equal(0.25))
+		Expect(t, t.m.Backends()).To(Equal([]string{"canary"}))
+	})
+
+	o.Spec("it returns empty stats for unknown backends", func(t TM) {
+		s := t.m.Stats("unknown")
+		Expect(t, s.Requests).To(Equal(int64(0)))
+		Expect(t, s.ErrorRatio()).To(Equal(0.0))
+		Expect(t, s.Quantile(0.99)).To(Equal(time.Duration(0)))
+	})
+
+	o.Spec("it estimates quantiles from the histogram", func(t TM) {
+		for i := 0; i < 90; i++ {
+			t.m.Record("canary", 200, 3*time.Millisecond)
+		}
+		for i := 0; i < 10; i++ {
+			t.m.Record("canary", 200, 200*time.Millisecond)
+		}
+
+		s := t.m.Stats("canary")
+		Expect(t, s.Quantile(0.5)).To(Equal(2777777 * time.Nanosecond))
+		Expect(t, s.Quantile(0.95)).To(Equal(175 * time.Millisecond))
+		Expect(t, s.LatencySum).To(Equal(90*3*time.Millisecond + 10*200*time.Millisecond))
+	})
+
+	o.Spec("it records requests to each backend", func(t TM) {
+		oldTestServer := httptest.NewServer(newSpyServer())
+		defer oldTestServer.Close()
+		newTestServer := httptest.NewServer(&stubResponse{status: http.StatusInternalServerError})
+		defer newTestServer.Close()
+
+		spyPlanner := newSpyPlanner()
+		spyPlanner.percentage = 50
+
+		p := proxy.New(
+			oldTestServer.URL,
+			newTestServer.URL,
+			spyPlanner,
+			true,
+			log.New(ioutil.Discard, "", 0),
+			proxy.WithMetrics(t.m),
+		)
+
+		for i := 0; i < 100; i++ {
+			req, err := http.NewRequest("GET", "http://some.url", nil)
+			Expect(t, err).To(BeNil())
+			p.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		current := t.m.Stats(proxy.CurrentBackend)
+		Expect(t, current.Requests).To(Equal(int64(50)))
+		Expect(t, current.StatusClasses[1]).To(Equal(int64(50)))
+
+		canary := t.m.Stats(proxy.DefaultCandidate)
+		Expect(t, canary.Requests).To(Equal(int64(50)))
+		Expect(t, canary.ErrorRatio()).To(Equal(1.0))
+	})
+
+	o.Spec("it does not record copies of shadowed requests", func(t TM) {
+		oldTestServer := httptest.NewServer(&stubResponse{status: http.StatusOK})
+		defer oldTestServer.Close()
+		newSpyServer := newSpyServer()
+		newTestServer := httptest.NewServer(newSpyServer)
+		defer newTestServer.Close()
+
+		spyPlanner := newSpyPlanner()
+		spyPlanner.shadow = 100
+
+		p := proxy.New(
+			oldTestServer.URL,
+			newTestServer.URL,
+			spyPlanner,
+			true,
+			log.New(ioutil.Discard, "", 0),
+			proxy.WithMetrics(t.m),
+		)
+
+		for i := 0; i < 10; i++ {
+			req, err := http.NewRequest("GET", "http://some.url", nil)
+			Expect(t, err).To(BeNil())
+			p.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		Expect(t, func() int {
+			return len(newSpyServer.requests)
+		}).To(ViaPolling(Equal(10)))
+		Expect(t, t.m.Stats(proxy.CurrentBackend).Requests).To(Equal(int64(10)))
+		Expect(t, func() int64 {
+			return t.m.Stats(proxy.DefaultCandidate).Requests
+		}).To(Always(Equal(int64(0))))
+	})
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// OverrideSecretHeader is the header that carries the shared secret for
+// override requests.
+const OverrideSecretHeader = "X-Canary-Secret"
+
+// Override allows a request to force the backend it is routed to, regardless
+// of the plan. A value of "always" (or "1", "true") forces the default
+// candidate and "never" (or "0", "false") forces the old route. The name of a
+// candidate forces that candidate.
+type Override struct {
+	// Header is the name of the header that is checked for an override. It
+	// is ignored if empty.
+	Header string
+
+	// QueryParam is the name of the query parameter that is checked for an
+	// override. It is ignored if empty.
+	QueryParam string
+
+	// Secret, if set, has to be given via the OverrideSecretHeader for the
+	// override to be honored.
+	Secret string
+}
+
+// WithOverride enables the given override rules.
+func WithOverride(o Override) ProxyOption {
+	return func(p *Proxy) {
+		p.override = o
+	}
+}
+
+// check returns the candidate the request should go to (an empty string for
+// the old route) and whether an override was given at all.
+func (o Override) check(r *http.Request) (candidate string, ok bool) {
+	var value string
+	if o.Header != "" {
+		value = r.Header.Get(o.Header)
+	}
+
+	if value == "" && o.QueryParam != "" {
+		value = r.URL.Query().Get(o.QueryParam)
+	}
+
+	if value == "" {
+		return "", false
+	}
+
+	if o.Secret != "" {
+		secret := r.Header.Get(OverrideSecretHeader)
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(o.Secret)) != 1 {
+			return "", false
+		}
+	}
+
+	switch strings.ToLower(value) {
+	case "always", "1", "true":
+		return DefaultCandidate, true
+	case "never", "0", "false":
+		return "", true
+	default:
+		return value, true
+	}
+}
@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// UnmarshalJSON implements json.Unmarshaler. The Duration is either given in
+// nanoseconds or as a string parsed by time.ParseDuration.
+func (s *PlanStep) UnmarshalJSON(data []byte) error {
+	type step PlanStep
+	v := struct {
+		*step
+		Duration json.RawMessage
+	}{
+		step: (*step)(s),
+	}
+
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	d, err := parseDuration(v.Duration)
+	if err != nil {
+		return err
+	}
+	s.Duration = d
+
+	return nil
+}
+
+func parseDuration(data json.RawMessage) (time.Duration, error) {
+	if len(data) == 0 || string(data) == "null" {
+		return 0, nil
+	}
+
+	if data[0] != '"' {
+		var ns int64
+		if err := json.Unmarshal(data, &ns); err != nil {
+			return 0, fmt.Errorf("invalid duration %s: must be nanoseconds or a string (e.g., \"5m\")", data)
+		}
+
+		return time.Duration(ns), nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return 0, err
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q: %s", s, err)
+	}
+
+	return d, nil
+}
+
+// Validate returns an error describing the first problem with the plan:
+// a plan without steps, a step without a positive duration, a percentage
+// outside of [0, 100] or finer than 0.01, a step whose percentages add up
+// to more than 100, a gate that sets percentages of its own, or query
+// settings without any Queries.
+func (p Plan) Validate() error {
+	if len(p) == 0 {
+		return errors.New("plan has no steps")
+	}
+
+	for i, s := range p {
+		if s.Gate {
+			if err := validateGate(s); err != nil {
+				return fmt.Errorf("step %d: %s", i+1, err)
+			}
+			continue
+		}
+
+		if s.OnTimeout != "" {
+			return fmt.Errorf("step %d: OnTimeout is only used by gates", i+1)
+		}
+
+		if s.Duration <= 0 {
+			return fmt.Errorf("step %d: duration must be greater than 0: %s", i+1, s.Duration)
+		}
+
+		if err := validateQueries(s); err != nil {
+			return fmt.Errorf("step %d: %s", i+1, err)
+		}
+
+		if s.Shadow < 0 || s.Shadow > 100 {
+			return fmt.Errorf("step %d: shadow must be between 0 and 100: %d", i+1, s.Shadow)
+		}
+
+		var total float64
+		weights := s.weights()
+		for _, name := range sortedCandidates(weights) {
+			w := weights[name]
+			if w < 0 || w > 100 {
+				return fmt.Errorf("step %d: percentage for %s must be between 0 and 100: %g", i+1, name, w)
+			}
+
+			if roundPercentage(w) != w {
+				return fmt.Errorf("step %d: percentage for %s must be a multiple of %g: %g", i+1, name, minPercentage, w)
+			}
+
+			total += w
+		}
+
+		if roundPercentage(total) > 100 {
+			return fmt.Errorf("step %d: percentages add up to more than 100: %g", i+1, roundPercentage(total))
+		}
+	}
+
+	return nil
+}
+
+func validateGate(s PlanStep) error {
+	if s.Duration < 0 {
+		return fmt.Errorf("duration must not be negative: %s", s.Duration)
+	}
+
+	if s.Percentage != 0 || len(s.Weights) > 0 || s.Shadow != 0 || s.Ramp != RampNone {
+		return errors.New("a gate holds the previous step's percentages and can not set its own")
+	}
+
+	if len(s.Queries) > 0 || s.ReplaceQuery || s.MinEvaluations != 0 || s.Evaluation != nil {
+		return errors.New("a gate can not have queries")
+	}
+
+	if s.Duration == 0 && s.OnTimeout != "" {
+		return errors.New("OnTimeout requires a duration")
+	}
+
+	return nil
+}
+
+func validateQueries(s PlanStep) error {
+	for _, q := range s.Queries {
+		if strings.TrimSpace(q) == "" {
+			return errors.New("queries must not be empty")
+		}
+	}
+
+	if s.MinEvaluations < 0 {
+		return fmt.Errorf("MinEvaluations must not be negative: %d", s.MinEvaluations)
+	}
+
+	if len(s.Queries) == 0 && (s.ReplaceQuery || s.MinEvaluations > 0) {
+		return errors.New("ReplaceQuery and MinEvaluations require Queries")
+	}
+
+	if len(s.Queries) == 0 && s.Evaluation != nil {
+		return errors.New("Evaluation requires Queries")
+	}
+
+	return nil
+}
+
+// Warnings returns the parts of a valid plan that are likely mistakes, such
+// as a candidate's percentage dropping from one step to the next.
+func (p Plan) Warnings() []string {
+	var warnings []string
+	for i := 1; i < len(p); i++ {
+		held, ok := p.held(int64(i - 1))
+		if p[i].Gate || !ok {
+			continue
+		}
+		prev, cur := held.weights(), p[i].weights()
+
+		names := make(map[string]float64)
+		for name := range prev {
+			names[name] = 0
+		}
+		for name := range cur {
+			names[name] = 0
+		}
+
+		for _, name := range sortedCandidates(names) {
+			if cur[name] < prev[name] {
+				warnings = append(warnings, fmt.Sprintf(
+					"step %d: percentage for %s drops from %g to %g",
+					i+1, name, prev[name], cur[name],
+				))
+			}
+		}
+	}
+
+	if len(p) > 0 && p.offsets() == nil {
+		warnings = append(warnings, "the largest percentages of the candidates add up to more than 100, so their cohorts move as the plan goes on")
+	}
+
+	return warnings
+}
+
+// offsets returns the first bucket of each candidate's range of cohorts.
+// Each candidate is given room for its largest percentage of the plan, in
+// order of their names, so that its cohorts only grow as its own percentage
+// grows. It returns nil if the largest percentages add up to more than 100.
+func (p Plan) offsets() map[string]int {
+	largest := make(map[string]float64)
+	for _, s := range p {
+		if s.Gate {
+			continue
+		}
+
+		for name, w := range s.weights() {
+			if w > largest[name] {
+				largest[name] = w
+			}
+		}
+	}
+
+	offsets := make(map[string]int, len(largest))
+	var next int
+	for _, name := range sortedCandidates(largest) {
+		offsets[name] = next
+		next += int(math.Round(largest[name] * bucketsPerPercent))
+	}
+
+	if next > buckets {
+		return nil
+	}
+
+	return offsets
+}
@@ -0,0 +1,129 @@
+package proxy_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-canary-router/internal/proxy"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+func TestPlan(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.Group("when parsing", func() {
+		o.Spec("it accepts durations in nanoseconds or as strings", func(t *testing.T) {
+			var plan proxy.Plan
+			err := json.Unmarshal([]byte(`[{"Percentage":10,"Duration":1000},{"Percentage":50,"Duration":"1h30m"}]`), &plan)
+			Expect(t, err).To(BeNil())
+			Expect(t, plan).To(Equal(proxy.Plan{
+				{Percentage: 10, Duration: 1000},
+				{Percentage: 50, Duration: 90 * time.Minute},
+			}))
+		})
+
+		o.Spec("it rejects invalid durations", func(t *testing.T) {
+			var plan proxy.Plan
+			err := json.Unmarshal([]byte(`[{"Percentage":10,"Duration":"5 minutes"}]`), &plan)
+			Expect(t, err).To(HaveOccurred())
+		})
+
+		o.Spec("it writes durations in nanoseconds", func(t *testing.T) {
+			data, err := json.Marshal(proxy.Plan{{Percentage: 10, Duration: time.Second}})
+			Expect(t, err).To(BeNil())
+			Expect(t, string(data)).To(Equal(`[{"Percentage":10,"Duration":1000000000}]`))
+		})
+	})
+
+	o.Group("when validating", func() {
+		o.Spec("it accepts integer and fractional percentages", func(t *testing.T) {
+			plan := proxy.Plan{
+				{Percentage: 10, Duration: time.Minute},
+				{Percentage: 0.01, Duration: time.Minute},
+				{Weights: map[string]float64{"a": 12.5, "b": 87.5}, Duration: time.Minute},
+			}
+			Expect(t, plan.Validate()).To(BeNil())
+		})
+
+		o.Spec("it rejects an empty plan", func(t *testing.T) {
+			Expect(t, proxy.Plan{}.Validate()).To(Equal(errors.New("plan has no steps")))
+		})
+
+		o.Spec("it rejects steps without a duration", func(t *testing.T) {
+			plan := proxy.Plan{{Percentage: 10}}
+			Expect(t, plan.Validate()).To(Equal(errors.New("step 1: duration must be greater than 0: 0s")))
+		})
+
+		o.Spec("it rejects percentages outside of 0 to 100", func(t *testing.T) {
+			plan := proxy.Plan{
+				{Percentage: 10, Duration: time.Minute},
+				{Weights: map[string]float64{"a": 101}, Duration: time.Minute},
+			}
+			Expect(t, plan.Validate()).To(Equal(errors.New("step 2: percentage for a must be between 0 and 100: 101")))
+		})
+
+		o.Spec("it rejects percentages finer than 0.01", func(t *testing.T) {
+			plan := proxy.Plan{{Percentage: 0.005, Duration: time.Minute}}
+			Expect(t, plan.Validate()).To(Equal(errors.New("step 1: percentage for canary must be a multiple of 0.01: 0.005")))
+		})
+
+		o.Spec("it rejects steps that add up to more than 100", func(t *testing.T) {
+			plan := proxy.Plan{{Weights: map[string]float64{"a": 60, "b": 50}, Duration: time.Minute}}
+			Expect(t, plan.Validate()).To(Equal(errors.New("step 1: percentages add up to more than 100: 110")))
+		})
+
+		o.Spec("it accepts gates without a duration", func(t *testing.T) {
+			plan := proxy.Plan{
+				{Percentage: 25, Duration: time.Minute},
+				{Gate: true},
+				{Percentage: 50, Duration: time.Minute},
+			}
+			Expect(t, plan.Validate()).To(BeNil())
+			Expect(t, plan.Warnings()).To(HaveLen(0))
+		})
+
+		o.Spec("it rejects gates with percentages of their own", func(t *testing.T) {
+			plan := proxy.Plan{{Gate: true, Percentage: 10}}
+			Expect(t, plan.Validate()).To(Equal(errors.New("step 1: a gate holds the previous step's percentages and can not set its own")))
+		})
+
+		o.Spec("it rejects a timeout action without a duration", func(t *testing.T) {
+			plan := proxy.Plan{{Gate: true, OnTimeout: proxy.GateApprove}}
+			Expect(t, plan.Validate()).To(Equal(errors.New("step 1: OnTimeout requires a duration")))
+		})
+
+		o.Spec("it rejects query settings without queries", func(t *testing.T) {
+			plan := proxy.Plan{{Percentage: 10, Duration: time.Minute, MinEvaluations: 5}}
+			Expect(t, plan.Validate()).To(Equal(errors.New("step 1: ReplaceQuery and MinEvaluations require Queries")))
+
+			plan = proxy.Plan{{Percentage: 10, Duration: time.Minute, Queries: []string{" "}}}
+			Expect(t, plan.Validate()).To(Equal(errors.New("step 1: queries must not be empty")))
+
+			plan = proxy.Plan{{Gate: true, Queries: []string{"some-query"}}}
+			Expect(t, plan.Validate()).To(Equal(errors.New("step 1: a gate can not have queries")))
+
+			plan = proxy.Plan{{Percentage: 10, Duration: time.Minute, Evaluation: &proxy.QueryEvaluation{Mode: "empty"}}}
+			Expect(t, plan.Validate()).To(Equal(errors.New("step 1: Evaluation requires Queries")))
+
+			plan = proxy.Plan{{Gate: true, Evaluation: &proxy.QueryEvaluation{Mode: "empty"}}}
+			Expect(t, plan.Validate()).To(Equal(errors.New("step 1: a gate can not have queries")))
+		})
+
+		o.Spec("it warns about percentages that drop", func(t *testing.T) {
+			plan := proxy.Plan{
+				{Weights: map[string]float64{"a": 10, "b": 10}, Duration: time.Minute},
+				{Weights: map[string]float64{"a": 20}, Duration: time.Minute},
+				{Weights: map[string]float64{"a": 20}, Duration: time.Minute},
+			}
+			Expect(t, plan.Warnings()).To(Equal([]string{
+				"step 2: percentage for b drops from 10 to 0",
+			}))
+		})
+	})
+}
@@ -3,22 +3,101 @@ package proxy
 import (
 	"crypto/tls"
 	"log"
+	"math"
 	"math/rand"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"sync/atomic"
+	"time"
 )
 
+// buckets is the number of cohorts a client can be assigned to. Each
+// percentage point of the plan covers bucketsPerPercent buckets.
+const (
+	buckets           = 10000
+	bucketsPerPercent = buckets / 100
+)
+
+// DefaultCandidate is the name of the new route given to New.
+const DefaultCandidate = "canary"
+
 type Proxy struct {
-	oldRp   *httputil.ReverseProxy
-	newRp   *httputil.ReverseProxy
-	planner Planner
-	idx     int64
+	oldRp      *httputil.ReverseProxy
+	candidates map[string]*httputil.ReverseProxy
+	planner    Planner
+	idx        int64
+
+	// step is the plan's step of the latest split. It is used for the access
+	// log of requests that do not consult the planner.
+	step int64
+
+	candidateRoutes map[string]string
+	stickyCookie    string
+	override        Override
+	key             KeyFunc
+
+	shadowConfig ShadowConfig
+	shadower     *shadower
+
+	// shadows send the copies of shadowed requests to each candidate. Unlike
+	// the candidates' reverse proxies, they are neither recorded, guarded by
+	// a breaker nor retried on the old route.
+	shadows  map[string]*httputil.ReverseProxy
+	differ   *Differ
+	fallback *fallback
+
+	breakerConfig *BreakerConfig
+	aborter       Aborter
+	breakers      map[string]*breaker
+
+	metrics   *Metrics
+	accessLog *accessLog
+}
+
+// ProxyOption configures optional behavior of a Proxy.
+type ProxyOption func(*Proxy)
+
+// WithStickySessions assigns each client to a cohort on its first request and
+// stores it in a cookie with the given name. The client is routed to the same
+// backend for as long as the planner's percentage includes its cohort.
+func WithStickySessions(cookieName string) ProxyOption {
+	return func(p *Proxy) {
+		p.stickyCookie = cookieName
+	}
+}
+
+// WithCandidate adds another new route with the given name. The planner
+// decides what percentage of requests each candidate receives.
+func WithCandidate(name, route string) ProxyOption {
+	return func(p *Proxy) {
+		p.candidateRoutes[name] = route
+	}
 }
 
 type Planner interface {
-	CurrentPercentage() int
+	CurrentSplit() Split
+}
+
+// Split is the percentage of requests each candidate (by name) receives. The
+// remaining requests are routed to the old route. Percentages are rounded to
+// whole buckets (0.01%).
+type Split struct {
+	Weights map[string]float64
+
+	// Shadow is the percentage of requests routed to the old route that are
+	// also copied to each candidate.
+	Shadow int
+
+	// Step is the index of the plan's step the split was taken from.
+	Step int
+
+	// Offsets is the first bucket of each candidate's range of cohorts. With
+	// fixed offsets, a candidate's cohorts only depend on its own weight.
+	// Without them, the ranges are laid out one after another in order of
+	// the candidates' names.
+	Offsets map[string]int
 }
 
 func New(
@@ -27,54 +106,279 @@ func New(
 	planner Planner,
 	skipSSLValidation bool,
 	log *log.Logger,
+	opts ...ProxyOption,
 ) *Proxy {
-	oldU, err := url.Parse(oldRoute)
-	if err != nil {
-		log.Fatalf("failed to parse URL (%s): %s", oldRoute, err)
+	p := &Proxy{
+		candidates: make(map[string]*httputil.ReverseProxy),
+		shadows:    make(map[string]*httputil.ReverseProxy),
+		breakers:   make(map[string]*breaker),
+		planner:    planner,
+
+		candidateRoutes: map[string]string{
+			DefaultCandidate: newRoute,
+		},
+
+		// Seed with a random values to ensure all the proxies don't blast the
+		// new route at thte same(ish) time.
+		idx:  rand.Int63(),
+		step: -1,
+
+		shadowConfig: DefaultShadowConfig(),
 	}
 
-	newU, err := url.Parse(newRoute)
-	if err != nil {
-		log.Fatalf("failed to parse URL (%s): %s", newRoute, err)
+	for _, o := range opts {
+		o(p)
 	}
 
-	oldRp := httputil.NewSingleHostReverseProxy(oldU)
-	oldRp.Transport = &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: skipSSLValidation,
-		},
+	p.shadower = newShadower(p.shadowConfig, p.differ, log)
+
+	p.oldRp = newReverseProxy(oldRoute, skipSSLValidation, log)
+	if p.metrics != nil {
+		p.oldRp.Transport = metricsTransport{
+			RoundTripper: p.oldRp.Transport,
+			m:            p.metrics,
+			backend:      CurrentBackend,
+		}
+	}
+
+	for name, route := range p.candidateRoutes {
+		rp := newReverseProxy(route, skipSSLValidation, log)
+		if p.fallback != nil {
+			p.fallback.install(rp, log)
+		}
+
+		if p.breakerConfig != nil {
+			b := newBreaker(*p.breakerConfig, name, p.aborter)
+			rp.Transport = breakerTransport{RoundTripper: rp.Transport, b: b}
+			p.breakers[name] = b
+		}
+
+		if p.metrics != nil {
+			rp.Transport = metricsTransport{
+				RoundTripper: rp.Transport,
+				m:            p.metrics,
+				backend:      name,
+			}
+		}
+
+		p.candidates[name] = rp
+		p.shadows[name] = newReverseProxy(route, skipSSLValidation, log)
 	}
 
-	newRp := httputil.NewSingleHostReverseProxy(newU)
-	newRp.Transport = &http.Transport{
+	return p
+}
+
+func newReverseProxy(route string, skipSSLValidation bool, log *log.Logger) *httputil.ReverseProxy {
+	u, err := url.Parse(route)
+	if err != nil {
+		log.Fatalf("failed to parse URL (%s): %s", route, err)
+	}
+
+	rp := httputil.NewSingleHostReverseProxy(u)
+	rp.Transport = &http.Transport{
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: skipSSLValidation,
 		},
 	}
 
-	return &Proxy{
-		oldRp:   oldRp,
-		newRp:   newRp,
-		planner: planner,
+	return rp
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.accessLog == nil || !p.accessLog.sample() {
+		p.route(w, r)
+		return
+	}
 
-		// Seed with a random values to ensure all the proxies don't blast the
-		// new route at thte same(ish) time.
-		idx: rand.Int63(),
+	e := AccessEntry{
+		RequestID: requestID(r),
+		Method:    r.Method,
+		Path:      r.URL.Path,
 	}
+
+	start := time.Now()
+	aw := &accessResponseWriter{ResponseWriter: w}
+	d := p.route(aw, r)
+
+	e.Latency = time.Since(start)
+	e.Status = aw.status
+	e.Bytes = aw.bytes
+	e.Backend = d.backend
+	e.Step = d.step
+	e.Reason = d.reason
+	p.accessLog.write(e)
 }
 
-func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	idx := atomic.AddInt64(&p.idx, 13)
+// route serves the request and returns how its backend was chosen.
+func (p *Proxy) route(w http.ResponseWriter, r *http.Request) decision {
+	candidate, overridden := p.override.check(r)
+	if _, ok := p.candidates[candidate]; overridden && candidate != "" && !ok {
+		// Unknown candidates fall back to the plan.
+		overridden = false
+	}
+
+	// The secret is only meant for the router.
+	r.Header.Del(OverrideSecretHeader)
 
 	// Host has to be cleared for the go-router. The reverse proxy does not
 	// mess with the request host.
 	r.Host = ""
 
-	// This will only return true for the percentage of the time.
-	if int(idx%100) < p.planner.CurrentPercentage() {
-		p.newRp.ServeHTTP(w, r)
+	if overridden {
+		p.serve(candidate, w, r)
+		return decision{
+			backend: backendName(candidate),
+			step:    int(atomic.LoadInt64(&p.step)),
+			reason:  ReasonOverride,
+		}
+	}
+
+	split := p.planner.CurrentSplit()
+	atomic.StoreInt64(&p.step, int64(split.Step))
+
+	cohort, sticky := p.cohort(w, r)
+	candidate = p.pick(cohort, split)
+
+	d := decision{
+		backend: backendName(candidate),
+		step:    split.Step,
+		reason:  ReasonPercentage,
+	}
+	if sticky {
+		d.reason = ReasonSticky
+	}
+
+	if rp, ok := p.candidates[candidate]; ok && p.fallback != nil {
+		if p.fallback.serve(candidate, rp, p.oldRp, w, r) {
+			d.backend = CurrentBackend
+			d.reason = ReasonFallback
+		}
+		return d
+	}
+
+	if candidate != "" || !p.shadower.sample(split.Shadow) {
+		p.serve(candidate, w, r)
+		return d
+	}
+
+	shadow, ok := p.shadower.copyRequest(r)
+	if !ok {
+		p.serve(candidate, w, r)
+		return d
+	}
+
+	p.shadower.serve(&shadow, w, func(w http.ResponseWriter) {
+		p.serve(candidate, w, r)
+	})
+
+	for name := range split.Weights {
+		if rp, ok := p.shadows[name]; ok && !p.Tripped(name) {
+			p.shadower.send(shadow, name, rp)
+		}
+	}
+
+	return d
+}
+
+// Fallbacks returns the number of requests to the given candidate that were
+// retried on the old route.
+func (p *Proxy) Fallbacks(candidate string) int64 {
+	if p.fallback == nil {
+		return 0
+	}
+
+	return p.fallback.count(candidate)
+}
+
+// serve routes the request to the given candidate. An empty or unknown
+// candidate is routed to the old route.
+func (p *Proxy) serve(candidate string, w http.ResponseWriter, r *http.Request) {
+	if rp, ok := p.candidates[candidate]; ok {
+		rp.ServeHTTP(w, r)
 		return
 	}
 
 	p.oldRp.ServeHTTP(w, r)
 }
+
+// pick returns the candidate whose range of cohorts includes the given
+// cohort. Each range starts at the candidate's offset, or where the range of
+// the previous candidate (in order of their names) ends. An empty string is
+// returned for the old route.
+func (p *Proxy) pick(cohort int, s Split) string {
+	var upper int
+	for _, name := range sortedCandidates(s.Weights) {
+		lower := upper
+		if offset, ok := s.Offsets[name]; ok {
+			lower = offset
+		}
+		upper = lower + int(math.Round(s.Weights[name]*bucketsPerPercent))
+
+		// This will only return true for the percentage of the cohorts.
+		if cohort >= lower && cohort < upper {
+			if p.Tripped(name) {
+				return ""
+			}
+
+			return name
+		}
+	}
+
+	return ""
+}
+
+// Tripped returns true if the candidate's circuit breaker has tripped.
+func (p *Proxy) Tripped(candidate string) bool {
+	b, ok := p.breakers[candidate]
+	return ok && b.Tripped()
+}
+
+// cohort returns the bucket the request falls into. If sticky sessions are
+// enabled, a client's cohort is read from (or stored in) its cookie. It
+// returns true if the cohort was read from the cookie.
+func (p *Proxy) cohort(w http.ResponseWriter, r *http.Request) (int, bool) {
+	if p.stickyCookie != "" {
+		if c, err := r.Cookie(p.stickyCookie); err == nil {
+			cohort, err := strconv.Atoi(c.Value)
+			if err == nil && cohort >= 0 && cohort < buckets {
+				return cohort, true
+			}
+		}
+	}
+
+	var cohort int
+	if key, ok := p.hashKey(r); ok {
+		cohort = hashCohort(key)
+	} else {
+		cohort = counterCohort(atomic.AddInt64(&p.idx, 13))
+	}
+
+	if p.stickyCookie != "" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     p.stickyCookie,
+			Value:    strconv.Itoa(cohort),
+			Path:     "/",
+			HttpOnly: true,
+		})
+	}
+
+	return cohort, false
+}
+
+func (p *Proxy) hashKey(r *http.Request) (string, bool) {
+	if p.key == nil {
+		return "", false
+	}
+
+	return p.key(r)
+}
+
+// counterCohort spreads the counter over the buckets. The whole percentage
+// comes from idx%100 so that every 100 requests follow the plan exactly. The
+// remaining precision is filled in by the higher digits. The counter is
+// read as unsigned so that it stays in range once it wraps around.
+func counterCohort(idx int64) int {
+	u := uint64(idx)
+
+	return int(u%100)*(buckets/100) + int((u/100)%(buckets/100))
+}
@@ -5,8 +5,10 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/poy/cf-canary-router/internal/proxy"
 	"github.com/poy/onpar"
@@ -24,6 +26,9 @@ type TP struct {
 	oldTestServer *httptest.Server
 	newTestServer *httptest.Server
 
+	otherSpyServer  *spyServer
+	otherTestServer *httptest.Server
+
 	spyPlanner *spyPlanner
 }
 
@@ -104,6 +109,293 @@ func TestProxy(t *testing.T) {
 		Expect(t, r.Host).To(Equal(t.newTestServer.URL[7:]))
 	})
 
+	o.Group("with sticky sessions", func() {
+		o.BeforeEach(func(t TP) TP {
+			t.p = proxy.New(
+				t.oldTestServer.URL,
+				t.newTestServer.URL,
+				t.spyPlanner,
+				true,
+				log.New(ioutil.Discard, "", 0),
+				proxy.WithStickySessions("some-cookie"),
+			)
+			return t
+		})
+
+		o.Spec("it assigns a cohort to new clients", func(t TP) {
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequest("GET", "http://some.url", nil)
+			Expect(t, err).To(BeNil())
+
+			t.p.ServeHTTP(recorder, req)
+
+			cookies := (&http.Response{Header: recorder.Header()}).Cookies()
+			Expect(t, cookies).To(HaveLen(1))
+			Expect(t, cookies[0].Name).To(Equal("some-cookie"))
+		})
+
+		o.Spec("it routes a client by its cohort", func(t TP) {
+			t.spyPlanner.percentage = 5
+
+			for i := 0; i < 10; i++ {
+				recorder := httptest.NewRecorder()
+				req, err := http.NewRequest("GET", "http://some.url", nil)
+				Expect(t, err).To(BeNil())
+				req.AddCookie(&http.Cookie{Name: "some-cookie", Value: "499"})
+
+				t.p.ServeHTTP(recorder, req)
+				Expect(t, recorder.Header().Get("Set-Cookie")).To(Equal(""))
+			}
+
+			Expect(t, len(t.newSpyServer.requests)).To(Equal(10))
+
+			t.spyPlanner.percentage = 4
+
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequest("GET", "http://some.url", nil)
+			Expect(t, err).To(BeNil())
+			req.AddCookie(&http.Cookie{Name: "some-cookie", Value: "499"})
+
+			t.p.ServeHTTP(recorder, req)
+			Expect(t, len(t.oldSpyServer.requests)).To(Equal(1))
+		})
+
+		o.Spec("it reassigns clients with an invalid cohort", func(t TP) {
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequest("GET", "http://some.url", nil)
+			Expect(t, err).To(BeNil())
+			req.AddCookie(&http.Cookie{Name: "some-cookie", Value: "invalid"})
+
+			t.p.ServeHTTP(recorder, req)
+			Expect(t, recorder.Header().Get("Set-Cookie")).To(Not(Equal("")))
+		})
+	})
+
+	o.Group("with overrides", func() {
+		o.BeforeEach(func(t TP) TP {
+			t.p = proxy.New(
+				t.oldTestServer.URL,
+				t.newTestServer.URL,
+				t.spyPlanner,
+				true,
+				log.New(ioutil.Discard, "", 0),
+				proxy.WithOverride(proxy.Override{
+					Header:     "X-Canary",
+					QueryParam: "canary",
+				}),
+			)
+			return t
+		})
+
+		o.Spec("it forces the new route via the header", func(t TP) {
+			for i := 0; i < 10; i++ {
+				recorder := httptest.NewRecorder()
+				req, err := http.NewRequest("GET", "http://some.url", nil)
+				Expect(t, err).To(BeNil())
+				req.Header.Set("X-Canary", "always")
+
+				t.p.ServeHTTP(recorder, req)
+			}
+
+			Expect(t, len(t.newSpyServer.requests)).To(Equal(10))
+		})
+
+		o.Spec("it forces the old route via the query parameter", func(t TP) {
+			t.spyPlanner.percentage = 100
+
+			for i := 0; i < 10; i++ {
+				recorder := httptest.NewRecorder()
+				req, err := http.NewRequest("GET", "http://some.url?canary=0", nil)
+				Expect(t, err).To(BeNil())
+
+				t.p.ServeHTTP(recorder, req)
+			}
+
+			Expect(t, len(t.oldSpyServer.requests)).To(Equal(10))
+		})
+
+		o.Spec("it follows the plan for unknown values", func(t TP) {
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequest("GET", "http://some.url", nil)
+			Expect(t, err).To(BeNil())
+			req.Header.Set("X-Canary", "sometimes")
+
+			t.p.ServeHTTP(recorder, req)
+
+			Expect(t, len(t.oldSpyServer.requests)).To(Equal(1))
+		})
+
+		o.Group("with a secret", func() {
+			o.BeforeEach(func(t TP) TP {
+				t.p = proxy.New(
+					t.oldTestServer.URL,
+					t.newTestServer.URL,
+					t.spyPlanner,
+					true,
+					log.New(ioutil.Discard, "", 0),
+					proxy.WithOverride(proxy.Override{
+						Header: "X-Canary",
+						Secret: "some-secret",
+					}),
+				)
+				return t
+			})
+
+			o.Spec("it only honors overrides with the secret", func(t TP) {
+				recorder := httptest.NewRecorder()
+				req, err := http.NewRequest("GET", "http://some.url", nil)
+				Expect(t, err).To(BeNil())
+				req.Header.Set("X-Canary", "always")
+				req.Header.Set(proxy.OverrideSecretHeader, "wrong-secret")
+
+				t.p.ServeHTTP(recorder, req)
+				Expect(t, len(t.oldSpyServer.requests)).To(Equal(1))
+
+				req, err = http.NewRequest("GET", "http://some.url", nil)
+				Expect(t, err).To(BeNil())
+				req.Header.Set("X-Canary", "always")
+				req.Header.Set(proxy.OverrideSecretHeader, "some-secret")
+
+				t.p.ServeHTTP(recorder, req)
+
+				var r *http.Request
+				Expect(t, t.newSpyServer.requests).To(Chain(Receive(), Fetch(&r)))
+				Expect(t, r.Header.Get(proxy.OverrideSecretHeader)).To(Equal(""))
+			})
+		})
+	})
+
+	o.Group("with multiple candidates", func() {
+		o.BeforeEach(func(t TP) TP {
+			t.otherSpyServer = newSpyServer()
+			t.otherTestServer = httptest.NewServer(t.otherSpyServer)
+
+			t.p = proxy.New(
+				t.oldTestServer.URL,
+				t.newTestServer.URL,
+				t.spyPlanner,
+				true,
+				log.New(ioutil.Discard, "", 0),
+				proxy.WithCandidate("other", t.otherTestServer.URL),
+				proxy.WithOverride(proxy.Override{Header: "X-Canary"}),
+			)
+			return t
+		})
+
+		o.AfterEach(func(t TP) {
+			t.otherTestServer.Close()
+		})
+
+		o.Spec("it splits the requests by weight", func(t TP) {
+			t.spyPlanner.weights = map[string]float64{
+				proxy.DefaultCandidate: 10,
+				"other":                20,
+			}
+
+			for i := 0; i < 100; i++ {
+				recorder := httptest.NewRecorder()
+				req, err := http.NewRequest("GET", "http://some.url", nil)
+				Expect(t, err).To(BeNil())
+
+				t.p.ServeHTTP(recorder, req)
+			}
+
+			Expect(t, len(t.oldSpyServer.requests)).To(Equal(70))
+			Expect(t, len(t.newSpyServer.requests)).To(Equal(10))
+			Expect(t, len(t.otherSpyServer.requests)).To(Equal(20))
+		})
+
+		o.Spec("it forces a candidate by name", func(t TP) {
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequest("GET", "http://some.url", nil)
+			Expect(t, err).To(BeNil())
+			req.Header.Set("X-Canary", "other")
+
+			t.p.ServeHTTP(recorder, req)
+
+			Expect(t, len(t.otherSpyServer.requests)).To(Equal(1))
+		})
+	})
+
+	o.Group("while shadowing", func() {
+		o.Spec("it copies requests to the candidates", func(t TP) {
+			t.spyPlanner.shadow = 100
+
+			for i := 0; i < 10; i++ {
+				recorder := httptest.NewRecorder()
+				req, err := http.NewRequest("POST", "http://some.url/some-path", strings.NewReader("some-body"))
+				Expect(t, err).To(BeNil())
+
+				t.p.ServeHTTP(recorder, req)
+			}
+
+			Expect(t, len(t.oldSpyServer.requests)).To(Equal(10))
+			Expect(t, func() int {
+				return len(t.newSpyServer.bodies)
+			}).To(ViaPolling(Equal(10)))
+
+			var body []byte
+			Expect(t, t.oldSpyServer.bodies).To(Chain(Receive(), Fetch(&body)))
+			Expect(t, string(body)).To(Equal("some-body"))
+			Expect(t, t.newSpyServer.bodies).To(Chain(Receive(), Fetch(&body)))
+			Expect(t, string(body)).To(Equal("some-body"))
+
+			var r *http.Request
+			Expect(t, t.newSpyServer.requests).To(Chain(Receive(), Fetch(&r)))
+			Expect(t, r.URL.Path).To(Equal("/some-path"))
+			Expect(t, r.Method).To(Equal("POST"))
+		})
+
+		o.Spec("it only copies the given percentage", func(t TP) {
+			t.spyPlanner.shadow = 10
+
+			for i := 0; i < 100; i++ {
+				recorder := httptest.NewRecorder()
+				req, err := http.NewRequest("GET", "http://some.url", nil)
+				Expect(t, err).To(BeNil())
+
+				t.p.ServeHTTP(recorder, req)
+			}
+
+			Expect(t, func() int {
+				return len(t.newSpyServer.requests)
+			}).To(ViaPolling(Equal(10)))
+			Expect(t, func() int {
+				return len(t.newSpyServer.requests)
+			}).To(Always(Equal(10)))
+		})
+
+		o.Spec("it does not copy large bodies", func(t TP) {
+			p := proxy.New(
+				t.oldTestServer.URL,
+				t.newTestServer.URL,
+				t.spyPlanner,
+				true,
+				log.New(ioutil.Discard, "", 0),
+				proxy.WithShadowConfig(proxy.ShadowConfig{
+					QueueSize:   10,
+					Workers:     1,
+					Timeout:     time.Second,
+					MaxBodySize: 4,
+				}),
+			)
+			t.spyPlanner.shadow = 100
+
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequest("POST", "http://some.url", strings.NewReader("some-body"))
+			Expect(t, err).To(BeNil())
+
+			p.ServeHTTP(recorder, req)
+
+			var body []byte
+			Expect(t, t.oldSpyServer.bodies).To(Chain(Receive(), Fetch(&body)))
+			Expect(t, string(body)).To(Equal("some-body"))
+			Expect(t, func() int {
+				return len(t.newSpyServer.requests)
+			}).To(Always(Equal(0)))
+		})
+	})
+
 	o.Spec("it survives the race detector", func(t TP) {
 		var wg sync.WaitGroup
 		defer wg.Wait()
@@ -150,13 +442,24 @@ func (s *spyServer) clear() {
 }
 
 type spyPlanner struct {
-	percentage int
+	percentage float64
+	weights    map[string]float64
+	shadow     int
+	step       int
 }
 
 func newSpyPlanner() *spyPlanner {
 	return &spyPlanner{}
 }
 
-func (s *spyPlanner) CurrentPercentage() int {
-	return s.percentage
+func (s *spyPlanner) CurrentSplit() proxy.Split {
+	if s.weights != nil {
+		return proxy.Split{Weights: s.weights, Shadow: s.shadow, Step: s.step}
+	}
+
+	return proxy.Split{
+		Weights: map[string]float64{proxy.DefaultCandidate: s.percentage},
+		Shadow:  s.shadow,
+		Step:    s.step,
+	}
 }
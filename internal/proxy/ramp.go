@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+)
+
+// Ramp is how a step moves from the previous step's percentages to its own.
+type Ramp string
+
+const (
+	// RampNone jumps to the step's percentages when the step starts.
+	RampNone Ramp = ""
+
+	// RampLinear raises (or lowers) the percentages by the same amount over
+	// each part of the step's duration.
+	RampLinear Ramp = "linear"
+
+	// RampExponential multiplies the percentages by the same factor over
+	// each part of the step's duration. It starts slowly, which suits
+	// candidates that are still scaling. A percentage of 0 is treated as
+	// minPercentage.
+	RampExponential Ramp = "exponential"
+)
+
+// minPercentage is the smallest share of requests the proxy can route to a
+// candidate (a single bucket).
+const minPercentage = 1.0 / bucketsPerPercent
+
+// UnmarshalText implements encoding.TextUnmarshaler so that unknown ramps
+// are rejected when a plan is parsed.
+func (r *Ramp) UnmarshalText(text []byte) error {
+	switch ramp := Ramp(text); ramp {
+	case RampNone, RampLinear, RampExponential:
+		*r = ramp
+		return nil
+	default:
+		return fmt.Errorf("unknown ramp: %s", text)
+	}
+}
+
+// at returns the percentage after the given fraction (0 to 1) of the step.
+// It is rounded to whole buckets.
+func (r Ramp) at(from, to, progress float64) float64 {
+	if progress >= 1 {
+		return to
+	}
+	progress = math.Max(progress, 0)
+
+	var p float64
+	switch r {
+	case RampLinear:
+		p = from + (to-from)*progress
+	case RampExponential:
+		from, to := math.Max(from, minPercentage), math.Max(to, minPercentage)
+		p = from * math.Pow(to/from, progress)
+	default:
+		return to
+	}
+
+	return roundPercentage(p)
+}
+
+// roundPercentage rounds the percentage to whole buckets.
+func roundPercentage(p float64) float64 {
+	return math.Round(p*bucketsPerPercent) / bucketsPerPercent
+}
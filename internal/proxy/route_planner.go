@@ -1,8 +1,12 @@
 package proxy
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
@@ -14,106 +18,1022 @@ type RoutePlanner struct {
 	// currentPlan
 	current unsafe.Pointer
 
+	// split is the Split decided on by the latest evaluation of the plan.
+	split atomic.Value
+
+	// now and tick drive the evaluation of the plan. Evaluations never
+	// overlap.
+	now    func() time.Time
+	tick   <-chan time.Time
+	evalMu sync.Mutex
+
 	w   EventWriter
 	log *log.Logger
 
-	plan      Plan
-	predicate Predicate
+	plan        Plan
+	predicate   Predicate
+	predicates  map[string]Predicate
+	queryChecks map[string]Check
+	candidates  []string
+
+	// offsets are the fixed offsets of the candidates' cohorts (see
+	// Plan.offsets). They are not used once the plan has finished.
+	offsets map[string]int
+
+	// stepQueries run the Queries of the step at stepQueriesIdx. They are
+	// only used while holding evalMu.
+	newStepQuery   func(query string, e QueryEvaluation) StepQuery
+	stepQueries    []StepQuery
+	stepQueriesIdx int64
+
+	mu sync.Mutex
+	// aborted holds the reason each candidate was aborted.
+	aborted     map[string]string
+	abortReason string
+
+	// abortReported is set once the Abort event has been written.
+	abortReported bool
+
+	// store shares the progress of the plan with other router instances.
+	// Every interaction with it happens while holding syncMu.
+	store     StateStore
+	syncTick  <-chan time.Time
+	syncMu    sync.Mutex
+	histories map[string]PredicateHistory
+
+	// restored is set once the predicates' failures have been read from the
+	// store.
+	restored bool
+
+	// over is set to 1 once Restore finds that the plan has already finished
+	// or has been aborted. The split is no longer evaluated from then on.
+	over int32
 }
 
 type currentPlan struct {
 	idx  int64
 	last time.Time
+
+	// paused is when the plan was paused. It is zero while the plan is
+	// running.
+	paused time.Time
+
+	// version is the version of the shared state this plan was read from or
+	// written as. It is only used with a StateStore.
+	version int64
 }
 
 type PlanStep struct {
-	// Percentage of requests to route to new route.
-	Percentage int
+	// Percentage of requests to route to new route. It may be a fraction
+	// down to 0.01 (e.g., 0.05 routes 1 in 2000 requests).
+	Percentage float64
+
+	// Weights is the percentage of requests to route to each candidate (by
+	// name). If it is empty, Percentage is used for the DefaultCandidate.
+	Weights map[string]float64 `json:",omitempty"`
+
+	// Shadow is the percentage of requests routed to the previous route that
+	// are also copied to the candidates. The responses of the copies are
+	// thrown away. A step with a Percentage of 0 only shadows traffic.
+	Shadow int `json:",omitempty"`
+
+	// Ramp moves the percentages from the previous step's to this step's
+	// over the Duration instead of starting the step with them. The first
+	// step ramps up from 0.
+	Ramp Ramp `json:",omitempty"`
+
+	// Gate makes the step wait for an operator to approve or reject the plan
+	// (see RoutePlanner.Approve and RoutePlanner.Reject). The percentages of
+	// the previous step are held in the meantime. A gate without a Duration
+	// waits forever, otherwise OnTimeout is taken once the Duration is up.
+	Gate      bool       `json:",omitempty"`
+	OnTimeout GateAction `json:",omitempty"`
+
+	// Queries are PromQL queries that have to succeed during the step on top
+	// of the global query. With ReplaceQuery, they are used instead of it.
+	// The step does not move on until each query has succeeded
+	// MinEvaluations times, even once its Duration is up. Evaluation decides
+	// which results of the Queries are a success.
+	Queries        []string         `json:",omitempty"`
+	ReplaceQuery   bool             `json:",omitempty"`
+	MinEvaluations int              `json:",omitempty"`
+	Evaluation     *QueryEvaluation `json:",omitempty"`
 
 	// Duration is the length of time that the step takes place before moving
 	// on to the next. If this is the last step in the plan, then the planner
-	// will recommend all the traffic go to the new route.
+	// will recommend all the traffic go to the new route. In JSON, it is
+	// either nanoseconds or a string (e.g., "1h30m").
 	Duration time.Duration
 }
 
+// String implements fmt.Stringer. Optional fields are only included when
+// they are set.
+func (s PlanStep) String() string {
+	if s.Gate {
+		fields := []string{"Gate", fmt.Sprintf("Duration:%s", s.Duration)}
+		if s.OnTimeout != "" {
+			fields = append(fields, fmt.Sprintf("OnTimeout:%s", s.OnTimeout))
+		}
+
+		return fmt.Sprintf("{%s}", strings.Join(fields, " "))
+	}
+
+	var fields []string
+	if len(s.Weights) == 0 {
+		fields = append(fields, fmt.Sprintf("Percentage:%g", s.Percentage))
+	} else {
+		names := sortedCandidates(s.Weights)
+		weights := make([]string, 0, len(names))
+		for _, name := range names {
+			weights = append(weights, fmt.Sprintf("%s:%g", name, s.Weights[name]))
+		}
+		fields = append(fields, fmt.Sprintf("Weights:[%s]", strings.Join(weights, " ")))
+	}
+
+	if s.Shadow != 0 {
+		fields = append(fields, fmt.Sprintf("Shadow:%d", s.Shadow))
+	}
+
+	if s.Ramp != RampNone {
+		fields = append(fields, fmt.Sprintf("Ramp:%s", s.Ramp))
+	}
+
+	if len(s.Queries) != 0 {
+		fields = append(fields, fmt.Sprintf("Queries:%q", s.Queries))
+	}
+
+	if s.ReplaceQuery {
+		fields = append(fields, "ReplaceQuery")
+	}
+
+	if s.MinEvaluations != 0 {
+		fields = append(fields, fmt.Sprintf("MinEvaluations:%d", s.MinEvaluations))
+	}
+
+	if s.Evaluation != nil {
+		fields = append(fields, fmt.Sprintf("Evaluation:%s", *s.Evaluation))
+	}
+
+	fields = append(fields, fmt.Sprintf("Duration:%s", s.Duration))
+
+	return fmt.Sprintf("{%s}", strings.Join(fields, " "))
+}
+
+func (s PlanStep) weights() map[string]float64 {
+	if len(s.Weights) == 0 {
+		return map[string]float64{DefaultCandidate: s.Percentage}
+	}
+
+	return s.Weights
+}
+
 type Plan []PlanStep
 
+// candidates returns the names of every candidate that is given a weight in
+// the plan.
+func (p Plan) candidates() []string {
+	names := make(map[string]float64)
+	for _, s := range p {
+		if s.Gate {
+			continue
+		}
+
+		for name := range s.weights() {
+			names[name] = 0
+		}
+	}
+
+	if len(names) == 0 {
+		return []string{DefaultCandidate}
+	}
+
+	return sortedCandidates(names)
+}
+
 type Predicate func() bool
 
+// Check is a predicate that tells why it failed. It returns nil while it
+// succeeds.
+type Check func() error
+
+// AllPredicates returns a Predicate that only succeeds while every given
+// predicate succeeds.
+func AllPredicates(ps ...Predicate) Predicate {
+	return func() bool {
+		for _, p := range ps {
+			if !p() {
+				return false
+			}
+		}
+
+		return true
+	}
+}
+
 // Codes are used to relay information from the application to the CLI about
 // what actions are being taken.
 const (
 	NextPlanStep      = 10
 	FinishedPlanSteps = 20
 	Abort             = 30
+
+	// AbortCandidate is used when a single candidate is aborted while other
+	// candidates carry on.
+	AbortCandidate = 31
+
+	// Fallback is used when a request to a candidate failed and was retried
+	// on the previous route.
+	Fallback = 40
+
+	// Paused and Resumed are used when an operator pauses or resumes the
+	// plan.
+	Paused  = 50
+	Resumed = 51
+
+	// Stopped is the last event written before the router exits. The message
+	// records the terminal state of the plan.
+	Stopped = 60
+
+	// AwaitingApproval is used when the plan reaches a gate.
+	AwaitingApproval = 70
+)
+
+// Terminal states of the plan recorded when the router stops.
+const (
+	Promoted    = "promoted"
+	Aborted     = "aborted"
+	Interrupted = "interrupted"
+)
+
+// errPredicateFailed is the reason candidates are aborted for when a
+// Predicate fails.
+var errPredicateFailed = errors.New("predicate failed")
+
+// errNotDue is returned by advance when the current step is not over yet.
+var errNotDue = errors.New("step is not over")
+
+// Errors returned when an operator's action does not apply to the plan.
+var (
+	ErrPaused    = errors.New("plan is paused")
+	ErrNotPaused = errors.New("plan is not paused")
+	ErrFinished  = errors.New("plan has finished")
+	ErrAborted   = errors.New("plan has been aborted")
 )
 
 type EventWriter interface {
 	Write(structuredlogs.Event)
 }
 
-func NewRoutePlanner(plan Plan, p Predicate, w EventWriter, log *log.Logger) *RoutePlanner {
+// RoutePlannerOption configures optional behavior of a RoutePlanner.
+type RoutePlannerOption func(*RoutePlanner)
+
+// WithCandidatePredicate sets the predicate for the given candidate. When it
+// fails, only that candidate is aborted and its traffic is directed to the
+// previous route. Candidates without their own predicate use the predicate
+// given to NewRoutePlanner.
+func WithCandidatePredicate(name string, p Predicate) RoutePlannerOption {
+	return func(r *RoutePlanner) {
+		r.predicates[name] = p
+	}
+}
+
+// WithClock replaces the wall clock. The plan is evaluated on each tick and
+// the steps are timed with now. It defaults to time.Now and a tick every
+// second. With a nil tick, the plan is only evaluated by Sync.
+func WithClock(now func() time.Time, tick <-chan time.Time) RoutePlannerOption {
+	return func(r *RoutePlanner) {
+		r.now = now
+		r.tick = tick
+	}
+}
+
+// NewRoutePlanner returns a RoutePlanner that evaluates the plan in the
+// background. The plan starts on the first tick.
+func NewRoutePlanner(plan Plan, p Predicate, w EventWriter, log *log.Logger, opts ...RoutePlannerOption) *RoutePlanner {
 	current := &currentPlan{
 		idx: -1,
 	}
 
-	return &RoutePlanner{
-		plan:      plan,
-		predicate: p,
-		w:         w,
-		log:       log,
-		current:   unsafe.Pointer(current),
+	r := &RoutePlanner{
+		plan:           plan,
+		predicate:      p,
+		predicates:     make(map[string]Predicate),
+		queryChecks:    make(map[string]Check),
+		candidates:     plan.candidates(),
+		offsets:        plan.offsets(),
+		stepQueriesIdx: -1,
+		aborted:        make(map[string]string),
+		histories:      make(map[string]PredicateHistory),
+		w:              w,
+		log:            log,
+		current:        unsafe.Pointer(current),
 	}
+
+	r.split.Store(Split{Step: -1})
+
+	for _, o := range opts {
+		o(r)
+	}
+
+	if r.now == nil {
+		r.now = time.Now
+		r.tick = time.Tick(time.Second)
+	}
+
+	if r.store != nil && r.syncTick != nil {
+		go r.runSync()
+	}
+
+	if r.tick != nil {
+		go r.run()
+	}
+
+	return r
 }
 
-func (p *RoutePlanner) CurrentPercentage() int {
-	if !p.predicate() {
-		p.w.Write(structuredlogs.Event{
-			Code:    Abort,
-			Message: "predicate failed. Directing traffic to previous route...",
-		})
-		return 0
+// CurrentPercentage returns the percentage of requests for the
+// DefaultCandidate.
+func (p *RoutePlanner) CurrentPercentage() float64 {
+	return p.CurrentSplit().Weights[DefaultCandidate]
+}
+
+// CurrentSplit returns the percentage of requests for each candidate that
+// has not been aborted. It only reads the split decided on by the latest
+// evaluation of the plan.
+func (p *RoutePlanner) CurrentSplit() Split {
+	return p.split.Load().(Split)
+}
+
+func (p *RoutePlanner) run() {
+	for range p.tick {
+		p.evaluate()
+	}
+}
+
+// evaluate runs the predicates and moves on to the next step once the
+// current step is over. Events are only written when something changes.
+func (p *RoutePlanner) evaluate() {
+	p.evalMu.Lock()
+	defer p.evalMu.Unlock()
+
+	if atomic.LoadInt32(&p.over) == 1 {
+		return
 	}
 
-	current := (*currentPlan)(atomic.LoadPointer(&p.current))
+	p.runStepQueries(*p.load())
 
-	if current.idx >= int64(len(p.plan)) {
+	if p.gateExpired(*p.load()) {
+		p.mu.Lock()
+		p.abort(p.candidates, "approval timed out")
+		p.mu.Unlock()
+		p.syncStore()
+	}
+
+	aborted, reason := p.checkCandidates()
+	if len(aborted) == len(p.candidates) {
+		p.reportAbort(reason)
+		p.split.Store(Split{Step: int(p.load().idx)})
+		return
+	}
+
+	if _, err := p.advance(*p.load()); err == nil {
+		// Another instance may have got there first.
+		if updated, err := p.update(p.advance); err == nil {
+			p.reportStep(updated)
+		}
+	}
+	p.runStepQueries(*p.load())
+
+	p.split.Store(p.splitFor(*p.load(), aborted))
+}
+
+// splitFor returns the split of the given step without the aborted
+// candidates.
+func (p *RoutePlanner) splitFor(c currentPlan, aborted map[string]bool) Split {
+	if c.idx < 0 {
+		return Split{Step: -1}
+	}
+
+	if c.idx >= int64(len(p.plan)) {
+		s := p.promote(aborted)
+		s.Step = int(c.idx)
+		return s
+	}
+
+	weights := make(map[string]float64)
+	for name, w := range p.weights(c) {
+		if !aborted[name] {
+			weights[name] = w
+		}
+	}
+
+	var shadow int
+	if step, ok := p.plan.held(c.idx); ok {
+		shadow = step.Shadow
+	}
+
+	return Split{
+		Weights: weights,
+		Shadow:  shadow,
+		Step:    int(c.idx),
+		Offsets: p.offsets,
+	}
+}
+
+// weights returns the percentages of the given step at this point of the
+// step. They only differ from the step's Weights while it ramps. A gate
+// holds the percentages of the step before it.
+func (p *RoutePlanner) weights(c currentPlan) map[string]float64 {
+	var from map[string]float64
+	if step, ok := p.plan.held(c.idx - 1); ok {
+		from = step.weights()
+	}
+
+	if p.atGate(c) {
+		weights := make(map[string]float64, len(from))
+		for name, w := range from {
+			weights[name] = w
+		}
+
+		return weights
+	}
+
+	step := p.plan[c.idx]
+
+	progress := 1.0
+	if step.Duration > 0 {
+		end := p.now()
+		if !c.paused.IsZero() {
+			end = c.paused
+		}
+		progress = float64(end.Sub(c.last)) / float64(step.Duration)
+	}
+
+	weights := make(map[string]float64)
+	for name, w := range step.weights() {
+		weights[name] = step.Ramp.at(from[name], w, progress)
+	}
+
+	return weights
+}
+
+// reportStep writes the event for the step the plan has moved on to.
+func (p *RoutePlanner) reportStep(c currentPlan) {
+	if c.idx >= int64(len(p.plan)) {
 		p.w.Write(structuredlogs.Event{
 			Code:    FinishedPlanSteps,
 			Message: "finished steps",
 		})
-		return 100
+		return
+	}
+
+	if p.atGate(c) {
+		p.reportGate(c)
+		return
+	}
+
+	p.w.Write(structuredlogs.Event{
+		Code:    NextPlanStep,
+		Message: fmt.Sprintf("starting next step: %+v", p.plan[c.idx]),
+	})
+}
+
+// reportAbort writes the Abort event the first time every candidate has
+// been aborted.
+func (p *RoutePlanner) reportAbort(reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.abortReported {
+		return
+	}
+	p.abortReported = true
+
+	p.w.Write(structuredlogs.Event{
+		Code:    Abort,
+		Message: fmt.Sprintf("%s. Directing traffic to previous route...", reason),
+	})
+}
+
+func (p *RoutePlanner) load() *currentPlan {
+	return (*currentPlan)(atomic.LoadPointer(&p.current))
+}
+
+// Status is a snapshot of the progress of a RoutePlanner.
+type Status struct {
+	// Step is the index of the current step. It is -1 before the plan has
+	// started and the number of steps once the plan has finished.
+	Step  int
+	Steps int
+
+	// StepStarted is when the current step started. It is zero before the
+	// plan has started.
+	StepStarted time.Time
+
+	// Weights is the percentage of requests for each candidate that has not
+	// been aborted.
+	Weights map[string]float64
+
+	// Aborted holds the reason each aborted candidate was aborted.
+	Aborted map[string]string
+
+	Paused bool
+
+	// PausedAt is when the plan was paused. It is zero while the plan is
+	// running.
+	PausedAt time.Time `json:",omitempty"`
+
+	// AwaitingApproval is set while the plan waits at a gate.
+	AwaitingApproval bool
+}
+
+// Status returns the progress of the plan. Like CurrentSplit, it does not
+// run the predicates or move on to the next step.
+func (p *RoutePlanner) Status() Status {
+	current := (*currentPlan)(atomic.LoadPointer(&p.current))
+
+	p.mu.Lock()
+	aborted := make(map[string]bool, len(p.aborted))
+	reasons := make(map[string]string, len(p.aborted))
+	for name, reason := range p.aborted {
+		aborted[name] = true
+		reasons[name] = reason
 	}
+	p.mu.Unlock()
 
-	if current.last.IsZero() || time.Since(current.last) >= p.plan[current.idx].Duration {
-		updated := &currentPlan{
-			last: time.Now(),
-			idx:  current.idx + 1,
+	s := Status{
+		Step:        int(current.idx),
+		Steps:       len(p.plan),
+		StepStarted: current.last,
+		Weights:     make(map[string]float64),
+		Aborted:     reasons,
+		Paused:      !current.paused.IsZero(),
+		PausedAt:    current.paused,
+
+		AwaitingApproval: p.atGate(*current),
+	}
+
+	if len(aborted) < len(p.candidates) && current.idx >= 0 {
+		s.Weights = p.splitFor(*current, aborted).Weights
+	}
+
+	return s
+}
+
+// Abort aborts the given candidate. Its traffic is directed to the previous
+// route. If every candidate has been aborted, the whole plan is aborted.
+func (p *RoutePlanner) Abort(candidate, reason string) {
+	if atomic.LoadInt32(&p.over) == 1 {
+		return
+	}
+
+	p.mu.Lock()
+	aborted := p.abort([]string{candidate}, reason)
+	p.mu.Unlock()
+
+	if len(aborted) > 0 {
+		p.syncStore()
+		p.evaluate()
+	}
+}
+
+// AbortPlan aborts every candidate. All the traffic is directed to the
+// previous route.
+func (p *RoutePlanner) AbortPlan(reason string) {
+	if atomic.LoadInt32(&p.over) == 1 {
+		return
+	}
+
+	p.mu.Lock()
+	if p.allAborted() {
+		p.mu.Unlock()
+		return
+	}
+
+	p.abort(p.candidates, reason)
+	p.w.Write(structuredlogs.Event{
+		Code:    Abort,
+		Message: fmt.Sprintf("%s. Directing traffic to previous route...", reason),
+	})
+	p.abortReported = true
+	p.mu.Unlock()
+
+	p.syncStore()
+	p.evaluate()
+}
+
+// Pause stops the plan from moving on to the next step. The current split
+// is kept until the plan is resumed.
+func (p *RoutePlanner) Pause() error {
+	if err := p.checkAborted(); err != nil {
+		return err
+	}
+
+	c, err := p.update(func(c currentPlan) (currentPlan, error) {
+		if c.idx >= int64(len(p.plan)) {
+			return c, ErrFinished
+		}
+
+		if !c.paused.IsZero() {
+			return c, ErrPaused
+		}
+
+		c.paused = p.now()
+		return c, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	p.w.Write(structuredlogs.Event{
+		Code:    Paused,
+		Message: fmt.Sprintf("paused plan at step %d of %d", c.idx+1, len(p.plan)),
+	})
+	p.evaluate()
+
+	return nil
+}
+
+// Resume continues a paused plan. The time spent paused does not count
+// towards the current step.
+func (p *RoutePlanner) Resume() error {
+	if err := p.checkAborted(); err != nil {
+		return err
+	}
+
+	c, err := p.update(func(c currentPlan) (currentPlan, error) {
+		if c.paused.IsZero() {
+			return c, ErrNotPaused
+		}
+
+		if !c.last.IsZero() {
+			c.last = c.last.Add(p.now().Sub(c.paused))
+		}
+		c.paused = time.Time{}
+
+		return c, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	p.w.Write(structuredlogs.Event{
+		Code:    Resumed,
+		Message: fmt.Sprintf("resumed plan at step %d of %d", c.idx+1, len(p.plan)),
+	})
+	p.evaluate()
+
+	return nil
+}
+
+// Promote skips the remaining steps. The remaining candidates are given all
+// the traffic.
+func (p *RoutePlanner) Promote() error {
+	if err := p.checkAborted(); err != nil {
+		return err
+	}
+
+	_, err := p.update(func(c currentPlan) (currentPlan, error) {
+		if c.idx >= int64(len(p.plan)) {
+			return c, ErrFinished
+		}
+
+		return currentPlan{
+			idx:  int64(len(p.plan)),
+			last: p.now(),
+		}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	p.w.Write(structuredlogs.Event{
+		Code:    FinishedPlanSteps,
+		Message: "promoted by operator",
+	})
+	p.evaluate()
+
+	return nil
+}
+
+// NextStep moves on to the next step without waiting for the current step's
+// duration. A paused plan stays paused.
+func (p *RoutePlanner) NextStep() error {
+	if err := p.checkAborted(); err != nil {
+		return err
+	}
+
+	c, err := p.update(func(c currentPlan) (currentPlan, error) {
+		if c.idx >= int64(len(p.plan)) {
+			return c, ErrFinished
+		}
+
+		now := p.now()
+		updated := currentPlan{
+			idx:  c.idx + 1,
+			last: now,
+		}
+		if !c.paused.IsZero() {
+			updated.paused = now
 		}
 
-		if !atomic.CompareAndSwapPointer(
+		return updated, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	p.reportStep(c)
+	p.evaluate()
+
+	return nil
+}
+
+// Stop writes the final event of the plan and returns its terminal state.
+// The plan is interrupted if it has neither been promoted nor aborted.
+func (p *RoutePlanner) Stop() string {
+	state := Interrupted
+	switch {
+	case p.checkAborted() != nil:
+		state = Aborted
+	case p.load().idx >= int64(len(p.plan)):
+		state = Promoted
+	}
+
+	p.w.Write(structuredlogs.Event{
+		Code:    Stopped,
+		Message: fmt.Sprintf("router stopped: %s", state),
+	})
+
+	return state
+}
+
+// advance moves on to the next step once the current step's duration is
+// up and its Queries have succeeded often enough. It returns errNotDue
+// otherwise.
+func (p *RoutePlanner) advance(c currentPlan) (currentPlan, error) {
+	if !c.paused.IsZero() || c.idx >= int64(len(p.plan)) {
+		return c, errNotDue
+	}
+
+	if !c.last.IsZero() && p.now().Sub(c.last) < p.plan[c.idx].Duration {
+		return c, errNotDue
+	}
+
+	if !p.evaluated(c.idx) {
+		return c, errNotDue
+	}
+
+	// Gates only move on by themselves if they approve once they are up.
+	if p.atGate(c) && (p.plan[c.idx].Duration == 0 || p.plan[c.idx].OnTimeout != GateApprove) {
+		return c, errNotDue
+	}
+
+	return currentPlan{
+		last: p.now(),
+		idx:  c.idx + 1,
+	}, nil
+}
+
+// update atomically replaces the current plan with the result of f. If f
+// returns an error, the current plan is left alone. With a StateStore, the
+// result is written to the store first so every instance agrees on it.
+func (p *RoutePlanner) update(f func(currentPlan) (currentPlan, error)) (currentPlan, error) {
+	if p.store == nil {
+		return p.updateLocal(f)
+	}
+
+	p.syncMu.Lock()
+	defer p.syncMu.Unlock()
+
+	// The evaluation and the operator may both try to move on. Only the first
+	// one has to go to the store.
+	current := (*currentPlan)(atomic.LoadPointer(&p.current))
+	if _, err := f(*current); err == errNotDue {
+		return *current, err
+	}
+
+	for {
+		if err := p.sync(); err != nil {
+			p.log.Printf("failed to sync plan state: %s", err)
+			return p.updateLocal(f)
+		}
+
+		current := (*currentPlan)(atomic.LoadPointer(&p.current))
+		updated, err := f(*current)
+		if err != nil {
+			return *current, err
+		}
+		updated.version = current.version + 1
+
+		ok, err := p.store.CompareAndSwap(current.version, p.state(updated))
+		if err != nil {
+			p.log.Printf("failed to store plan state: %s", err)
+			return p.updateLocal(f)
+		}
+
+		if ok {
+			atomic.StorePointer(&p.current, unsafe.Pointer(&updated))
+			return updated, nil
+		}
+	}
+}
+
+// updateLocal replaces the current plan without consulting the store.
+func (p *RoutePlanner) updateLocal(f func(currentPlan) (currentPlan, error)) (currentPlan, error) {
+	for {
+		current := (*currentPlan)(atomic.LoadPointer(&p.current))
+
+		updated, err := f(*current)
+		if err != nil {
+			return *current, err
+		}
+		updated.version = current.version
+
+		if atomic.CompareAndSwapPointer(
 			&p.current,
 			unsafe.Pointer(current),
-			unsafe.Pointer(updated),
+			unsafe.Pointer(&updated),
 		) {
-			return p.CurrentPercentage()
+			return updated, nil
 		}
-		current = updated
+	}
+}
+
+func (p *RoutePlanner) checkAborted() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-		if current.idx >= int64(len(p.plan)) {
-			p.w.Write(structuredlogs.Event{
-				Code:    FinishedPlanSteps,
-				Message: "finished steps",
-			})
-			return p.CurrentPercentage()
+	if p.allAborted() {
+		return ErrAborted
+	}
+
+	return nil
+}
+
+// allAborted has to be called while holding the lock.
+func (p *RoutePlanner) allAborted() bool {
+	return len(p.aborted) == len(p.candidates)
+}
+
+// abort has to be called while holding the lock. It returns the candidates
+// that were not aborted before.
+func (p *RoutePlanner) abort(candidates []string, reason string) []string {
+	var aborted []string
+	for _, c := range candidates {
+		if _, ok := p.aborted[c]; ok || !p.isCandidate(c) {
+			continue
 		}
 
+		p.aborted[c] = reason
+		p.abortReason = reason
+		aborted = append(aborted, c)
+	}
+
+	// If every candidate has been aborted, CurrentSplit reports it.
+	if p.allAborted() {
+		return aborted
+	}
+
+	for _, candidate := range aborted {
 		p.w.Write(structuredlogs.Event{
-			Code:    NextPlanStep,
-			Message: fmt.Sprintf("starting next step: %+v", p.plan[current.idx]),
+			Code:    AbortCandidate,
+			Message: fmt.Sprintf("%s for %s. Directing its traffic to previous route...", reason, candidate),
 		})
-		return p.CurrentPercentage()
 	}
 
-	return p.plan[current.idx].Percentage
+	return aborted
+}
+
+func (p *RoutePlanner) isCandidate(name string) bool {
+	for _, c := range p.candidates {
+		if c == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkCandidates runs each candidate's predicate and the current step's
+// Queries and returns every candidate that has been aborted along with the
+// latest reason. Once a candidate is aborted, it stays aborted.
+func (p *RoutePlanner) checkCandidates() (map[string]bool, string) {
+	idx := p.load().idx
+
+	// failed holds the candidates that failed by the reason they failed for.
+	failed := make(map[string][]string)
+	for _, name := range p.candidates {
+		predicate, ok := p.predicates[name]
+		if !ok {
+			predicate = p.predicate
+		}
+
+		if !predicate() {
+			failed[errPredicateFailed.Error()] = append(failed[errPredicateFailed.Error()], name)
+			continue
+		}
+
+		query, ok := p.queryChecks[name]
+		if !ok || p.replacesQuery(idx) {
+			continue
+		}
+
+		if err := query(); err != nil {
+			failed[err.Error()] = append(failed[err.Error()], name)
+		}
+	}
+
+	reasons := make([]string, 0, len(failed))
+	for reason := range failed {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	stepFailure := p.stepQueryFailure()
+
+	p.mu.Lock()
+	var newlyAborted []string
+	for _, reason := range reasons {
+		newlyAborted = append(newlyAborted, p.abort(failed[reason], reason)...)
+	}
+	if stepFailure != "" {
+		newlyAborted = append(newlyAborted, p.abort(p.candidates, stepFailure)...)
+	}
+
+	aborted := make(map[string]bool, len(p.aborted))
+	for name := range p.aborted {
+		aborted[name] = true
+	}
+	reason := p.abortReason
+	p.mu.Unlock()
+
+	if len(newlyAborted) > 0 {
+		p.syncStore()
+	}
+
+	return aborted, reason
+}
+
+// promote splits all the traffic between the remaining candidates. The
+// candidates keep their relative weights from the last step.
+func (p *RoutePlanner) promote(aborted map[string]bool) Split {
+	var last map[string]float64
+	if step, ok := p.plan.held(int64(len(p.plan))); ok {
+		last = step.weights()
+	}
+
+	var (
+		remaining []string
+		total     float64
+	)
+	for _, name := range p.candidates {
+		if aborted[name] {
+			continue
+		}
+		remaining = append(remaining, name)
+		total += last[name]
+	}
+
+	// The split is worked out in buckets so that rounding leftovers can go to
+	// the first candidate.
+	shares := make(map[string]int, len(remaining))
+	left := buckets
+	for _, name := range remaining {
+		share := buckets / len(remaining)
+		if total > 0 {
+			share = int(buckets * last[name] / total)
+		}
+		shares[name] = share
+		left -= share
+	}
+	shares[remaining[0]] += left
+
+	weights := make(map[string]float64, len(shares))
+	for name, share := range shares {
+		weights[name] = float64(share) / bucketsPerPercent
+	}
+
+	return Split{Weights: weights}
+}
+
+func sortedNames(m map[string]int) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// sortedCandidates returns the names of the candidates of a split in order.
+func sortedCandidates(weights map[string]float64) []string {
+	names := make([]string, 0, len(weights))
+	for name := range weights {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
 }
@@ -1,8 +1,11 @@
 package proxy_test
 
 import (
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"log"
+	"sync"
 	"testing"
 	"time"
 
@@ -18,6 +21,9 @@ type TR struct {
 	p              *proxy.RoutePlanner
 	spyEventWriter *spyEventWriter
 	spyPredicate   *spyPredicate
+	clock          *stubClock
+
+	otherSpyPredicate *spyPredicate
 }
 
 func TestPlanner(t *testing.T) {
@@ -35,36 +41,42 @@ func TestPlanner(t *testing.T) {
 		spyPredicate.result = true
 
 		spyEventWriter := newSpyEventWriter()
+		clock := newStubClock()
 
 		return TR{
 			T:              t,
 			spyPredicate:   spyPredicate,
 			spyEventWriter: spyEventWriter,
+			clock:          clock,
 			p: proxy.NewRoutePlanner(
 				plan,
 				spyPredicate.Predicate,
 				spyEventWriter,
 				log.New(ioutil.Discard, "", 0),
+				proxy.WithClock(clock.Now, nil),
 			),
 		}
 	})
 
 	o.Spec("it returns the plan over time", func(t TR) {
-		for i := 0; i < 100; i++ {
-			Expect(t, t.p.CurrentPercentage()).To(Equal(5))
-		}
+		Expect(t, t.p.CurrentPercentage()).To(Equal(0.0))
 
-		time.Sleep(100 * time.Millisecond)
+		t.p.Sync()
+		Expect(t, t.p.CurrentPercentage()).To(Equal(5.0))
 
-		for i := 0; i < 100; i++ {
-			Expect(t, t.p.CurrentPercentage()).To(Equal(10))
-		}
+		t.clock.Add(50 * time.Millisecond)
+		t.p.Sync()
+		Expect(t, t.p.CurrentPercentage()).To(Equal(5.0))
 
-		time.Sleep(100 * time.Millisecond)
+		t.clock.Add(50 * time.Millisecond)
+		t.p.Sync()
+		Expect(t, t.p.CurrentPercentage()).To(Equal(10.0))
 
-		for i := 0; i < 100; i++ {
-			Expect(t, t.p.CurrentPercentage()).To(Equal(100))
-		}
+		t.clock.Add(100 * time.Millisecond)
+		t.p.Sync()
+		t.p.Sync()
+		Expect(t, t.p.CurrentPercentage()).To(Equal(100.0))
+		Expect(t, t.spyEventWriter.events).To(HaveLen(3))
 
 		Expect(t, t.spyEventWriter.events).To(Contain(structuredlogs.Event{
 			Code:    proxy.NextPlanStep,
@@ -77,20 +89,620 @@ func TestPlanner(t *testing.T) {
 		}))
 	})
 
+	o.Spec("it moves on without any requests", func(t TR) {
+		tick := make(chan time.Time)
+		t.p = proxy.NewRoutePlanner(
+			proxy.Plan{{Percentage: 5, Duration: time.Minute}},
+			t.spyPredicate.Predicate,
+			t.spyEventWriter,
+			log.New(ioutil.Discard, "", 0),
+			proxy.WithClock(t.clock.Now, tick),
+		)
+
+		tick <- t.clock.Now()
+		Expect(t, t.p.CurrentPercentage).To(ViaPolling(Equal(5.0)))
+
+		t.clock.Add(time.Minute)
+		tick <- t.clock.Now()
+		Expect(t, t.p.CurrentPercentage).To(ViaPolling(Equal(100.0)))
+		Expect(t, t.spyEventWriter.events).To(Contain(structuredlogs.Event{
+			Code:    proxy.FinishedPlanSteps,
+			Message: "finished steps",
+		}))
+	})
+
 	o.Spec("it aborts and returns 0 if the predicate fails", func(t TR) {
 		t.spyPredicate.result = false
-		for i := 0; i < 100; i++ {
-			Expect(t, t.p.CurrentPercentage()).To(Equal(0))
+		for i := 0; i < 10; i++ {
+			t.p.Sync()
+			Expect(t, t.p.CurrentPercentage()).To(Equal(0.0))
 		}
 
-		Expect(t, t.spyEventWriter.events).To(HaveLen(100))
+		Expect(t, t.spyEventWriter.events).To(HaveLen(1))
 		Expect(t, t.spyEventWriter.events[0].Code).To(Equal(proxy.Abort))
 	})
 
+	o.Spec("it aborts with the error of a failed query check", func(t TR) {
+		t.p = proxy.NewRoutePlanner(
+			proxy.Plan{{Percentage: 5, Duration: time.Minute}},
+			t.spyPredicate.Predicate,
+			t.spyEventWriter,
+			log.New(ioutil.Discard, "", 0),
+			proxy.WithClock(t.clock.Now, nil),
+			proxy.WithQueryCheck(proxy.DefaultCandidate, func() error {
+				return errors.New("query errors failed")
+			}),
+		)
+
+		t.p.Sync()
+		Expect(t, t.p.CurrentPercentage()).To(Equal(0.0))
+		Expect(t, t.spyEventWriter.events).To(Equal([]structuredlogs.Event{{
+			Code:    proxy.Abort,
+			Message: "query errors failed. Directing traffic to previous route...",
+		}}))
+	})
+
+	o.Spec("it aborts when told to", func(t TR) {
+		t.p.Abort(proxy.DefaultCandidate, "some-reason")
+		t.p.Abort(proxy.DefaultCandidate, "other-reason")
+
+		Expect(t, t.p.CurrentPercentage()).To(Equal(0.0))
+		Expect(t, t.spyEventWriter.events).To(Equal([]structuredlogs.Event{{
+			Code:    proxy.Abort,
+			Message: "some-reason. Directing traffic to previous route...",
+		}}))
+	})
+
+	o.Spec("it reports its status without moving on", func(t TR) {
+		s := t.p.Status()
+		Expect(t, s.Step).To(Equal(-1))
+		Expect(t, s.Steps).To(Equal(2))
+		Expect(t, s.StepStarted.IsZero()).To(BeTrue())
+		Expect(t, s.Weights).To(HaveLen(0))
+		Expect(t, t.spyEventWriter.events).To(HaveLen(0))
+
+		t.p.Sync()
+		s = t.p.Status()
+		Expect(t, s.Step).To(Equal(0))
+		Expect(t, s.StepStarted.IsZero()).To(BeFalse())
+		Expect(t, s.Weights).To(Equal(map[string]float64{proxy.DefaultCandidate: 5}))
+
+		t.p.Abort(proxy.DefaultCandidate, "some-reason")
+		s = t.p.Status()
+		Expect(t, s.Weights).To(HaveLen(0))
+		Expect(t, s.Aborted).To(Equal(map[string]string{proxy.DefaultCandidate: "some-reason"}))
+	})
+
+	o.Spec("it shadows traffic", func(t TR) {
+		t.p = proxy.NewRoutePlanner(
+			proxy.Plan{
+				{Shadow: 50, Duration: 100 * time.Millisecond},
+				{Percentage: 10, Duration: 100 * time.Millisecond},
+			},
+			t.spyPredicate.Predicate,
+			t.spyEventWriter,
+			log.New(ioutil.Discard, "", 0),
+			proxy.WithClock(t.clock.Now, nil),
+		)
+
+		t.p.Sync()
+		Expect(t, t.p.CurrentSplit()).To(Equal(proxy.Split{
+			Weights: map[string]float64{proxy.DefaultCandidate: 0},
+			Shadow:  50,
+			Offsets: map[string]int{proxy.DefaultCandidate: 0},
+		}))
+
+		Expect(t, t.spyEventWriter.events).To(Contain(structuredlogs.Event{
+			Code:    proxy.NextPlanStep,
+			Message: "starting next step: {Percentage:0 Shadow:50 Duration:100ms}",
+		}))
+
+		t.clock.Add(100 * time.Millisecond)
+		t.p.Sync()
+		Expect(t, t.p.CurrentSplit()).To(Equal(proxy.Split{
+			Weights: map[string]float64{proxy.DefaultCandidate: 10},
+			Step:    1,
+			Offsets: map[string]int{proxy.DefaultCandidate: 0},
+		}))
+	})
+
+	o.Spec("it routes fractions of a percent", func(t TR) {
+		t.p = proxy.NewRoutePlanner(
+			proxy.Plan{{Percentage: 0.05, Duration: 100 * time.Millisecond}},
+			t.spyPredicate.Predicate,
+			t.spyEventWriter,
+			log.New(ioutil.Discard, "", 0),
+			proxy.WithClock(t.clock.Now, nil),
+		)
+
+		t.p.Sync()
+		Expect(t, t.p.CurrentPercentage()).To(Equal(0.05))
+		Expect(t, t.spyEventWriter.events).To(Contain(structuredlogs.Event{
+			Code:    proxy.NextPlanStep,
+			Message: "starting next step: {Percentage:0.05 Duration:100ms}",
+		}))
+	})
+
+	o.Group("with ramps", func() {
+		o.Spec("it ramps linearly from the previous step", func(t TR) {
+			t.p = proxy.NewRoutePlanner(
+				proxy.Plan{
+					{Percentage: 10, Duration: 100 * time.Millisecond},
+					{Percentage: 50, Ramp: proxy.RampLinear, Duration: 100 * time.Millisecond},
+				},
+				t.spyPredicate.Predicate,
+				t.spyEventWriter,
+				log.New(ioutil.Discard, "", 0),
+				proxy.WithClock(t.clock.Now, nil),
+			)
+
+			t.p.Sync()
+			t.clock.Add(100 * time.Millisecond)
+			t.p.Sync()
+			Expect(t, t.p.CurrentPercentage()).To(Equal(10.0))
+
+			t.clock.Add(25 * time.Millisecond)
+			t.p.Sync()
+			Expect(t, t.p.CurrentPercentage()).To(Equal(20.0))
+			Expect(t, t.p.Status().Weights).To(Equal(map[string]float64{proxy.DefaultCandidate: 20}))
+
+			// The ramp holds while paused.
+			Expect(t, t.p.Pause()).To(BeNil())
+			t.clock.Add(time.Minute)
+			t.p.Sync()
+			Expect(t, t.p.CurrentPercentage()).To(Equal(20.0))
+
+			Expect(t, t.p.Resume()).To(BeNil())
+			t.clock.Add(50 * time.Millisecond)
+			t.p.Sync()
+			Expect(t, t.p.CurrentPercentage()).To(Equal(40.0))
+
+			Expect(t, t.spyEventWriter.events).To(Contain(structuredlogs.Event{
+				Code:    proxy.NextPlanStep,
+				Message: "starting next step: {Percentage:50 Ramp:linear Duration:100ms}",
+			}))
+		})
+
+		o.Spec("it ramps exponentially from a fraction of a percent", func(t TR) {
+			t.p = proxy.NewRoutePlanner(
+				proxy.Plan{
+					{Percentage: 1, Ramp: proxy.RampExponential, Duration: 100 * time.Millisecond},
+				},
+				t.spyPredicate.Predicate,
+				t.spyEventWriter,
+				log.New(ioutil.Discard, "", 0),
+				proxy.WithClock(t.clock.Now, nil),
+			)
+
+			t.p.Sync()
+			Expect(t, t.p.CurrentPercentage()).To(Equal(0.01))
+
+			t.clock.Add(50 * time.Millisecond)
+			t.p.Sync()
+			Expect(t, t.p.CurrentPercentage()).To(Equal(0.1))
+
+			t.clock.Add(25 * time.Millisecond)
+			t.p.Sync()
+			Expect(t, t.p.CurrentPercentage()).To(Equal(0.32))
+		})
+
+		o.Spec("it rejects unknown ramps", func(t TR) {
+			var plan proxy.Plan
+			err := json.Unmarshal([]byte(`[{"Percentage":10,"Ramp":"sideways"}]`), &plan)
+			Expect(t, err).To(HaveOccurred())
+		})
+	})
+
+	o.Group("with a gate", func() {
+		newGatedPlanner := func(t TR, gate proxy.PlanStep) *proxy.RoutePlanner {
+			gate.Gate = true
+			p := proxy.NewRoutePlanner(
+				proxy.Plan{
+					{Percentage: 25, Duration: 100 * time.Millisecond},
+					gate,
+					{Percentage: 50, Duration: 100 * time.Millisecond},
+				},
+				t.spyPredicate.Predicate,
+				t.spyEventWriter,
+				log.New(ioutil.Discard, "", 0),
+				proxy.WithClock(t.clock.Now, nil),
+			)
+
+			p.Sync()
+			t.clock.Add(100 * time.Millisecond)
+			p.Sync()
+
+			return p
+		}
+
+		o.Spec("it holds the previous percentage until approved", func(t TR) {
+			t.p = newGatedPlanner(t, proxy.PlanStep{})
+			Expect(t, t.p.CurrentPercentage()).To(Equal(25.0))
+			Expect(t, t.p.Status().AwaitingApproval).To(BeTrue())
+			Expect(t, t.spyEventWriter.events).To(Contain(structuredlogs.Event{
+				Code:    proxy.AwaitingApproval,
+				Message: "waiting for approval at step 2 of 3",
+			}))
+
+			t.clock.Add(time.Hour)
+			t.p.Sync()
+			Expect(t, t.p.CurrentPercentage()).To(Equal(25.0))
+
+			Expect(t, t.p.Approve()).To(BeNil())
+			Expect(t, t.p.CurrentPercentage()).To(Equal(50.0))
+			Expect(t, t.p.Status().AwaitingApproval).To(BeFalse())
+			Expect(t, t.p.Approve()).To(Equal(proxy.ErrNoGate))
+		})
+
+		o.Spec("it aborts when rejected", func(t TR) {
+			Expect(t, t.p.Reject("some-reason")).To(Equal(proxy.ErrNoGate))
+
+			t.p = newGatedPlanner(t, proxy.PlanStep{})
+			Expect(t, t.p.Reject("some-reason")).To(BeNil())
+			Expect(t, t.p.CurrentPercentage()).To(Equal(0.0))
+			Expect(t, t.spyEventWriter.events).To(Contain(structuredlogs.Event{
+				Code:    proxy.Abort,
+				Message: "some-reason. Directing traffic to previous route...",
+			}))
+		})
+
+		o.Spec("it approves once the gate times out", func(t TR) {
+			t.p = newGatedPlanner(t, proxy.PlanStep{Duration: time.Minute, OnTimeout: proxy.GateApprove})
+			Expect(t, t.spyEventWriter.events).To(Contain(structuredlogs.Event{
+				Code:    proxy.AwaitingApproval,
+				Message: "waiting for approval at step 2 of 3 (approves in 1m0s)",
+			}))
+
+			t.clock.Add(time.Minute)
+			t.p.Sync()
+			Expect(t, t.p.CurrentPercentage()).To(Equal(50.0))
+		})
+
+		o.Spec("it rejects once the gate times out", func(t TR) {
+			t.p = newGatedPlanner(t, proxy.PlanStep{Duration: time.Minute})
+
+			t.clock.Add(time.Minute)
+			t.p.Sync()
+			Expect(t, t.p.CurrentPercentage()).To(Equal(0.0))
+			Expect(t, t.spyEventWriter.events).To(Contain(structuredlogs.Event{
+				Code:    proxy.Abort,
+				Message: "approval timed out. Directing traffic to previous route...",
+			}))
+		})
+	})
+
+	o.Group("with step queries", func() {
+		var (
+			queryPredicate *spyPredicate
+			queries        map[string]*spyStepQuery
+		)
+
+		newQueriedPlanner := func(t TR, plan proxy.Plan) *proxy.RoutePlanner {
+			queryPredicate = newSpyPredicate()
+			queryPredicate.result = true
+			queries = make(map[string]*spyStepQuery)
+
+			return proxy.NewRoutePlanner(
+				plan,
+				t.spyPredicate.Predicate,
+				t.spyEventWriter,
+				log.New(ioutil.Discard, "", 0),
+				proxy.WithClock(t.clock.Now, nil),
+				proxy.WithQueryPredicate(proxy.DefaultCandidate, queryPredicate.Predicate),
+				proxy.WithStepQueries(func(query string, e proxy.QueryEvaluation) proxy.StepQuery {
+					q := &spyStepQuery{result: true, evaluation: e}
+					queries[query] = q
+					return q
+				}),
+			)
+		}
+
+		o.Spec("it swaps the queries as the plan moves on", func(t TR) {
+			t.p = newQueriedPlanner(t, proxy.Plan{
+				{Percentage: 5, Duration: 100 * time.Millisecond, Queries: []string{"query-a"}},
+				{Percentage: 10, Duration: 100 * time.Millisecond, Queries: []string{"query-b"}, ReplaceQuery: true},
+			})
+
+			t.p.Sync()
+			Expect(t, queries).To(HaveLen(1))
+			Expect(t, queries["query-a"].stopped).To(BeFalse())
+
+			t.clock.Add(100 * time.Millisecond)
+			t.p.Sync()
+			Expect(t, queries).To(HaveLen(2))
+			Expect(t, queries["query-a"].stopped).To(BeTrue())
+			Expect(t, queries["query-b"].stopped).To(BeFalse())
+			Expect(t, t.spyEventWriter.events).To(Contain(structuredlogs.Event{
+				Code:    proxy.NextPlanStep,
+				Message: `starting next step: {Percentage:10 Queries:["query-b"] ReplaceQuery Duration:100ms}`,
+			}))
+
+			t.clock.Add(100 * time.Millisecond)
+			t.p.Sync()
+			Expect(t, queries["query-b"].stopped).To(BeTrue())
+		})
+
+		o.Spec("it only runs the global query if the step does not replace it", func(t TR) {
+			t.p = newQueriedPlanner(t, proxy.Plan{
+				{Percentage: 5, Duration: 100 * time.Millisecond, Queries: []string{"query-a"}, ReplaceQuery: true},
+				{Percentage: 10, Duration: 100 * time.Millisecond},
+			})
+
+			t.p.Sync()
+			queryPredicate.result = false
+			t.p.Sync()
+			Expect(t, t.p.CurrentPercentage()).To(Equal(5.0))
+
+			t.clock.Add(100 * time.Millisecond)
+			t.p.Sync()
+			Expect(t, t.p.CurrentPercentage()).To(Equal(10.0))
+
+			t.p.Sync()
+			Expect(t, t.p.CurrentPercentage()).To(Equal(0.0))
+			Expect(t, t.spyEventWriter.events).To(Contain(structuredlogs.Event{
+				Code:    proxy.Abort,
+				Message: "predicate failed. Directing traffic to previous route...",
+			}))
+		})
+
+		o.Spec("it runs the queries with the step's evaluation", func(t TR) {
+			t.p = newQueriedPlanner(t, proxy.Plan{
+				{Percentage: 5, Duration: 100 * time.Millisecond, Queries: []string{"query-a"}},
+				{
+					Percentage: 10,
+					Duration:   100 * time.Millisecond,
+					Queries:    []string{"query-b"},
+					Evaluation: &proxy.QueryEvaluation{Mode: "threshold", Threshold: "< 0.5", NoData: "hold"},
+				},
+			})
+
+			t.p.Sync()
+			Expect(t, queries["query-a"].evaluation).To(Equal(proxy.QueryEvaluation{}))
+
+			t.clock.Add(100 * time.Millisecond)
+			t.p.Sync()
+			Expect(t, queries["query-b"].evaluation).To(Equal(proxy.QueryEvaluation{
+				Mode:      "threshold",
+				Threshold: "< 0.5",
+				NoData:    "hold",
+			}))
+			Expect(t, t.spyEventWriter.events).To(Contain(structuredlogs.Event{
+				Code:    proxy.NextPlanStep,
+				Message: `starting next step: {Percentage:10 Queries:["query-b"] Evaluation:{Mode:threshold Threshold:"< 0.5" NoData:hold} Duration:100ms}`,
+			}))
+		})
+
+		o.Spec("it aborts if a query of the step fails", func(t TR) {
+			t.p = newQueriedPlanner(t, proxy.Plan{
+				{Percentage: 5, Duration: 100 * time.Millisecond, Queries: []string{"query-a", "query-b"}},
+			})
+
+			t.p.Sync()
+			queries["query-b"].result = false
+			queries["query-b"].value = "0.7"
+			t.p.Sync()
+			Expect(t, t.p.CurrentPercentage()).To(Equal(0.0))
+			Expect(t, t.spyEventWriter.events).To(Contain(structuredlogs.Event{
+				Code:    proxy.Abort,
+				Message: "query 2 of step 1 (query-b) failed with 0.7. Directing traffic to previous route...",
+			}))
+		})
+
+		o.Spec("it waits for the queries to succeed often enough", func(t TR) {
+			t.p = newQueriedPlanner(t, proxy.Plan{
+				{Percentage: 5, Duration: 100 * time.Millisecond, Queries: []string{"query-a"}, MinEvaluations: 3},
+				{Percentage: 10, Duration: 100 * time.Millisecond},
+			})
+
+			t.p.Sync()
+			t.clock.Add(100 * time.Millisecond)
+			t.p.Sync()
+			Expect(t, t.p.CurrentPercentage()).To(Equal(5.0))
+
+			queries["query-a"].evaluations = 3
+			t.p.Sync()
+			Expect(t, t.p.CurrentPercentage()).To(Equal(10.0))
+		})
+	})
+
+	o.Group("with an operator", func() {
+		o.Spec("it holds the current step while paused", func(t TR) {
+			t.p.Sync()
+			Expect(t, t.p.CurrentPercentage()).To(Equal(5.0))
+			Expect(t, t.p.Pause()).To(BeNil())
+			Expect(t, t.p.Pause()).To(Equal(proxy.ErrPaused))
+			Expect(t, t.p.Status().Paused).To(BeTrue())
+			Expect(t, t.p.Status().PausedAt.Equal(t.clock.Now())).To(BeTrue())
+
+			t.clock.Add(150 * time.Millisecond)
+			t.p.Sync()
+			Expect(t, t.p.CurrentPercentage()).To(Equal(5.0))
+
+			Expect(t, t.p.Resume()).To(BeNil())
+			Expect(t, t.p.Resume()).To(Equal(proxy.ErrNotPaused))
+			Expect(t, t.p.CurrentPercentage()).To(Equal(5.0))
+
+			t.clock.Add(100 * time.Millisecond)
+			t.p.Sync()
+			Expect(t, t.p.CurrentPercentage()).To(Equal(10.0))
+
+			Expect(t, t.spyEventWriter.events).To(Contain(
+				structuredlogs.Event{
+					Code:    proxy.Paused,
+					Message: "paused plan at step 1 of 2",
+				},
+				structuredlogs.Event{
+					Code:    proxy.Resumed,
+					Message: "resumed plan at step 1 of 2",
+				},
+			))
+		})
+
+		o.Spec("it routes to the previous route if paused before starting", func(t TR) {
+			Expect(t, t.p.Pause()).To(BeNil())
+			Expect(t, t.p.CurrentSplit()).To(Equal(proxy.Split{Step: -1}))
+		})
+
+		o.Spec("it moves on to the next step", func(t TR) {
+			t.p.Sync()
+			Expect(t, t.p.CurrentPercentage()).To(Equal(5.0))
+			Expect(t, t.p.NextStep()).To(BeNil())
+			Expect(t, t.p.CurrentPercentage()).To(Equal(10.0))
+			Expect(t, t.spyEventWriter.events).To(Contain(structuredlogs.Event{
+				Code:    proxy.NextPlanStep,
+				Message: "starting next step: {Percentage:10 Duration:100ms}",
+			}))
+
+			Expect(t, t.p.NextStep()).To(BeNil())
+			Expect(t, t.p.CurrentPercentage()).To(Equal(100.0))
+			Expect(t, t.p.NextStep()).To(Equal(proxy.ErrFinished))
+		})
+
+		o.Spec("it promotes the candidates", func(t TR) {
+			Expect(t, t.p.Promote()).To(BeNil())
+			Expect(t, t.p.CurrentPercentage()).To(Equal(100.0))
+			Expect(t, t.p.Promote()).To(Equal(proxy.ErrFinished))
+			Expect(t, t.p.Pause()).To(Equal(proxy.ErrFinished))
+			Expect(t, t.spyEventWriter.events[0]).To(Equal(structuredlogs.Event{
+				Code:    proxy.FinishedPlanSteps,
+				Message: "promoted by operator",
+			}))
+		})
+
+		o.Spec("it aborts the plan", func(t TR) {
+			t.p.AbortPlan("aborted by operator")
+			t.p.AbortPlan("aborted by operator")
+
+			Expect(t, t.spyEventWriter.events).To(Equal([]structuredlogs.Event{{
+				Code:    proxy.Abort,
+				Message: "aborted by operator. Directing traffic to previous route...",
+			}}))
+			Expect(t, t.p.CurrentPercentage()).To(Equal(0.0))
+			Expect(t, t.p.Promote()).To(Equal(proxy.ErrAborted))
+			Expect(t, t.p.NextStep()).To(Equal(proxy.ErrAborted))
+		})
+	})
+
+	o.Group("with multiple candidates", func() {
+		o.BeforeEach(func(t TR) TR {
+			plan := proxy.Plan{
+				{Weights: map[string]float64{"a": 10, "b": 20}, Duration: 100 * time.Millisecond},
+				{Weights: map[string]float64{"a": 20, "b": 20}, Duration: 100 * time.Millisecond},
+			}
+
+			t.otherSpyPredicate = newSpyPredicate()
+			t.otherSpyPredicate.result = true
+
+			t.p = proxy.NewRoutePlanner(
+				plan,
+				t.spyPredicate.Predicate,
+				t.spyEventWriter,
+				log.New(ioutil.Discard, "", 0),
+				proxy.WithCandidatePredicate("b", t.otherSpyPredicate.Predicate),
+				proxy.WithClock(t.clock.Now, nil),
+			)
+			return t
+		})
+
+		o.Spec("it returns the weights over time", func(t TR) {
+			t.p.Sync()
+			Expect(t, t.p.CurrentSplit().Weights).To(Equal(map[string]float64{"a": 10, "b": 20}))
+
+			t.clock.Add(100 * time.Millisecond)
+			t.p.Sync()
+			Expect(t, t.p.CurrentSplit().Weights).To(Equal(map[string]float64{"a": 20, "b": 20}))
+
+			t.clock.Add(100 * time.Millisecond)
+			t.p.Sync()
+			Expect(t, t.p.CurrentSplit().Weights).To(Equal(map[string]float64{"a": 50, "b": 50}))
+
+			Expect(t, t.spyEventWriter.events).To(Contain(structuredlogs.Event{
+				Code:    proxy.NextPlanStep,
+				Message: "starting next step: {Weights:[a:20 b:20] Duration:100ms}",
+			}))
+		})
+
+		o.Spec("it aborts a single candidate", func(t TR) {
+			t.otherSpyPredicate.result = false
+			for i := 0; i < 10; i++ {
+				t.p.Sync()
+				Expect(t, t.p.CurrentSplit().Weights).To(Equal(map[string]float64{"a": 10}))
+			}
+
+			// Aborted candidates stay aborted.
+			t.otherSpyPredicate.result = true
+			t.p.Sync()
+			Expect(t, t.p.CurrentSplit().Weights).To(Equal(map[string]float64{"a": 10}))
+
+			Expect(t, t.spyEventWriter.events).To(HaveLen(2))
+			Expect(t, t.spyEventWriter.events[0].Code).To(Equal(proxy.AbortCandidate))
+
+			t.clock.Add(100 * time.Millisecond)
+			t.p.Sync()
+			Expect(t, t.p.CurrentSplit().Weights).To(Equal(map[string]float64{"a": 20}))
+
+			t.clock.Add(100 * time.Millisecond)
+			t.p.Sync()
+			Expect(t, t.p.CurrentSplit().Weights).To(Equal(map[string]float64{"a": 100}))
+		})
+
+		o.Spec("it aborts once every candidate fails", func(t TR) {
+			t.otherSpyPredicate.result = false
+			t.spyPredicate.result = false
+
+			t.p.Sync()
+			Expect(t, t.p.CurrentSplit().Weights).To(HaveLen(0))
+			Expect(t, t.spyEventWriter.events).To(HaveLen(1))
+			Expect(t, t.spyEventWriter.events[0].Code).To(Equal(proxy.Abort))
+		})
+	})
+
+	o.Group("when stopped", func() {
+		o.Spec("it records an interrupted plan", func(t TR) {
+			t.p.Sync()
+
+			Expect(t, t.p.Stop()).To(Equal(proxy.Interrupted))
+			Expect(t, t.spyEventWriter.events).To(Contain(structuredlogs.Event{
+				Code:    proxy.Stopped,
+				Message: "router stopped: interrupted",
+			}))
+		})
+
+		o.Spec("it records a promoted plan", func(t TR) {
+			Expect(t, t.p.Promote()).To(BeNil())
+
+			Expect(t, t.p.Stop()).To(Equal(proxy.Promoted))
+			Expect(t, t.spyEventWriter.events).To(Contain(structuredlogs.Event{
+				Code:    proxy.Stopped,
+				Message: "router stopped: promoted",
+			}))
+		})
+
+		o.Spec("it records an aborted plan", func(t TR) {
+			t.p.AbortPlan("some-reason")
+
+			Expect(t, t.p.Stop()).To(Equal(proxy.Aborted))
+			Expect(t, t.spyEventWriter.events).To(Contain(structuredlogs.Event{
+				Code:    proxy.Stopped,
+				Message: "router stopped: aborted",
+			}))
+		})
+	})
+
 	o.Spec("it survives the race detector", func(t TR) {
+		tick := make(chan time.Time)
+		t.p = proxy.NewRoutePlanner(
+			proxy.Plan{{Percentage: 5, Duration: time.Millisecond}},
+			t.spyPredicate.Predicate,
+			t.spyEventWriter,
+			log.New(ioutil.Discard, "", 0),
+			proxy.WithClock(t.clock.Now, tick),
+		)
+
 		go func() {
 			for i := 0; i < 100; i++ {
-				t.p.CurrentPercentage()
+				t.clock.Add(time.Millisecond)
+				tick <- t.clock.Now()
 			}
 		}()
 
@@ -112,6 +724,30 @@ func (s *spyPredicate) Predicate() bool {
 	return s.result
 }
 
+type spyStepQuery struct {
+	result      bool
+	evaluations int
+	value       string
+	stopped     bool
+	evaluation  proxy.QueryEvaluation
+}
+
+func (s *spyStepQuery) Predicate() bool {
+	return s.result
+}
+
+func (s *spyStepQuery) Evaluations() int {
+	return s.evaluations
+}
+
+func (s *spyStepQuery) Value() string {
+	return s.value
+}
+
+func (s *spyStepQuery) Stop() {
+	s.stopped = true
+}
+
 type spyEventWriter struct {
 	events []structuredlogs.Event
 }
@@ -123,3 +759,26 @@ func newSpyEventWriter() *spyEventWriter {
 func (s *spyEventWriter) Write(e structuredlogs.Event) {
 	s.events = append(s.events, e)
 }
+
+type stubClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newStubClock() *stubClock {
+	return &stubClock{now: time.Now()}
+}
+
+func (s *stubClock) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.now
+}
+
+func (s *stubClock) Add(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.now = s.now.Add(d)
+}
@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ShadowConfig configures how copies of requests are sent to the candidates
+// while a step of the plan shadows traffic. The responses of the copies are
+// thrown away.
+type ShadowConfig struct {
+	// QueueSize is the number of copies that can wait to be sent. Copies are
+	// dropped while the queue is full.
+	QueueSize int
+
+	// Workers is the number of copies that are sent concurrently.
+	Workers int
+
+	// Timeout is how long a copy has to get a response.
+	Timeout time.Duration
+
+	// MaxBodySize is the largest request body that is copied. Requests with
+	// larger bodies are not shadowed.
+	MaxBodySize int64
+}
+
+// WithShadowConfig overrides the DefaultShadowConfig.
+func WithShadowConfig(c ShadowConfig) ProxyOption {
+	return func(p *Proxy) {
+		p.shadowConfig = c
+	}
+}
+
+// DefaultShadowConfig returns the ShadowConfig that is used unless
+// WithShadowConfig is given.
+func DefaultShadowConfig() ShadowConfig {
+	return ShadowConfig{
+		QueueSize:   100,
+		Workers:     4,
+		Timeout:     5 * time.Second,
+		MaxBodySize: 1 << 20,
+	}
+}
+
+type shadower struct {
+	cfg     ShadowConfig
+	queue   chan shadowRequest
+	differ  *Differ
+	log     *log.Logger
+	idx     int64
+	dropped int64
+
+	// start starts the workers once the first copy is sent, so they only
+	// run when the plan shadows traffic.
+	start sync.Once
+}
+
+type shadowRequest struct {
+	candidate string
+	rp        *httputil.ReverseProxy
+	method    string
+	url       string
+	header    http.Header
+	body      []byte
+
+	// expected is the response of the old route. It is only set when
+	// responses are compared.
+	expected *recordedResponse
+}
+
+func newShadower(cfg ShadowConfig, d *Differ, log *log.Logger) *shadower {
+	return &shadower{
+		cfg:    cfg,
+		queue:  make(chan shadowRequest, cfg.QueueSize),
+		differ: d,
+		log:    log,
+	}
+}
+
+// sample returns true for the given percentage of calls.
+func (s *shadower) sample(percentage int) bool {
+	if percentage <= 0 {
+		return false
+	}
+
+	return int(atomic.AddInt64(&s.idx, 13)%100) < percentage
+}
+
+// copyRequest captures the request so that it can be sent again after the
+// original has been served. The body is buffered and put back on the
+// original request. It returns false if the body is too large or the request
+// is a protocol upgrade.
+func (s *shadower) copyRequest(r *http.Request) (shadowRequest, bool) {
+	if r.Header.Get("Upgrade") != "" {
+		return shadowRequest{}, false
+	}
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(r.Body, s.cfg.MaxBodySize+1))
+		if err != nil {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			return shadowRequest{}, false
+		}
+
+		if int64(len(body)) > s.cfg.MaxBodySize {
+			r.Body = readCloser{
+				Reader: io.MultiReader(bytes.NewReader(body), r.Body),
+				Closer: r.Body,
+			}
+			return shadowRequest{}, false
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	return shadowRequest{
+		method: r.Method,
+		url:    r.URL.String(),
+		header: cloneHeader(r.Header),
+		body:   body,
+	}, true
+}
+
+// serve serves the original request. The response is recorded if it is
+// going to be compared.
+func (s *shadower) serve(req *shadowRequest, w http.ResponseWriter, serve func(http.ResponseWriter)) {
+	if s.differ == nil {
+		serve(w)
+		return
+	}
+
+	rw := newRecordingResponseWriter(w, s.differ.cfg.MaxBodySize)
+	serve(rw)
+	req.expected = rw.response()
+}
+
+// send queues the copy for the given candidate. It never blocks.
+func (s *shadower) send(req shadowRequest, candidate string, rp *httputil.ReverseProxy) {
+	req.candidate = candidate
+	req.rp = rp
+
+	s.start.Do(func() {
+		for i := 0; i < s.cfg.Workers; i++ {
+			go s.run()
+		}
+	})
+
+	select {
+	case s.queue <- req:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+func (s *shadower) run() {
+	for req := range s.queue {
+		s.do(req)
+	}
+}
+
+func (s *shadower) do(req shadowRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.Timeout)
+	defer cancel()
+
+	r, err := http.NewRequest(req.method, req.url, bytes.NewReader(req.body))
+	if err != nil {
+		s.log.Printf("failed to create shadow request: %s", err)
+		return
+	}
+	r.Header = cloneHeader(req.header)
+
+	if req.expected == nil {
+		req.rp.ServeHTTP(discardResponseWriter{header: make(http.Header)}, r.WithContext(ctx))
+		return
+	}
+
+	rw := newRecordingResponseWriter(nil, s.differ.cfg.MaxBodySize)
+	req.rp.ServeHTTP(rw, r.WithContext(ctx))
+	s.differ.compare(req.candidate, req, rw.response())
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// discardResponseWriter throws away the response of a shadowed request.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w discardResponseWriter) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (w discardResponseWriter) WriteHeader(int) {}
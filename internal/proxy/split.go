@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// KeyFunc extracts the attribute a request is split on. It returns false if
+// the request does not have the attribute.
+type KeyFunc func(r *http.Request) (string, bool)
+
+// WithHashSplit assigns requests to a cohort by hashing the given key
+// instead of using a counter. A given key always lands in the same cohort,
+// therefore the clients routed to the new route only grow as the plan
+// progresses. Requests without the key fall back to the counter.
+func WithHashSplit(key KeyFunc) ProxyOption {
+	return func(p *Proxy) {
+		p.key = key
+	}
+}
+
+// ParseKey parses a key description. Valid descriptions are
+// "header:<name>", "cookie:<name>", "ip" and "jwt-sub".
+func ParseKey(s string) (KeyFunc, error) {
+	kind, name := s, ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		kind, name = s[:i], s[i+1:]
+	}
+
+	switch kind {
+	case "header":
+		if name == "" {
+			return nil, fmt.Errorf("header key requires a name")
+		}
+		return HeaderKey(name), nil
+	case "cookie":
+		if name == "" {
+			return nil, fmt.Errorf("cookie key requires a name")
+		}
+		return CookieKey(name), nil
+	case "ip":
+		return ClientIPKey(), nil
+	case "jwt-sub":
+		return JWTSubjectKey(), nil
+	default:
+		return nil, fmt.Errorf("unknown key: %s", s)
+	}
+}
+
+// HeaderKey splits requests on the value of the given header.
+func HeaderKey(name string) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		v := r.Header.Get(name)
+		return v, v != ""
+	}
+}
+
+// CookieKey splits requests on the value of the given cookie.
+func CookieKey(name string) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		c, err := r.Cookie(name)
+		if err != nil || c.Value == "" {
+			return "", false
+		}
+		return c.Value, true
+	}
+}
+
+// ClientIPKey splits requests on the client's IP. The first entry of the
+// X-Forwarded-For header (set by the gorouter) is preferred over the remote
+// address.
+func ClientIPKey() KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			return strings.TrimSpace(strings.Split(xff, ",")[0]), true
+		}
+
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+
+		return host, host != ""
+	}
+}
+
+// JWTSubjectKey splits requests on the subject of the bearer token in the
+// Authorization header. The token's signature is NOT verified, it is only
+// used to pick a cohort.
+func JWTSubjectKey() KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		auth := r.Header.Get("Authorization")
+		if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+			return "", false
+		}
+
+		parts := strings.Split(auth[7:], ".")
+		if len(parts) != 3 {
+			return "", false
+		}
+
+		payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+		if err != nil {
+			return "", false
+		}
+
+		var claims struct {
+			Sub string `json:"sub"`
+		}
+		if err := json.Unmarshal(payload, &claims); err != nil {
+			return "", false
+		}
+
+		return claims.Sub, claims.Sub != ""
+	}
+}
+
+// hashCohort maps the key onto a bucket.
+func hashCohort(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	return int(h.Sum32() % buckets)
+}
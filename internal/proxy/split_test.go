@@ -0,0 +1,211 @@
+package proxy_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-canary-router/internal/proxy"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TS struct {
+	*testing.T
+
+	oldSpyServer *spyServer
+	newSpyServer *spyServer
+
+	oldTestServer *httptest.Server
+	newTestServer *httptest.Server
+
+	spyPlanner *spyPlanner
+}
+
+func TestHashSplit(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TS {
+		oldSpyServer := newSpyServer()
+		newSpyServer := newSpyServer()
+
+		return TS{
+			T:             t,
+			oldSpyServer:  oldSpyServer,
+			oldTestServer: httptest.NewServer(oldSpyServer),
+			newSpyServer:  newSpyServer,
+			newTestServer: httptest.NewServer(newSpyServer),
+			spyPlanner:    newSpyPlanner(),
+		}
+	})
+
+	o.AfterEach(func(t TS) {
+		t.oldTestServer.Close()
+		t.newTestServer.Close()
+	})
+
+	o.Spec("it routes the same key to the same route", func(t TS) {
+		p := proxy.New(
+			t.oldTestServer.URL,
+			t.newTestServer.URL,
+			t.spyPlanner,
+			true,
+			log.New(ioutil.Discard, "", 0),
+			proxy.WithHashSplit(proxy.HeaderKey("X-User")),
+		)
+		t.spyPlanner.percentage = 50
+
+		for i := 0; i < 20; i++ {
+			req, err := http.NewRequest("GET", "http://some.url", nil)
+			Expect(t, err).To(BeNil())
+			req.Header.Set("X-User", "some-user")
+
+			p.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		Expect(t, len(t.oldSpyServer.requests)+len(t.newSpyServer.requests)).To(Equal(20))
+		Expect(t, len(t.oldSpyServer.requests) == 20 || len(t.newSpyServer.requests) == 20).To(BeTrue())
+	})
+
+	o.Spec("it only grows the cohort on the new route", func(t TS) {
+		p := proxy.New(
+			t.oldTestServer.URL,
+			t.newTestServer.URL,
+			t.spyPlanner,
+			true,
+			log.New(ioutil.Discard, "", 0),
+			proxy.WithHashSplit(proxy.HeaderKey("X-User")),
+		)
+
+		users := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}
+		onNew := map[string]bool{}
+		for _, percentage := range []float64{10, 30, 60, 90} {
+			t.spyPlanner.percentage = percentage
+			for _, u := range users {
+				t.newSpyServer.clear()
+
+				req, err := http.NewRequest("GET", "http://some.url", nil)
+				Expect(t, err).To(BeNil())
+				req.Header.Set("X-User", u)
+				p.ServeHTTP(httptest.NewRecorder(), req)
+
+				routedToNew := len(t.newSpyServer.requests) == 1
+				if onNew[u] {
+					Expect(t, routedToNew).To(BeTrue())
+				}
+				onNew[u] = routedToNew
+			}
+		}
+	})
+
+	o.Spec("it keeps a candidate's cohort while another candidate ramps", func(t TS) {
+		otherSpyServer := newSpyServer()
+		otherTestServer := httptest.NewServer(otherSpyServer)
+		defer otherTestServer.Close()
+
+		clock := newStubClock()
+		planner := proxy.NewRoutePlanner(
+			proxy.Plan{
+				{Weights: map[string]float64{"a": 10, proxy.DefaultCandidate: 10}, Duration: time.Minute},
+				{Weights: map[string]float64{"a": 50, proxy.DefaultCandidate: 10}, Duration: time.Minute},
+			},
+			func() bool { return true },
+			&spyEventWriter{},
+			log.New(ioutil.Discard, "", 0),
+			proxy.WithClock(clock.Now, nil),
+		)
+
+		p := proxy.New(
+			t.oldTestServer.URL,
+			t.newTestServer.URL,
+			planner,
+			true,
+			log.New(ioutil.Discard, "", 0),
+			proxy.WithCandidate("a", otherTestServer.URL),
+			proxy.WithHashSplit(proxy.HeaderKey("X-User")),
+		)
+
+		onCanary := func(user string) bool {
+			t.oldSpyServer.clear()
+			t.newSpyServer.clear()
+			otherSpyServer.clear()
+
+			req, err := http.NewRequest("GET", "http://some.url", nil)
+			Expect(t, err).To(BeNil())
+			req.Header.Set("X-User", user)
+			p.ServeHTTP(httptest.NewRecorder(), req)
+
+			return len(t.newSpyServer.requests) == 1
+		}
+
+		planner.Sync()
+		var users []string
+		for i := 0; i < 200; i++ {
+			if u := fmt.Sprintf("user-%d", i); onCanary(u) {
+				users = append(users, u)
+			}
+		}
+		Expect(t, len(users) > 0).To(BeTrue())
+
+		clock.Add(time.Minute)
+		planner.Sync()
+		Expect(t, planner.CurrentSplit().Weights["a"]).To(Equal(50.0))
+		for _, u := range users {
+			Expect(t, onCanary(u)).To(BeTrue())
+		}
+	})
+
+	o.Spec("it parses keys", func(t TS) {
+		_, err := proxy.ParseKey("header:X-User")
+		Expect(t, err).To(BeNil())
+		_, err = proxy.ParseKey("cookie:session")
+		Expect(t, err).To(BeNil())
+		_, err = proxy.ParseKey("ip")
+		Expect(t, err).To(BeNil())
+		_, err = proxy.ParseKey("jwt-sub")
+		Expect(t, err).To(BeNil())
+
+		_, err = proxy.ParseKey("header")
+		Expect(t, err).To(HaveOccurred())
+		_, err = proxy.ParseKey("invalid")
+		Expect(t, err).To(HaveOccurred())
+	})
+
+	o.Spec("it reads the client IP", func(t TS) {
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		req.RemoteAddr = "10.0.0.1:1234"
+
+		ip, ok := proxy.ClientIPKey()(req)
+		Expect(t, ok).To(BeTrue())
+		Expect(t, ip).To(Equal("10.0.0.1"))
+
+		req.Header.Set("X-Forwarded-For", "10.0.0.2, 10.0.0.3")
+		ip, ok = proxy.ClientIPKey()(req)
+		Expect(t, ok).To(BeTrue())
+		Expect(t, ip).To(Equal("10.0.0.2"))
+	})
+
+	o.Spec("it reads the JWT subject", func(t TS) {
+		payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"some-user"}`))
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("Authorization", "Bearer header."+payload+".signature")
+
+		sub, ok := proxy.JWTSubjectKey()(req)
+		Expect(t, ok).To(BeTrue())
+		Expect(t, sub).To(Equal("some-user"))
+
+		req.Header.Set("Authorization", "Bearer invalid")
+		_, ok = proxy.JWTSubjectKey()(req)
+		Expect(t, ok).To(BeFalse())
+	})
+}
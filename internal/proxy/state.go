@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// State is the progress of a plan that is shared between router instances.
+type State struct {
+	// Version is incremented with every change. A store without a state
+	// returns a Version of 0.
+	Version int64
+
+	// Step is the index of the current step. It is -1 before the plan has
+	// started and the number of steps once the plan has finished (or has
+	// been promoted).
+	Step        int64
+	StepStarted time.Time
+
+	// Paused is when the plan was paused. It is zero while the plan is
+	// running.
+	Paused time.Time `json:",omitempty"`
+
+	// Aborted holds the reason each aborted candidate was aborted.
+	Aborted map[string]string `json:",omitempty"`
+
+	// Failures holds the number of times in a row each predicate (by the
+	// name given to WithPredicateHistory) has failed.
+	Failures map[string]int `json:",omitempty"`
+}
+
+// PredicateHistory is implemented by predicates that fail after failing a
+// number of times in a row (e.g., predicate.PromQL).
+type PredicateHistory interface {
+	Failures() int
+	RestoreFailures(n int)
+}
+
+// StateStore shares the State of a plan between router instances.
+type StateStore interface {
+	// Load returns the latest State.
+	Load() (State, error)
+
+	// CompareAndSwap stores the State if the stored State is still at the
+	// given version. It returns false if another instance changed it first.
+	CompareAndSwap(version int64, s State) (bool, error)
+}
+
+// WithStateStore shares the progress of the plan with the other router
+// instances. Every change to the plan is written to the store before it is
+// used, so the instances agree on the current step, when it started and
+// which candidates have been aborted. The changes of the other instances
+// are read from the store on each tick.
+func WithStateStore(s StateStore, tick <-chan time.Time) RoutePlannerOption {
+	return func(r *RoutePlanner) {
+		r.store = s
+		r.syncTick = tick
+	}
+}
+
+// WithPredicateHistory stores the failures of the given predicate along
+// with the State. They are restored the first time the State is read (see
+// Restore).
+func WithPredicateHistory(name string, h PredicateHistory) RoutePlannerOption {
+	return func(r *RoutePlanner) {
+		r.histories[name] = h
+	}
+}
+
+// Restore reads the State from the store so that a restarted router resumes
+// the plan where it left off. It returns ErrFinished or ErrAborted if the
+// plan is already over. The plan is not started over: all the traffic goes
+// to the previous route if it has been aborted and to the remaining
+// candidates if it has finished. The predicates are no longer evaluated, so
+// it stays that way.
+func (p *RoutePlanner) Restore() error {
+	if p.store == nil {
+		return nil
+	}
+
+	p.syncMu.Lock()
+	err := p.sync()
+	p.syncMu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	c := *p.load()
+	switch {
+	case p.checkAborted() != nil:
+		p.end(Split{Step: int(c.idx)})
+		return ErrAborted
+	case c.idx >= int64(len(p.plan)):
+		p.mu.Lock()
+		aborted := make(map[string]bool, len(p.aborted))
+		for name := range p.aborted {
+			aborted[name] = true
+		}
+		p.mu.Unlock()
+
+		p.end(p.splitFor(c, aborted))
+		return ErrFinished
+	}
+
+	p.evaluate()
+
+	return nil
+}
+
+// end stops evaluating the plan and keeps the given split.
+func (p *RoutePlanner) end(s Split) {
+	p.evalMu.Lock()
+	defer p.evalMu.Unlock()
+
+	atomic.StoreInt32(&p.over, 1)
+	p.split.Store(s)
+}
+
+// Sync reads the State from the store and writes any aborted candidates the
+// store does not know about yet. The plan is then evaluated. Without a
+// StateStore, it only evaluates the plan.
+func (p *RoutePlanner) Sync() {
+	p.syncStore()
+	p.evaluate()
+}
+
+func (p *RoutePlanner) runSync() {
+	for range p.syncTick {
+		p.Sync()
+	}
+}
+
+// syncStore is Sync without the evaluation. It is used while evaluating.
+func (p *RoutePlanner) syncStore() {
+	if p.store == nil {
+		return
+	}
+
+	p.syncMu.Lock()
+	defer p.syncMu.Unlock()
+
+	if err := p.sync(); err != nil {
+		p.log.Printf("failed to sync plan state: %s", err)
+	}
+}
+
+// sync has to be called while holding syncMu.
+func (p *RoutePlanner) sync() error {
+	for {
+		s, err := p.store.Load()
+		if err != nil {
+			return err
+		}
+
+		if !p.restored {
+			for name, h := range p.histories {
+				h.RestoreFailures(s.Failures[name])
+			}
+			p.restored = true
+		}
+
+		current := p.adopt(s)
+		updated := p.state(*current)
+		if current.version == s.Version &&
+			len(updated.Aborted) == len(s.Aborted) &&
+			equalFailures(updated.Failures, s.Failures) {
+			return nil
+		}
+
+		// Either the store is missing aborted candidates or failures, or it
+		// is behind (e.g., it was reset).
+		updated.Version = s.Version + 1
+		ok, err := p.store.CompareAndSwap(s.Version, updated)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			c := *current
+			c.version = updated.Version
+			atomic.StorePointer(&p.current, unsafe.Pointer(&c))
+			return nil
+		}
+	}
+}
+
+// adopt replaces the current plan with the State if it is newer. Aborted
+// candidates are merged as a candidate never comes back once aborted. It
+// returns the resulting current plan.
+func (p *RoutePlanner) adopt(s State) *currentPlan {
+	p.mu.Lock()
+	for name, reason := range s.Aborted {
+		if _, ok := p.aborted[name]; ok || !p.isCandidate(name) {
+			continue
+		}
+
+		p.aborted[name] = reason
+		p.abortReason = reason
+	}
+	p.mu.Unlock()
+
+	current := (*currentPlan)(atomic.LoadPointer(&p.current))
+	if s.Version <= current.version {
+		return current
+	}
+
+	current = &currentPlan{
+		idx:     s.Step,
+		last:    s.StepStarted,
+		paused:  s.Paused,
+		version: s.Version,
+	}
+	atomic.StorePointer(&p.current, unsafe.Pointer(current))
+
+	return current
+}
+
+// state returns the State to share for the given plan.
+func (p *RoutePlanner) state(c currentPlan) State {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	aborted := make(map[string]string, len(p.aborted))
+	for name, reason := range p.aborted {
+		aborted[name] = reason
+	}
+
+	var failures map[string]int
+	if len(p.histories) > 0 {
+		failures = make(map[string]int, len(p.histories))
+		for name, h := range p.histories {
+			failures[name] = h.Failures()
+		}
+	}
+
+	return State{
+		Version:     c.version,
+		Step:        c.idx,
+		StepStarted: c.last,
+		Paused:      c.paused,
+		Aborted:     aborted,
+		Failures:    failures,
+	}
+}
+
+func equalFailures(a, b map[string]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for name, n := range a {
+		if m, ok := b[name]; !ok || m != n {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,260 @@
+package proxy_test
+
+import (
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-canary-router/internal/proxy"
+	"github.com/poy/cf-canary-router/internal/structuredlogs"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TSS struct {
+	*testing.T
+	a, b           *proxy.RoutePlanner
+	spyEventWriter *spyEventWriter
+	spyPredicate   *spyPredicate
+}
+
+func TestSharedState(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TSS {
+		plan := proxy.Plan{
+			{Percentage: 5, Duration: time.Hour},
+			{Percentage: 10, Duration: time.Hour},
+		}
+
+		spyPredicate := newSpyPredicate()
+		spyPredicate.result = true
+		spyEventWriter := newSpyEventWriter()
+		store := &stubStateStore{}
+
+		newPlanner := func() *proxy.RoutePlanner {
+			return proxy.NewRoutePlanner(
+				plan,
+				spyPredicate.Predicate,
+				spyEventWriter,
+				log.New(ioutil.Discard, "", 0),
+				proxy.WithStateStore(store, nil),
+				proxy.WithClock(time.Now, nil),
+			)
+		}
+
+		return TSS{
+			T:              t,
+			a:              newPlanner(),
+			b:              newPlanner(),
+			spyEventWriter: spyEventWriter,
+			spyPredicate:   spyPredicate,
+		}
+	})
+
+	o.Spec("it starts each step once", func(t TSS) {
+		t.a.Sync()
+		t.b.Sync()
+		Expect(t, t.a.CurrentPercentage()).To(Equal(5.0))
+		Expect(t, t.b.CurrentPercentage()).To(Equal(5.0))
+
+		Expect(t, t.spyEventWriter.events).To(HaveLen(1))
+		Expect(t, t.a.Status().StepStarted).To(Equal(t.b.Status().StepStarted))
+
+		Expect(t, t.b.NextStep()).To(BeNil())
+		t.a.Sync()
+		Expect(t, t.a.CurrentPercentage()).To(Equal(10.0))
+		Expect(t, t.a.Status().Step).To(Equal(1))
+	})
+
+	o.Spec("it shares aborted candidates", func(t TSS) {
+		t.a.Sync()
+		t.a.Abort(proxy.DefaultCandidate, "some-reason")
+
+		t.b.Sync()
+		Expect(t, t.b.CurrentPercentage()).To(Equal(0.0))
+		Expect(t, t.b.Status().Aborted).To(Equal(map[string]string{
+			proxy.DefaultCandidate: "some-reason",
+		}))
+		Expect(t, t.b.Promote()).To(Equal(proxy.ErrAborted))
+	})
+
+	o.Spec("it shares pauses and promotions", func(t TSS) {
+		t.a.Sync()
+		Expect(t, t.a.Pause()).To(BeNil())
+
+		t.b.Sync()
+		Expect(t, t.b.Status().Paused).To(BeTrue())
+		Expect(t, t.b.Pause()).To(Equal(proxy.ErrPaused))
+
+		Expect(t, t.b.Promote()).To(BeNil())
+		t.a.Sync()
+		Expect(t, t.a.CurrentPercentage()).To(Equal(100.0))
+		Expect(t, t.a.Promote()).To(Equal(proxy.ErrFinished))
+
+		Expect(t, t.spyEventWriter.events).To(Contain(structuredlogs.Event{
+			Code:    proxy.FinishedPlanSteps,
+			Message: "promoted by operator",
+		}))
+	})
+}
+
+func TestRestore(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TSS {
+		return TSS{
+			T:              t,
+			spyEventWriter: newSpyEventWriter(),
+			spyPredicate:   &spyPredicate{result: true},
+		}
+	})
+
+	newPlanner := func(t TSS, s proxy.StateStore, opts ...proxy.RoutePlannerOption) *proxy.RoutePlanner {
+		return proxy.NewRoutePlanner(
+			proxy.Plan{
+				{Percentage: 5, Duration: time.Hour},
+				{Percentage: 10, Duration: time.Hour},
+			},
+			t.spyPredicate.Predicate,
+			t.spyEventWriter,
+			log.New(ioutil.Discard, "", 0),
+			append(opts, proxy.WithStateStore(s, nil), proxy.WithClock(time.Now, nil))...,
+		)
+	}
+
+	o.Spec("it resumes the plan where it left off", func(t TSS) {
+		started := time.Now().Add(-time.Minute)
+		history := &spyHistory{}
+		p := newPlanner(t, &stubStateStore{s: proxy.State{
+			Version:     3,
+			Step:        1,
+			StepStarted: started,
+			Failures:    map[string]int{"canary:promql": 7},
+		}}, proxy.WithPredicateHistory("canary:promql", history))
+
+		Expect(t, p.Restore()).To(BeNil())
+		Expect(t, p.CurrentPercentage()).To(Equal(10.0))
+		Expect(t, p.Status().StepStarted.Equal(started)).To(BeTrue())
+		Expect(t, history.Failures()).To(Equal(7))
+		Expect(t, t.spyEventWriter.events).To(HaveLen(0))
+	})
+
+	o.Spec("it stores the failures of the predicates", func(t TSS) {
+		store := &stubStateStore{}
+		history := &spyHistory{}
+		p := newPlanner(t, store, proxy.WithPredicateHistory("canary:promql", history))
+		Expect(t, p.Restore()).To(BeNil())
+
+		history.RestoreFailures(3)
+		p.Sync()
+
+		s, err := store.Load()
+		Expect(t, err).To(BeNil())
+		Expect(t, s.Failures).To(Equal(map[string]int{"canary:promql": 3}))
+	})
+
+	o.Spec("it does not restart a promoted plan", func(t TSS) {
+		p := newPlanner(t, &stubStateStore{s: proxy.State{
+			Version:     1,
+			Step:        2,
+			StepStarted: time.Now(),
+		}})
+
+		Expect(t, p.Restore()).To(Equal(proxy.ErrFinished))
+		Expect(t, p.CurrentPercentage()).To(Equal(100.0))
+	})
+
+	o.Spec("it does not restart an aborted plan", func(t TSS) {
+		p := newPlanner(t, &stubStateStore{s: proxy.State{
+			Version: 1,
+			Step:    0,
+			Aborted: map[string]string{proxy.DefaultCandidate: "some-reason"},
+		}})
+
+		Expect(t, p.Restore()).To(Equal(proxy.ErrAborted))
+		Expect(t, p.CurrentPercentage()).To(Equal(0.0))
+	})
+
+	o.Spec("it keeps a promoted plan promoted once it is restored", func(t TSS) {
+		p := newPlanner(t, &stubStateStore{s: proxy.State{
+			Version:     1,
+			Step:        2,
+			StepStarted: time.Now(),
+		}})
+		t.spyPredicate.result = false
+
+		Expect(t, p.Restore()).To(Equal(proxy.ErrFinished))
+		p.Sync()
+		p.Abort(proxy.DefaultCandidate, "some-reason")
+
+		Expect(t, p.CurrentPercentage()).To(Equal(100.0))
+		Expect(t, p.Stop()).To(Equal(proxy.Promoted))
+		Expect(t, t.spyEventWriter.events).To(HaveLen(1))
+	})
+
+	o.Spec("it keeps an aborted plan aborted once it is restored", func(t TSS) {
+		p := newPlanner(t, &stubStateStore{s: proxy.State{
+			Version:     1,
+			Step:        1,
+			StepStarted: time.Now().Add(-2 * time.Hour),
+			Aborted:     map[string]string{proxy.DefaultCandidate: "some-reason"},
+		}})
+
+		Expect(t, p.Restore()).To(Equal(proxy.ErrAborted))
+		p.Sync()
+
+		Expect(t, p.CurrentPercentage()).To(Equal(0.0))
+		Expect(t, p.Stop()).To(Equal(proxy.Aborted))
+	})
+}
+
+type stubStateStore struct {
+	mu sync.Mutex
+	s  proxy.State
+}
+
+func (s *stubStateStore) Load() (proxy.State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.s, nil
+}
+
+func (s *stubStateStore) CompareAndSwap(version int64, state proxy.State) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.s.Version != version {
+		return false, nil
+	}
+	s.s = state
+
+	return true, nil
+}
+
+type spyHistory struct {
+	mu       sync.Mutex
+	failures int
+}
+
+func (s *spyHistory) Failures() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.failures
+}
+
+func (s *spyHistory) RestoreFailures(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures = n
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StepQuery runs one of a step's Queries (e.g., predicate.PromQL).
+type StepQuery interface {
+	Predicate() bool
+
+	// Evaluations returns the number of times the query has succeeded.
+	Evaluations() int
+
+	// Value returns the latest result of the query. It is included in the
+	// reason the step is aborted for.
+	Value() string
+
+	// Stop stops running the query.
+	Stop()
+}
+
+// QueryEvaluation decides which results of a step's Queries are a success.
+// Its fields are the ones of predicate.Evaluation, which is used to validate
+// and run it. The zero value succeeds on a non-empty result and fails without
+// data.
+type QueryEvaluation struct {
+	Mode      string `json:",omitempty"`
+	Threshold string `json:",omitempty"`
+	NoData    string `json:",omitempty"`
+}
+
+// String implements fmt.Stringer. Only the fields that are set are
+// included.
+func (e QueryEvaluation) String() string {
+	var fields []string
+	if e.Mode != "" {
+		fields = append(fields, fmt.Sprintf("Mode:%s", e.Mode))
+	}
+
+	if e.Threshold != "" {
+		fields = append(fields, fmt.Sprintf("Threshold:%q", e.Threshold))
+	}
+
+	if e.NoData != "" {
+		fields = append(fields, fmt.Sprintf("NoData:%s", e.NoData))
+	}
+
+	return fmt.Sprintf("{%s}", strings.Join(fields, " "))
+}
+
+// WithStepQueries sets how the Queries of each step are run. A StepQuery is
+// created for each query, along with the step's Evaluation, when the plan
+// moves on to the step and stopped when the plan moves on from it. Without
+// it, the Queries are ignored.
+func WithStepQueries(f func(query string, e QueryEvaluation) StepQuery) RoutePlannerOption {
+	return func(r *RoutePlanner) {
+		r.newStepQuery = f
+	}
+}
+
+// WithQueryPredicate sets the predicate of the global query for the given
+// candidate. Unlike the predicates given to NewRoutePlanner and
+// WithCandidatePredicate, it is not run during steps that replace the global
+// query with their own Queries.
+func WithQueryPredicate(name string, p Predicate) RoutePlannerOption {
+	return WithQueryCheck(name, func() error {
+		if !p() {
+			return errPredicateFailed
+		}
+
+		return nil
+	})
+}
+
+// WithQueryCheck is like WithQueryPredicate, but the candidate is aborted
+// with the error the check fails with (e.g., naming the query that failed).
+func WithQueryCheck(name string, c Check) RoutePlannerOption {
+	return func(r *RoutePlanner) {
+		r.queryChecks[name] = c
+	}
+}
+
+// runStepQueries starts the Queries of the given step and stops the ones
+// of the previous step. It has to be called while holding evalMu.
+func (p *RoutePlanner) runStepQueries(c currentPlan) {
+	if c.idx == p.stepQueriesIdx {
+		return
+	}
+
+	for _, q := range p.stepQueries {
+		q.Stop()
+	}
+	p.stepQueries = nil
+	p.stepQueriesIdx = c.idx
+
+	if p.newStepQuery == nil || c.idx < 0 || c.idx >= int64(len(p.plan)) {
+		return
+	}
+
+	var e QueryEvaluation
+	if p.plan[c.idx].Evaluation != nil {
+		e = *p.plan[c.idx].Evaluation
+	}
+
+	for _, query := range p.plan[c.idx].Queries {
+		p.stepQueries = append(p.stepQueries, p.newStepQuery(query, e))
+	}
+}
+
+// stepQueryFailure returns the reason the first of the current step's
+// Queries that has failed failed for. It is empty if none of them has
+// failed. It has to be called while holding evalMu.
+func (p *RoutePlanner) stepQueryFailure() string {
+	for i, q := range p.stepQueries {
+		if q.Predicate() {
+			continue
+		}
+
+		reason := fmt.Sprintf(
+			"query %d of step %d (%s) failed",
+			i+1,
+			p.stepQueriesIdx+1,
+			p.plan[p.stepQueriesIdx].Queries[i],
+		)
+		if v := q.Value(); v != "" {
+			reason = fmt.Sprintf("%s with %s", reason, v)
+		}
+
+		return reason
+	}
+
+	return ""
+}
+
+// evaluated returns true once each of the given step's Queries has
+// succeeded its MinEvaluations. It has to be called while holding evalMu.
+func (p *RoutePlanner) evaluated(idx int64) bool {
+	if idx < 0 || idx >= int64(len(p.plan)) || p.plan[idx].MinEvaluations == 0 {
+		return true
+	}
+
+	// The queries of a step another instance has moved on to have not run
+	// yet.
+	if idx != p.stepQueriesIdx {
+		return false
+	}
+
+	for _, q := range p.stepQueries {
+		if q.Evaluations() < p.plan[idx].MinEvaluations {
+			return false
+		}
+	}
+
+	return true
+}
+
+// replacesQuery returns true if the given step runs its own Queries instead
+// of the global query.
+func (p *RoutePlanner) replacesQuery(idx int64) bool {
+	return idx >= 0 && idx < int64(len(p.plan)) && p.plan[idx].ReplaceQuery
+}
@@ -0,0 +1,93 @@
+package statestore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/poy/cf-canary-router/internal/proxy"
+)
+
+// File keeps the State in a file. Instances that share a file system (or a
+// volume) can share the State through it. Changes are guarded by an
+// advisory lock on a file next to it.
+type File struct {
+	path string
+}
+
+func NewFile(path string) *File {
+	return &File{
+		path: path,
+	}
+}
+
+// Load implements proxy.StateStore.
+func (f *File) Load() (proxy.State, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return proxy.State{}, nil
+	}
+
+	if err != nil {
+		return proxy.State{}, err
+	}
+
+	var s proxy.State
+	if err := json.Unmarshal(data, &s); err != nil {
+		return proxy.State{}, err
+	}
+
+	return s, nil
+}
+
+// CompareAndSwap implements proxy.StateStore.
+func (f *File) CompareAndSwap(version int64, s proxy.State) (bool, error) {
+	lock, err := os.OpenFile(f.path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer lock.Close()
+
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return false, err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	current, err := f.Load()
+	if err != nil {
+		return false, err
+	}
+
+	if current.Version != version {
+		return false, nil
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return false, err
+	}
+
+	// Readers never see a partially written file.
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path))
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return false, err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
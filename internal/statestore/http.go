@@ -0,0 +1,149 @@
+package statestore
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/poy/cf-canary-router/internal/proxy"
+)
+
+// HTTP reads and writes the State from a server (see NewHandler). A GET
+// returns the State. A PUT with a "version" query parameter replaces it and
+// responds with a 409 if the version is no longer current.
+type HTTP struct {
+	addr   string
+	token  string
+	client *http.Client
+}
+
+func NewHTTP(addr, token string, client *http.Client) *HTTP {
+	return &HTTP{
+		addr:   addr,
+		token:  token,
+		client: client,
+	}
+}
+
+// Load implements proxy.StateStore.
+func (h *HTTP) Load() (proxy.State, error) {
+	req, err := http.NewRequest(http.MethodGet, h.addr, nil)
+	if err != nil {
+		return proxy.State{}, err
+	}
+
+	resp, err := h.do(req)
+	if err != nil {
+		return proxy.State{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return proxy.State{}, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var s proxy.State
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return proxy.State{}, err
+	}
+
+	return s, nil
+}
+
+// CompareAndSwap implements proxy.StateStore.
+func (h *HTTP) CompareAndSwap(version int64, s proxy.State) (bool, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequest(
+		http.MethodPut,
+		fmt.Sprintf("%s?version=%d", h.addr, version),
+		bytes.NewReader(data),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := h.do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+}
+
+func (h *HTTP) do(req *http.Request) (*http.Response, error) {
+	if h.token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+
+	return h.client.Do(req)
+}
+
+// NewHandler serves the given store for HTTP clients. If token is set, it is
+// required as a bearer token.
+func NewHandler(s proxy.StateStore, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			state, err := s.Load()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(state)
+		case http.MethodPut:
+			version, err := strconv.ParseInt(r.URL.Query().Get("version"), 10, 64)
+			if err != nil {
+				http.Error(w, "invalid version", http.StatusBadRequest)
+				return
+			}
+
+			var state proxy.State
+			if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			ok, err := s.CompareAndSwap(version, state)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			if !ok {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,63 @@
+// Package statestore implements proxy.StateStore so that several router
+// instances can share the progress of a plan.
+package statestore
+
+import (
+	"sync"
+
+	"github.com/poy/cf-canary-router/internal/proxy"
+)
+
+// Memory keeps the State in memory. It is used to serve the State over
+// HTTP (see NewHandler).
+type Memory struct {
+	mu sync.Mutex
+	s  proxy.State
+}
+
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// Load implements proxy.StateStore.
+func (m *Memory) Load() (proxy.State, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return clone(m.s), nil
+}
+
+// CompareAndSwap implements proxy.StateStore.
+func (m *Memory) CompareAndSwap(version int64, s proxy.State) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.s.Version != version {
+		return false, nil
+	}
+
+	m.s = clone(s)
+	return true, nil
+}
+
+// clone copies the maps of the given State so that callers can not change
+// the stored State.
+func clone(s proxy.State) proxy.State {
+	if s.Aborted != nil {
+		aborted := make(map[string]string, len(s.Aborted))
+		for name, reason := range s.Aborted {
+			aborted[name] = reason
+		}
+		s.Aborted = aborted
+	}
+
+	if s.Failures != nil {
+		failures := make(map[string]int, len(s.Failures))
+		for name, n := range s.Failures {
+			failures[name] = n
+		}
+		s.Failures = failures
+	}
+
+	return s
+}
@@ -0,0 +1,126 @@
+package statestore_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-canary-router/internal/proxy"
+	"github.com/poy/cf-canary-router/internal/statestore"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TS struct {
+	*testing.T
+	stores map[string]proxy.StateStore
+
+	dir    string
+	server *httptest.Server
+}
+
+func TestStores(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TS {
+		dir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		server := httptest.NewServer(statestore.NewHandler(statestore.NewMemory(), "some-token"))
+
+		return TS{
+			T:      t,
+			dir:    dir,
+			server: server,
+			stores: map[string]proxy.StateStore{
+				"memory": statestore.NewMemory(),
+				"file":   statestore.NewFile(filepath.Join(dir, "state")),
+				"http":   statestore.NewHTTP(server.URL, "some-token", http.DefaultClient),
+			},
+		}
+	})
+
+	o.AfterEach(func(t TS) {
+		os.RemoveAll(t.dir)
+		t.server.Close()
+	})
+
+	o.Spec("it starts without a state", func(t TS) {
+		for _, s := range t.stores {
+			state, err := s.Load()
+			Expect(t, err).To(Not(HaveOccurred()))
+			Expect(t, state.Version).To(Equal(int64(0)))
+			Expect(t, state.Aborted).To(HaveLen(0))
+		}
+	})
+
+	o.Spec("it only swaps the current version", func(t TS) {
+		started := time.Now().Round(time.Second).UTC()
+
+		for _, s := range t.stores {
+			ok, err := s.CompareAndSwap(0, proxy.State{
+				Version:     1,
+				Step:        2,
+				StepStarted: started,
+				Aborted:     map[string]string{"a": "some-reason"},
+			})
+			Expect(t, err).To(Not(HaveOccurred()))
+			Expect(t, ok).To(BeTrue())
+
+			ok, err = s.CompareAndSwap(0, proxy.State{Version: 1})
+			Expect(t, err).To(Not(HaveOccurred()))
+			Expect(t, ok).To(BeFalse())
+
+			state, err := s.Load()
+			Expect(t, err).To(Not(HaveOccurred()))
+			Expect(t, state.Version).To(Equal(int64(1)))
+			Expect(t, state.Step).To(Equal(int64(2)))
+			Expect(t, state.StepStarted.Equal(started)).To(BeTrue())
+			Expect(t, state.Aborted).To(Equal(map[string]string{"a": "some-reason"}))
+		}
+	})
+
+	o.Spec("it does not share its maps with the caller", func(t TS) {
+		for _, s := range t.stores {
+			state := proxy.State{
+				Version:  1,
+				Aborted:  map[string]string{"a": "some-reason"},
+				Failures: map[string]int{"a:promql": 2},
+			}
+			ok, err := s.CompareAndSwap(0, state)
+			Expect(t, err).To(Not(HaveOccurred()))
+			Expect(t, ok).To(BeTrue())
+			state.Aborted["b"] = "other-reason"
+			state.Failures["a:promql"] = 3
+
+			loaded, err := s.Load()
+			Expect(t, err).To(Not(HaveOccurred()))
+			loaded.Aborted["b"] = "other-reason"
+			loaded.Failures["a:promql"] = 3
+
+			loaded, err = s.Load()
+			Expect(t, err).To(Not(HaveOccurred()))
+			Expect(t, loaded.Aborted).To(Equal(map[string]string{"a": "some-reason"}))
+			Expect(t, loaded.Failures).To(Equal(map[string]int{"a:promql": 2}))
+		}
+	})
+
+	o.Spec("it requires the token over HTTP", func(t TS) {
+		s := statestore.NewHTTP(t.server.URL, "wrong-token", http.DefaultClient)
+
+		_, err := s.Load()
+		Expect(t, err).To(HaveOccurred())
+
+		_, err = s.CompareAndSwap(0, proxy.State{Version: 1})
+		Expect(t, err).To(HaveOccurred())
+	})
+}
@@ -3,10 +3,13 @@ package structuredlogs
 import (
 	"fmt"
 	"io"
+	"sync"
 )
 
 type EventStream struct {
-	s      LineStream
+	s LineStream
+
+	mu     sync.Mutex
 	writer io.Writer
 }
 
@@ -25,9 +28,25 @@ func (s *EventStream) Write(e Event) {
 		return
 	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	fmt.Fprintf(s.writer, "%s\n", data)
 }
 
+// Flush writes any buffered events. It is a no-op unless the writer buffers
+// (e.g., a bufio.Writer).
+func (s *EventStream) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f, ok := s.writer.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+
+	return nil
+}
+
 func (s *EventStream) NextEvent() Event {
 	for {
 		var e Event
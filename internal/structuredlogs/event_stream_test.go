@@ -1,6 +1,8 @@
 package structuredlogs_test
 
 import (
+	"bufio"
+	"bytes"
 	"strings"
 	"testing"
 
@@ -81,6 +83,20 @@ func TestEventStream(t *testing.T) {
 		Expect(t, e2.Code).To(Equal(101))
 		Expect(t, strings.HasSuffix(t.stubWriter.data[1], "\n")).To(BeTrue())
 	})
+
+	o.Spec("it flushes buffered events", func(t TE) {
+		var out bytes.Buffer
+		s := structuredlogs.NewEventStream(nil, bufio.NewWriter(&out))
+
+		s.Write(structuredlogs.Event{Code: 99})
+		Expect(t, out.Len()).To(Equal(0))
+
+		Expect(t, s.Flush()).To(Not(HaveOccurred()))
+
+		var e structuredlogs.Event
+		Expect(t, e.Unmarshal(out.String())).To(Not(HaveOccurred()))
+		Expect(t, e.Code).To(Equal(99))
+	})
 }
 
 type stubWriter struct {